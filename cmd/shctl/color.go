@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ----------------- Color -----------------
+//
+// Every ANSI escape the tool prints goes through colorize, so the decision
+// whether to color is made here and nowhere else.
+
+const (
+	colorDim    = "2"
+	colorRed    = "31"
+	colorGreen  = "32"
+	colorYellow = "33"
+	colorCyan   = "36"
+)
+
+var (
+	colorMode = "auto" // --color: auto, always or never
+	noColor   = false  // --no-color, the same as --color never
+
+	colorOnce                  sync.Once
+	colorEnabled, colorOnError bool
+)
+
+// useColor reports whether stdout may contain ANSI escapes: always with
+// --color always, never with --color never or --no-color, and otherwise
+// only when NO_COLOR is unset, TERM isn't dumb and stdout is a terminal,
+// so piped output is plain.
+func useColor() bool {
+	colorOnce.Do(initColor)
+	return colorEnabled
+}
+
+// useErrColor is useColor for stderr.
+func useErrColor() bool {
+	colorOnce.Do(initColor)
+	return colorOnError
+}
+
+func initColor() {
+	switch {
+	case noColor || colorMode == "never":
+	case colorMode == "always":
+		colorEnabled, colorOnError = true, true
+	case os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb":
+		colorEnabled, colorOnError = isTerminal(os.Stdout), isTerminal(os.Stderr)
+	}
+}
+
+func colorize(code, s string) string {
+	if !useColor() {
+		return s
+	}
+	return ansi(code, s)
+}
+
+func ansi(code, s string) string {
+	return "\x1b[" + code + "m" + s + "\x1b[0m"
+}
+
+// warnf prints a warning to stderr, in yellow when stderr takes colors.
+func warnf(format string, a ...any) {
+	fmt.Fprint(warnWriter(), fmt.Sprintf(format, a...))
+}
+
+// warnWriter is stderr, coloring what is written to it yellow when it
+// takes colors; the Manager writes its warnings there.
+func warnWriter() io.Writer {
+	if !useErrColor() {
+		return os.Stderr
+	}
+	return yellowWriter{os.Stderr}
+}
+
+type yellowWriter struct{ w io.Writer }
+
+func (y yellowWriter) Write(p []byte) (int, error) {
+	s := strings.TrimSuffix(string(p), "\n")
+	if _, err := io.WriteString(y.w, ansi(colorYellow, s)+string(p[len(s):])); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// colorizeEntry colors the name and the value of an alias or export line
+// differently; lines that aren't entries are returned as they are.
+func colorizeEntry(line string) string {
+	e, ok := mgr.ParseEntry(line)
+	if !useColor() || !ok {
+		return line
+	}
+	// the name follows the prefix and is followed by = or a blank
+	for i := 1; i+len(e.Name) < len(line); i++ {
+		j := i + len(e.Name)
+		if line[i-1] != ' ' && line[i-1] != '\t' || line[i:j] != e.Name || !strings.ContainsRune("= \t", rune(line[j])) {
+			continue
+		}
+		return line[:i] + colorize(colorCyan, e.Name) + line[j:j+1] + colorize(colorGreen, line[j+1:])
+	}
+	return line
+}
+
+// colorizeDiff colors a unified diff line by line.
+func colorizeDiff(d string) string {
+	if !useColor() || d == "" {
+		return d
+	}
+	lines := strings.SplitAfter(d, "\n")
+	for i, ln := range lines {
+		body := strings.TrimSuffix(ln, "\n")
+		nl := ln[len(body):]
+		switch {
+		case strings.HasPrefix(body, "+++"), strings.HasPrefix(body, "---"):
+			lines[i] = body + nl
+		case strings.HasPrefix(body, "@@"):
+			lines[i] = colorize(colorCyan, body) + nl
+		case strings.HasPrefix(body, "+"):
+			lines[i] = colorize(colorGreen, body) + nl
+		case strings.HasPrefix(body, "-"):
+			lines[i] = colorize(colorRed, body) + nl
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
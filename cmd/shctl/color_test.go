@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/marcelodevops/go-cli-tool/pkg/shctl"
+)
+
+func TestNoEscapesWhenNotATerminal(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = w, w
+	defer func() { os.Stdout, os.Stderr = stdout, stderr }()
+	if mgr == nil {
+		mgr = &shctl.Manager{}
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		noColor  bool
+		env      string // NO_COLOR
+		wantANSI bool
+	}{
+		{"auto, piped", "auto", false, "", false},
+		{"never", "never", false, "", false},
+		{"--no-color wins over always", "always", true, "", false},
+		{"NO_COLOR, piped", "auto", false, "1", false},
+		{"always, piped", "always", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NO_COLOR", tt.env)
+			t.Setenv("TERM", "xterm-256color")
+			colorMode, noColor = tt.mode, tt.noColor
+			colorOnce, colorEnabled, colorOnError = sync.Once{}, false, false
+			defer func() { colorMode, noColor, colorOnce = "auto", false, sync.Once{} }()
+
+			var warned string
+			if _, ok := warnWriter().(yellowWriter); ok {
+				warned = ansi(colorYellow, "warning")
+			}
+			outputs := []string{
+				colorize(colorRed, "error"),
+				colorizeEntry("alias ll='ls -la'"),
+				colorizeDiff("--- a\n+++ b\n@@ -1 +1 @@\n-old\n+new\n"),
+				warned,
+			}
+			for _, out := range outputs {
+				if got := strings.Contains(out, "\x1b["); got != tt.wantANSI {
+					t.Errorf("escape codes in %q: %v, want %v", out, got, tt.wantANSI)
+				}
+			}
+		})
+	}
+}
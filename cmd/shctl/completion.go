@@ -0,0 +1,185 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ----------------- Completion -----------------
+//
+// The scripts complete commands and subcommands from the tables below and
+// ask the tool itself (`alias list --names`, `export list --names`) for the
+// entry names. The bash and zsh scripts pass along the global flags already
+// typed, so --rc-file and --profile are honored.
+
+// completionCommands lists the subcommands of every command.
+var completionCommands = [][2]string{
+	{"alias", "add list import rename get remove disable enable sort dedupe"},
+	{"export", "add update list remove disable enable sort dedupe path-add path-remove path-list env dump load"},
+	{"search", ""},
+	{"migrate", ""},
+	{"sudoers", "add check list remove edit test"},
+	{"backup", "list verify delete prune"},
+	{"restore", ""},
+	{"diff", ""},
+	{"apply", ""},
+	{"dump", ""},
+	{"uninstall", ""},
+	{"undo", ""},
+	{"stats", ""},
+	{"doctor", ""},
+	{"sync", "commit push"},
+	{"rc", "validate edit"},
+	{"completion", "bash zsh fish"},
+	{"version", ""},
+	{"help", ""},
+}
+
+// completionValueFlags are the global flags that take a separate value.
+const completionValueFlags = "--retries --retry-delay --config --rc-file --rc-files --priv-cmd --shell --lock-timeout --timeout --color --entry-prefix"
+
+func handleCompletion(args []string) {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "completion requires a shell: bash, zsh or fish")
+		os.Exit(exitUsage)
+	}
+	prog := filepath.Base(os.Args[0])
+	switch fs.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletion(prog))
+	case "zsh":
+		fmt.Print(zshCompletion(prog))
+	case "fish":
+		fmt.Print(fishCompletion(prog))
+	default:
+		fmt.Fprintf(os.Stderr, "completion: unknown shell %q (want bash, zsh or fish)\n", fs.Arg(0))
+		os.Exit(exitUsage)
+	}
+}
+
+func bashCompletion(prog string) string {
+	var cmds, cases strings.Builder
+	for _, c := range completionCommands {
+		cmds.WriteString(" " + c[0])
+		if c[1] != "" {
+			fmt.Fprintf(&cases, "\t\t%s) subs=%q ;;\n", c[0], c[1])
+		}
+	}
+	return fmt.Sprintf(`# %[1]s bash completion; load with: source <(%[1]s completion bash)
+_cli_tool() {
+	local cur=${COMP_WORDS[COMP_CWORD]} cmd= sub= subs= w i
+	local -a globals=()
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		w=${COMP_WORDS[i]}
+		if [[ -z $cmd ]]; then
+			case " %[2]s " in
+			*" $w "*) globals+=("$w" "${COMP_WORDS[i+1]}"); ((i++)); continue ;;
+			esac
+			case $w in
+			-*) globals+=("$w"); continue ;;
+			esac
+			cmd=$w
+		elif [[ -z $sub && $w != -* ]]; then
+			sub=$w
+		fi
+	done
+	if [[ -z $cmd ]]; then
+		COMPREPLY=($(compgen -W "%[3]s" -- "$cur"))
+		return
+	fi
+	case $cmd in
+%[4]s	esac
+	if [[ -z $sub ]]; then
+		COMPREPLY=($(compgen -W "$subs" -- "$cur"))
+		return
+	fi
+	local kind=
+	case $cmd:$sub in
+	alias:rename | alias:get | alias:remove | alias:disable) kind=alias ;;
+	export:update | export:remove | export:disable) kind=export ;;
+	esac
+	if [[ -n $kind ]]; then
+		COMPREPLY=($(compgen -W "$("${COMP_WORDS[0]}" "${globals[@]}" $kind list --names 2>/dev/null)" -- "$cur"))
+	fi
+}
+complete -o default -F _cli_tool %[1]s
+`, prog, completionValueFlags, strings.TrimSpace(cmds.String()), cases.String())
+}
+
+func zshCompletion(prog string) string {
+	var cmds, cases strings.Builder
+	for _, c := range completionCommands {
+		cmds.WriteString(" " + c[0])
+		if c[1] != "" {
+			fmt.Fprintf(&cases, "\t%s) subs=(%s) ;;\n", c[0], c[1])
+		}
+	}
+	return fmt.Sprintf(`#compdef %[1]s
+# %[1]s zsh completion; load with: source <(%[1]s completion zsh)
+_cli_tool() {
+	local cmd= sub= w i kind=
+	local -a globals subs
+	for ((i = 2; i < CURRENT; i++)); do
+		w=${words[i]}
+		if [[ -z $cmd ]]; then
+			case " %[2]s " in
+			*" $w "*) globals+=("$w" "${words[i+1]}"); ((i++)); continue ;;
+			esac
+			case $w in
+			-*) globals+=("$w"); continue ;;
+			esac
+			cmd=$w
+		elif [[ -z $sub && $w != -* ]]; then
+			sub=$w
+		fi
+	done
+	if [[ -z $cmd ]]; then
+		compadd -- %[3]s
+		return
+	fi
+	case $cmd in
+%[4]s	esac
+	if [[ -z $sub ]]; then
+		(( ${#subs} )) && compadd -a subs || _files
+		return
+	fi
+	case $cmd:$sub in
+	alias:rename | alias:get | alias:remove | alias:disable) kind=alias ;;
+	export:update | export:remove | export:disable) kind=export ;;
+	*) _files; return ;;
+	esac
+	compadd -- ${(f)"$(${words[1]} "${globals[@]}" $kind list --names 2>/dev/null)"}
+}
+compdef _cli_tool %[1]s
+`, prog, completionValueFlags, strings.TrimSpace(cmds.String()), cases.String())
+}
+
+func fishCompletion(prog string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %[1]s fish completion; load with: %[1]s completion fish | source\n", prog)
+	var cmds []string
+	for _, c := range completionCommands {
+		cmds = append(cmds, c[0])
+	}
+	fmt.Fprintf(&b, "complete -c %s -n 'not __fish_seen_subcommand_from %s' -f -a '%s'\n",
+		prog, strings.Join(cmds, " "), strings.Join(cmds, " "))
+	for _, c := range completionCommands {
+		if c[1] != "" {
+			fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s' -f -a '%s'\n",
+				prog, c[0], c[1], c[1])
+		}
+	}
+	for _, n := range [][3]string{
+		{"alias", "rename get remove disable", "alias"},
+		{"export", "update remove disable", "export"},
+	} {
+		fmt.Fprintf(&b, "complete -c %s -n '__fish_seen_subcommand_from %s; and __fish_seen_subcommand_from %s' -f -a '(%s %s list --names 2>/dev/null)'\n",
+			prog, n[0], n[1], prog, n[2])
+	}
+	return b.String()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/marcelodevops/go-cli-tool/pkg/shctl"
+)
+
+// ----------------- Config file -----------------
+//
+// The config file format is described in pkg/shctl/config.go.
+
+// fileSettings holds the keys of the config file once loadSettings has
+// read it.
+var fileSettings = shctl.Config{}
+
+// setting resolves one value: the flag if given, then the environment
+// variable, then key in the config file, then def.
+func setting(flagValue, envValue, key, def string) string {
+	for _, v := range []string{flagValue, envValue, fileSettings[key]} {
+		if v != "" {
+			return v
+		}
+	}
+	return def
+}
+
+// pathSetting is setting for a file or directory: a leading ~ and $VAR or
+// ${VAR} are expanded as the shell would, so "~/.config/myrc" works even
+// where no shell expanded it (quoted, in --flag=~/x, or in the config).
+func pathSetting(flagValue, envValue, key, def string) string {
+	return expandPath(setting(flagValue, envValue, key, def))
+}
+
+// expandPath expands a leading ~ (the current user's home) and environment
+// variables in p.
+func expandPath(p string) string {
+	p = os.ExpandEnv(p)
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = home + p[1:]
+		}
+	}
+	return p
+}
+
+// entryPrefixFlags holds --entry-prefix overrides, keyed by entry kind.
+var entryPrefixFlags = map[string]string{}
+
+// configPath resolves the config file: --config, then BASM_CONFIG, then the
+// XDG default. explicit reports whether the user chose the file.
+func configPath() (path string, explicit bool) {
+	if configFile != "" {
+		return expandPath(configFile), true
+	}
+	if envConfig != "" {
+		return expandPath(envConfig), true
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "cli-tool", "config.toml"), false
+}
+
+// loadSettings reads the config file and applies it underneath the flags and
+// the environment. A missing default config is fine; a missing explicit one
+// is an error.
+func loadSettings() error {
+	path, explicit := configPath()
+	cfg, err := mgr.LoadConfig(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		cfg = shctl.Config{}
+	} else if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	fileSettings = cfg
+	resolvePaths()
+	if v, ok := cfg["check_syntax"]; ok && !checkSyntax {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: check_syntax: %w", err)
+		}
+		mgr.SyntaxCheck = on
+	}
+	if v, ok := cfg["follow_symlinks"]; ok && !followLinks {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("config: follow_symlinks: %w", err)
+		}
+		mgr.FollowSymlinks = on
+	}
+	if v, ok := cfg["file_mode"]; ok && fileMode == 0 {
+		mode, err := parseFileMode(v)
+		if err != nil {
+			return fmt.Errorf("config: file_mode: %w", err)
+		}
+		mgr.FileMode = mode
+	}
+	// --entry-prefix wins over the alias_prefix/export_prefix config keys
+	for _, kind := range []string{"alias", "export"} {
+		prefix, ok := entryPrefixFlags[kind]
+		if !ok {
+			prefix, ok = cfg[kind+"_prefix"]
+		}
+		if !ok {
+			continue
+		}
+		if err := mgr.SetEntryPrefix(kind, prefix); err != nil {
+			return err
+		}
+	}
+	// checked after the prefixes, as a marker mustn't read as an entry
+	begin, setBegin := cfg["managed_begin"]
+	end, setEnd := cfg["managed_end"]
+	if setBegin || setEnd {
+		if !setBegin {
+			begin = shctl.DefaultManagedBegin
+		}
+		if !setEnd {
+			end = shctl.DefaultManagedEnd
+		}
+		if err := mgr.SetManagedMarkers(begin, end); err != nil {
+			return fmt.Errorf("config: %w", err)
+		}
+	}
+	return nil
+}
+
+// entryPrefixFlag implements --entry-prefix kind=prefix.
+type entryPrefixFlag struct{}
+
+func (entryPrefixFlag) String() string { return "" }
+
+func (entryPrefixFlag) Set(v string) error {
+	kind, prefix, ok := strings.Cut(v, "=")
+	if !ok || (kind != "alias" && kind != "export") {
+		return fmt.Errorf("expected alias=<prefix> or export=<prefix>, got %q", v)
+	}
+	entryPrefixFlags[kind] = prefix
+	return nil
+}
+
+// fileModeFlag implements --mode.
+type fileModeFlag struct{}
+
+func (fileModeFlag) String() string { return "" }
+
+func (fileModeFlag) Set(v string) error {
+	mode, err := parseFileMode(v)
+	fileMode = mode
+	return err
+}
+
+// parseFileMode parses octal permission bits such as 0600 or 600. The
+// owner must be able to read and write, or the next change would fail.
+func parseFileMode(v string) (fs.FileMode, error) {
+	n, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("expected octal permission bits such as 0600, got %q", v)
+	}
+	if n&0o600 != 0o600 {
+		return 0, fmt.Errorf("mode %04o doesn't let the owner read and write the file", n)
+	}
+	return fs.FileMode(n), nil
+}
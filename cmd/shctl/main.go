@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,54 +10,229 @@ import (
 	"io/fs"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/marcelodevops/go-cli-tool/pkg/shctl"
 )
 
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=...
+// -X main.date=..." (see the Makefile).
 var (
-	// Environment overrides
-	envRCFile     = getenvDefault("BASM_RC_FILE", "")
-	envSudoers    = getenvDefault("BASM_SUDOERS_PATH", "")
-	envBackupDir  = getenvDefault("BASM_BACKUP_DIR", "/tmp")
-	shellPath     = getenvDefault("SHELL", "/bin/bash")
-	defaultIsZsh  = strings.HasSuffix(shellPath, "zsh")
-	defaultRCName = ".bashrc"
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
 )
 
-func init() {
-	if defaultIsZsh {
-		defaultRCName = ".zshrc"
-	}
-}
+var (
+	// Environment overrides
+	envRCFile    = getenvDefault("BASM_RC_FILE", "")
+	envSudoers   = getenvDefault("BASM_SUDOERS_PATH", "")
+	envBackupDir = getenvDefault("BASM_BACKUP_DIR", "")
+	envConfig    = getenvDefault("BASM_CONFIG", "")
+	envVisudo    = getenvDefault("BASM_VISUDO_PATH", "")
+	envPrivCmd   = getenvDefault("BASM_PRIV_CMD", "")
+	envAuditLog  = getenvDefault("BASM_AUDIT_LOG", "")
+	shellPath    = getenvDefault("SHELL", "/bin/bash")
+
+	// Global flags
+	retries     = 0
+	retryDelay  = 100 * time.Millisecond
+	configFile  = ""
+	verbose     = false
+	checkSyntax = false
+	followLinks = false
+	fileMode    fs.FileMode // --mode; zero when not given
+	jsonOutput  = false
+	rcFileFlag  = ""
+	rcFilesFlag = ""
+	useProfile  = false
+	shellFlag   = ""
+	privCmdFlag = ""
+	dryRun      = false
+	quiet       = false
+	lockTimeout = 10 * time.Second
+	cmdTimeout  = shctl.DefaultCommandTimeout
+	showVersion = false
+
+	// mgr carries out every command on the files selected above.
+	mgr *shctl.Manager
+)
 
 func main() {
-	if len(os.Args) < 2 {
+	args := parseGlobalFlags(os.Args[1:])
+	if showVersion || len(args) > 0 && args[0] == "version" {
+		printVersion()
+		return
+	}
+	if len(args) < 1 {
 		usageAndExit()
 	}
+	mgr = newManager()
+	removeTempsOnSignal()
+	if err := loadSettings(); err != nil {
+		dieErr(err)
+	}
+
+	mgr.Command = strings.Join(args, " ")
 
-	cmd := os.Args[1]
+	cmd := args[0]
+	if len(args) > 1 && isHelpArg(args[1]) && hasCommandHelp(cmd) {
+		helpAndExit(cmd)
+	}
 	switch cmd {
 	case "alias":
-		handleAlias(os.Args[2:])
+		handleAlias(args[1:])
 	case "export":
-		handleExport(os.Args[2:])
+		handleExport(args[1:])
 	case "sudoers":
-		handleSudoers(os.Args[2:])
+		handleSudoers(args[1:])
 	case "backup":
-		handleBackup(os.Args[2:])
+		handleBackup(args[1:])
 	case "restore":
-		handleRestore(os.Args[2:])
+		handleRestore(args[1:])
 	case "apply":
-		handleApply()
-	case "help", "--help", "-h":
-		usageAndExit()
+		handleApply(args[1:])
+	case "dump":
+		handleDump(args[1:])
+	case "search":
+		handleSearch(args[1:])
+	case "migrate":
+		handleMigrate(args[1:])
+	case "rc":
+		handleRC(args[1:])
+	case "completion":
+		handleCompletion(args[1:])
+	case "uninstall":
+		handleUninstall(args[1:])
+	case "undo":
+		handleUndo(args[1:])
+	case "stats":
+		handleStats(args[1:])
+	case "sync":
+		handleSync(args[1:])
+	case "diff":
+		handleDiff(args[1:])
+	case "doctor":
+		handleDoctor(args[1:])
+	case "help":
+		if len(args) > 1 {
+			helpAndExit(args[1])
+		}
+		helpAndExit("")
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", cmd)
 		usageAndExit()
 	}
 }
 
+// parseGlobalFlags consumes the flags placed before the command name and
+// returns the remaining arguments.
+func parseGlobalFlags(args []string) []string {
+	fs := flag.NewFlagSet("cli-tool", flag.ContinueOnError)
+	fs.IntVar(&retries, "retries", retries, "retry transient file errors this many times")
+	fs.DurationVar(&retryDelay, "retry-delay", retryDelay, "initial delay between retries (doubles each attempt)")
+	fs.StringVar(&configFile, "config", "", "read settings from this config file")
+	fs.StringVar(&rcFileFlag, "rc-file", "", "operate on this rc file")
+	fs.StringVar(&rcFilesFlag, "rc-files", "", "alias/export add and remove: operate on each of these comma-separated rc files")
+	fs.BoolVar(&useProfile, "profile", false, "operate on the login profile (~/.bash_profile or ~/.zprofile)")
+	fs.StringVar(&shellFlag, "shell", "", "target shell syntax: bash, zsh or fish (default: from $SHELL)")
+	fs.StringVar(&privCmdFlag, "priv-cmd", "", "run privileged copies with sudo, doas or pkexec (default: sudo)")
+	fs.BoolVar(&verbose, "verbose", false, "show extra diagnostics such as visudo output")
+	fs.BoolVar(&checkSyntax, "check-syntax", false, "refuse alias/export changes that leave the rc file unparsable ($SHELL -n)")
+	fs.BoolVar(&followLinks, "follow-symlinks", false, "write through a symlinked rc file to the file it points to")
+	fs.Var(fileModeFlag{}, "mode", "permission bits (octal, e.g. 0600) of files the tool creates (default 0644)")
+	fs.BoolVar(&noColor, "no-color", false, "never use ANSI colors")
+	fs.StringVar(&colorMode, "color", colorMode, "use ANSI colors: auto, always or never")
+	fs.BoolVar(&quiet, "quiet", false, "print only data on stdout, no confirmations or notices")
+	fs.BoolVar(&jsonOutput, "json", false, "print machine-readable JSON where supported")
+	fs.BoolVar(&dryRun, "dry-run", false, "show what would change without writing anything")
+	fs.DurationVar(&lockTimeout, "lock-timeout", lockTimeout, "how long to wait for another run's lock on a file")
+	fs.DurationVar(&cmdTimeout, "timeout", cmdTimeout, "kill visudo or sudo after this long (0 waits forever)")
+	fs.BoolVar(&showVersion, "version", false, "print the version and exit")
+	fs.Var(entryPrefixFlag{}, "entry-prefix", "recognize entries by this prefix: alias=<prefix> or export=<prefix>")
+	fs.Usage = func() {}
+	if err := fs.Parse(args); errors.Is(err, flag.ErrHelp) {
+		helpAndExit("")
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr)
+		usageAndExit()
+	}
+	switch shellFlag {
+	case "", "bash", "zsh", "fish":
+	default:
+		fmt.Fprintf(os.Stderr, "--shell must be bash, zsh or fish, got %q\n", shellFlag)
+		os.Exit(exitUsage)
+	}
+	switch colorMode {
+	case "auto", "always", "never":
+	default:
+		fmt.Fprintf(os.Stderr, "--color must be auto, always or never, got %q\n", colorMode)
+		os.Exit(exitUsage)
+	}
+	if rcFilesFlag != "" {
+		rest := fs.Args()
+		switch {
+		case rcFileFlag != "" || useProfile:
+			fmt.Fprintln(os.Stderr, "--rc-files can't be combined with --rc-file or --profile")
+			os.Exit(exitUsage)
+		case len(rest) < 2 || rest[0] != "alias" && rest[0] != "export" || rest[1] != "add" && rest[1] != "remove":
+			fmt.Fprintln(os.Stderr, "--rc-files only applies to alias/export add and remove")
+			os.Exit(exitUsage)
+		}
+	}
+	return fs.Args()
+}
+
+// printVersion prints the build metadata. Builds without -ldflags fall
+// back to what the Go toolchain recorded: the module version for
+// `go install`, the VCS revision and time for builds in a git checkout.
+func printVersion() {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		vcs := map[string]string{}
+		for _, s := range info.Settings {
+			vcs[s.Key] = s.Value
+		}
+		if c == "none" && vcs["vcs.revision"] != "" {
+			c = vcs["vcs.revision"]
+			if vcs["vcs.modified"] == "true" {
+				c += "-dirty"
+			}
+		}
+		if d == "unknown" && vcs["vcs.time"] != "" {
+			d = vcs["vcs.time"]
+		}
+	}
+	fmt.Printf("cli-tool %s (commit %s, built %s, %s %s/%s)\n", v, c, d, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// removeTempsOnSignal makes SIGINT and SIGTERM remove the temp files of
+// the change in progress before exiting: they may be copies of sudoers.
+func removeTempsOnSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		shctl.RemoveTempFiles()
+		code := 130
+		if sig == syscall.SIGTERM {
+			code = 143
+		}
+		os.Exit(code)
+	}()
+}
+
 // ----------------- Helpers: env, paths -----------------
 
 func getenvDefault(k, def string) string {
@@ -66,62 +242,139 @@ func getenvDefault(k, def string) string {
 	return def
 }
 
-func rcFilePath() string {
-	if envRCFile != "" {
-		return envRCFile
+// targetShell is the shell whose syntax is written: --shell, else $SHELL.
+func targetShell() string {
+	if shellFlag != "" {
+		return shellFlag
 	}
-	home, _ := os.UserHomeDir()
-	return filepath.Join(home, defaultRCName)
+	return filepath.Base(shellPath)
 }
 
-func sudoersPath() string {
-	if envSudoers != "" {
-		return envSudoers
+// defaultRCFiles returns the interactive rc file and the login profile of
+// shell, relative to the home directory.
+func defaultRCFiles(shell string) (rc, profile string) {
+	switch shell {
+	case "zsh":
+		return ".zshrc", ".zprofile"
+	case "fish":
+		// fish reads config.fish for login and interactive shells alike
+		f := filepath.Join(".config", "fish", "config.fish")
+		return f, f
 	}
-	return "/etc/sudoers"
+	return ".bashrc", ".bash_profile"
 }
 
-func backupDir() string {
-	return envBackupDir
+// rcFilePath resolves the rc file: --rc-file, then --profile, then
+// BASM_RC_FILE, then rc_file in the config, then the interactive rc file of
+// the target shell.
+func rcFilePath() string {
+	home, _ := os.UserHomeDir()
+	rc, profile := defaultRCFiles(targetShell())
+	if useProfile && rcFileFlag == "" {
+		return filepath.Join(home, profile)
+	}
+	return pathSetting(rcFileFlag, envRCFile, "rc_file", filepath.Join(home, rc))
 }
 
-// ----------------- Usage -----------------
-
-func usageAndExit() {
-	fmt.Print(`cli-tool (Go)
-
-Usage:
-  cli-tool <command> [subcommand] [args...]
-
-Commands:
-  alias    add <name> <command>   : add alias
-           list                    : list aliases
-           remove <name>           : remove alias
+// rcFiles returns the files named by --rc-files, with ~ and $VARs
+// expanded.
+func rcFiles() []string {
+	var files []string
+	for _, f := range strings.Split(rcFilesFlag, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			files = append(files, expandPath(f))
+		}
+	}
+	return files
+}
 
-  export   add <VAR> <value>      : add export
-           list                    : list exports
-           remove <VAR>            : remove export
+// forEachRC runs change on the rc file or, with --rc-files, on each of
+// them in turn with its own syntax, all or nothing: when one fails, the
+// ones already changed are put back and listed.
+func forEachRC(change func() error) error {
+	if rcFilesFlag == "" {
+		return change()
+	}
+	results, err := mgr.EachRC(rcFiles(), change)
+	for _, r := range results {
+		if r.RolledBack {
+			warnf("%s: rolled back\n", r.File)
+		}
+	}
+	return err
+}
 
-  sudoers  add <entry>            : add sudoers entry (uses visudo validation)
-           list                    : list non-comment sudoers lines
-           remove <pattern>        : remove lines containing pattern (validates)
+// stateDir is $XDG_STATE_HOME/cli-tool, or ~/.local/state/cli-tool
+// (%LocalAppData%\cli-tool on Windows): private to the user, unlike /tmp.
+// Backups, the undo journal and the audit log default to it.
+func stateDir() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" && runtime.GOOS == "windows" {
+		dir, _ = os.UserCacheDir()
+	}
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "cli-tool")
+}
 
-  backup   [--no-rc] [--no-sudoers] : backup files to backup dir
-  restore  [--no-rc] [--no-sudoers] : restore from backups (sudo may be required)
+// resolvePaths sets the Manager's files from the flags, the environment
+// and the config file, in that order of precedence.
+func resolvePaths() {
+	mgr.RCFile = rcFilePath()
+	mgr.SudoersFile = pathSetting("", envSudoers, "sudoers_path", "")
+	mgr.BackupDir = pathSetting("", envBackupDir, "backup_dir", filepath.Join(stateDir(), "backups"))
+	mgr.Visudo = pathSetting("", envVisudo, "visudo_path", "")
+	mgr.PrivCmd = setting(privCmdFlag, envPrivCmd, "priv_cmd", "")
+	mgr.JournalDir = filepath.Join(stateDir(), "journal")
+	mgr.AuditLog = pathSetting("", envAuditLog, "audit_log", filepath.Join(stateDir(), "audit.log"))
+}
 
-  apply    : source the RC file in a shell (spawns shell - won't affect current process)
+// newManager builds the Manager for the settings chosen by the global
+// flags; loadSettings fills in the files once the config has been read.
+func newManager() *shctl.Manager {
+	cfg, _ := configPath()
+	return &shctl.Manager{
+		ConfigFile: cfg,
+		Shell:      targetShell(),
+		DryRun:     dryRun,
+		Preview: func(path, diff string) {
+			if diff == "" {
+				fmt.Printf("%s: no changes\n", path)
+				return
+			}
+			fmt.Print(colorizeDiff(diff))
+		},
+		Stdout:         notices(),
+		Stderr:         warnWriter(),
+		Verbose:        verbose,
+		SyntaxCheck:    checkSyntax,
+		FollowSymlinks: followLinks,
+		FileMode:       fileMode,
+		Retries:        retries,
+		RetryDelay:     retryDelay,
+		LockTimeout:    lockTimeout,
+		// 0 on the command line means no limit; the Manager's zero value
+		// means the default
+		CommandTimeout: commandTimeout(),
+	}
+}
 
-Environment overrides:
-  BASM_RC_FILE        - path to rc file (default: ~/.bashrc or ~/.zshrc)
-  BASM_SUDOERS_PATH   - path to sudoers (default: /etc/sudoers)
-  BASM_BACKUP_DIR     - backup directory (default: /tmp)
+// notices is where the Manager's progress notices go: stdout, or nowhere
+// with --quiet.
+func notices() io.Writer {
+	if quiet {
+		return nil
+	}
+	return os.Stdout
+}
 
-Examples:
-  cli-tool alias add ll "ls -la"
-  cli-tool alias list
-  cli-tool sudoers add "myuser ALL=(ALL) NOPASSWD: /usr/bin/somebinary"
-`)
-	os.Exit(1)
+func commandTimeout() time.Duration {
+	if cmdTimeout <= 0 {
+		return -1
+	}
+	return cmdTimeout
 }
 
 // ----------------- Alias commands -----------------
@@ -134,533 +387,1902 @@ func handleAlias(args []string) {
 	action := args[0]
 	switch action {
 	case "add":
-		if len(args) != 3 {
-			fmt.Fprintln(os.Stderr, "alias add requires name and command")
-			os.Exit(2)
+		fs := flag.NewFlagSet("alias add", flag.ExitOnError)
+		stdout := fs.Bool("stdout", false, "Print the line that would be written instead of touching any file")
+		keepGoing := fs.Bool("continue-on-error", false, "With -, skip lines that fail instead of stopping")
+		comment := fs.String("comment", "", "Write `reason` as a comment line above the alias")
+		strict := fs.Bool("strict", false, "Refuse an alias that shadows a shell builtin or a command on $PATH")
+		var tags stringList
+		fs.Var(&tags, "tag", "Tag the alias with `name` (repeatable)")
+		fs.Parse(args[1:])
+		if fs.NArg() == 1 && fs.Arg(0) == "-" && !*stdout {
+			addFromStdin("alias", shctl.ExportOptions{}, *keepGoing)
+			return
+		}
+		if fs.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "alias add requires name and command, or - to read them from stdin")
+			os.Exit(exitUsage)
 		}
-		name, cmd := args[1], args[2]
-		if err := addAlias(name, cmd); err != nil {
+		name, cmd := fs.Arg(0), fs.Arg(1)
+		if *stdout {
+			line, err := mgr.AliasLine(name, cmd)
+			if err != nil {
+				dieErr(err)
+			}
+			c, err := shctl.TagComment(*comment, tags)
+			if err != nil {
+				dieErr(err)
+			}
+			printLine(name, cmd, line, c)
+			return
+		}
+		if what := mgr.AliasShadows(name); what != "" {
+			if *strict {
+				fmt.Fprintf(os.Stderr, "error: alias %s would shadow %s\n", name, what)
+				os.Exit(exitInvalid)
+			}
+			warnf("warning: alias %s shadows %s\n", name, what)
+		}
+		err := forEachRC(func() error {
+			updated, err := mgr.AddAliasTagged(name, cmd, *comment, tags)
+			if err != nil {
+				return err
+			}
+			if updated {
+				printDone("Alias '%s' updated in %s\n", name, mgr.RCFile)
+			} else {
+				printDone("Alias '%s' added to %s\n", name, mgr.RCFile)
+			}
+			return nil
+		})
+		if err != nil {
 			dieErr(err)
 		}
-		fmt.Printf("Alias '%s' added to %s\n", name, rcFilePath())
 	case "list":
-		if err := listAliases(); err != nil {
+		handleList("alias", args[1:])
+	case "disable", "enable":
+		handleToggle("alias", action, args[1:])
+	case "sort":
+		handleSort("alias")
+	case "dedupe":
+		handleDedupe("alias")
+	case "import":
+		fs := flag.NewFlagSet("alias import", flag.ExitOnError)
+		strict := fs.Bool("strict", false, "Abort without writing anything if any line is malformed")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "alias import requires file")
+			os.Exit(exitUsage)
+		}
+		res, err := mgr.ImportAliases(fs.Arg(0), *strict)
+		if err != nil {
 			dieErr(err)
 		}
-	case "remove":
-		if len(args) != 2 {
-			fmt.Fprintln(os.Stderr, "alias remove requires name")
-			os.Exit(2)
+		printDone("Imported aliases into %s: %d added, %d updated, %d skipped\n", mgr.RCFile, res.Added, res.Updated, res.Skipped)
+	case "rename":
+		fs := flag.NewFlagSet("alias rename", flag.ExitOnError)
+		force := fs.Bool("force", false, "Overwrite an existing alias with the new name")
+		fs.Parse(args[1:])
+		if fs.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "alias rename requires old and new name")
+			os.Exit(exitUsage)
+		}
+		if err := mgr.RenameAlias(fs.Arg(0), fs.Arg(1), *force); err != nil {
+			dieErr(err)
+		}
+		printDone("Alias '%s' renamed to '%s' in %s\n", fs.Arg(0), fs.Arg(1), mgr.RCFile)
+	case "get":
+		fs := flag.NewFlagSet("alias get", flag.ExitOnError)
+		valueOnly := fs.Bool("value-only", false, "Print only the command")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "alias get requires name")
+			os.Exit(exitUsage)
 		}
-		if err := removeAlias(args[1]); err != nil {
+		e, ok, err := mgr.Lookup("alias", fs.Arg(0))
+		if err != nil {
 			dieErr(err)
 		}
-		fmt.Printf("Alias '%s' removed (if present) from %s\n", args[1], rcFilePath())
+		if !ok {
+			// a distinct code so scripts can test for existence
+			os.Exit(exitNotFound)
+		}
+		if *valueOnly {
+			fmt.Println(e.Value)
+		} else {
+			fmt.Println(e.Raw)
+		}
+	case "remove":
+		handleRemove("alias", args[1:])
 	default:
 		fmt.Fprintf(os.Stderr, "alias: unknown action %s\n", action)
 		usageAndExit()
 	}
 }
 
-func addAlias(name, command string) error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
-	}
-	line := fmt.Sprintf("alias %s='%s'\n", name, command)
-	return appendAtomic(path, []byte(line))
-}
+// handleList implements `alias list` and `export list`.
+func handleList(kind string, args []string) {
+	fs := flag.NewFlagSet(kind+" list", flag.ExitOnError)
+	sinceBackup := fs.Bool("since-backup", false, "Show what changed since the latest rc backup")
+	strict := fs.Bool("strict", false, "With --since-backup, exit 1 if anything changed")
+	grepName := fs.String("grep-name", "", "Only show entries whose name matches")
+	grepValue := fs.String("grep-value", "", "Only show entries whose value/command matches")
+	useRegex := fs.Bool("regex", false, "Treat --grep-name/--grep-value as regular expressions")
+	names := fs.Bool("names", false, "Print only the names, one per line (used by shell completion)")
+	all := fs.Bool("all", false, "Also show disabled entries")
+	long := fs.Bool("long", false, "Show each entry's comment above it")
+	tag := fs.String("tag", "", "Only show entries tagged with `name`")
+	fs.Parse(args)
 
-func listAliases() error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
-	}
-	f, err := os.Open(path)
+	nameMatch, err := newMatcher(*grepName, *useRegex)
 	if err != nil {
-		return err
+		dieErr(err)
 	}
-	defer f.Close()
-	return scanAndPrintPrefix(f, "alias ")
-}
-
-func removeAlias(name string) error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
+	valueMatch, err := newMatcher(*grepValue, *useRegex)
+	if err != nil {
+		dieErr(err)
 	}
-	return removeLinesContainingPrefix(path, fmt.Sprintf("alias %s=", name))
-}
-
-// ----------------- Export commands -----------------
+	filtered := *grepName != "" || *grepValue != "" || *tag != ""
 
-func handleExport(args []string) {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "export: requires subcommand")
-		usageAndExit()
-	}
-	action := args[0]
-	switch action {
-	case "add":
-		if len(args) != 3 {
-			fmt.Fprintln(os.Stderr, "export add requires var and value")
-			os.Exit(2)
-		}
-		if err := addExport(args[1], args[2]); err != nil {
+	if *sinceBackup {
+		changes, err := mgr.EntriesSinceBackup(kind)
+		if err != nil {
 			dieErr(err)
 		}
-		fmt.Printf("Export '%s' added to %s\n", args[1], rcFilePath())
-	case "list":
-		if err := listExports(); err != nil {
-			dieErr(err)
+		var shown []shctl.EntryChange
+		for _, c := range changes {
+			if nameMatch(c.Name) && (valueMatch(c.Old) || valueMatch(c.New)) {
+				shown = append(shown, c)
+			}
 		}
-	case "remove":
-		if len(args) != 2 {
-			fmt.Fprintln(os.Stderr, "export remove requires var")
-			os.Exit(2)
+		changes = shown
+		if jsonOutput {
+			if err := printJSON(changes); err != nil {
+				dieErr(err)
+			}
+		} else {
+			printEntryChanges(changes)
 		}
-		if err := removeExport(args[1]); err != nil {
-			dieErr(err)
+		if *strict && len(changes) > 0 {
+			os.Exit(exitNotFound)
 		}
-		fmt.Printf("Export '%s' removed (if present) from %s\n", args[1], rcFilePath())
-	default:
-		fmt.Fprintf(os.Stderr, "export: unknown action %s\n", action)
-		usageAndExit()
+		return
 	}
-}
 
-func addExport(varName, value string) error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
+	match := func(e shctl.Entry) bool {
+		return nameMatch(e.Name) && valueMatch(e.Value) && (*tag == "" || e.HasTag(*tag))
 	}
-	if strings.ContainsAny(value, " ") {
-		value = fmt.Sprintf("\"%s\"", value)
-	}
-	line := fmt.Sprintf("export %s=%s\n", varName, value)
-	return appendAtomic(path, []byte(line))
-}
-
-func listExports() error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
+	switch {
+	case *names:
+		err = listEntryNames(kind, match)
+	case jsonOutput:
+		err = listEntriesJSON(kind, match, *all)
+	case filtered || *all || *long:
+		err = listEntries(kind, match, *all, *long)
+	default:
+		var lines []string
+		lines, err = mgr.Lines(kind)
+		for _, line := range lines {
+			fmt.Println(colorizeEntry(line))
+		}
 	}
-	f, err := os.Open(path)
 	if err != nil {
-		return err
+		dieErr(err)
 	}
-	defer f.Close()
-	return scanAndPrintPrefix(f, "export ")
 }
 
-func removeExport(varName string) error {
-	path := rcFilePath()
-	if err := ensureFile(path); err != nil {
-		return err
+func printEntryChanges(changes []shctl.EntryChange) {
+	for _, c := range changes {
+		switch c.Op {
+		case "added":
+			fmt.Println(colorize(colorGreen, fmt.Sprintf("+ %s=%s", c.Name, c.New)))
+		case "removed":
+			fmt.Println(colorize(colorRed, fmt.Sprintf("- %s=%s", c.Name, c.Old)))
+		case "changed":
+			fmt.Println(colorize(colorYellow, fmt.Sprintf("~ %s=%s -> %s", c.Name, c.Old, c.New)))
+		}
 	}
-	return removeLinesContainingPrefix(path, fmt.Sprintf("export %s=", varName))
 }
 
-// ----------------- Sudoers commands -----------------
-
-func handleSudoers(args []string) {
-	if len(args) < 1 {
-		fmt.Fprintln(os.Stderr, "sudoers: requires subcommand")
-		usageAndExit()
+// listEntries prints the rc lines of the given kind accepted by match;
+// with all, the disabled ones too, and with long, each below its comment.
+func listEntries(kind string, match func(shctl.Entry) bool, all, long bool) error {
+	entries, disabled, err := selectEntries(kind, match, all)
+	if err != nil {
+		return err
 	}
-	action := args[0]
-	switch action {
-	case "add":
-		if len(args) != 2 {
-			fmt.Fprintln(os.Stderr, "sudoers add requires entry string (wrap it in quotes)")
-			os.Exit(2)
-		}
-		if err := sudoersAdd(args[1]); err != nil {
-			dieErr(err)
-		}
-	case "list":
-		if err := sudoersList(); err != nil {
-			dieErr(err)
-		}
-	case "remove":
-		if len(args) != 2 {
-			fmt.Fprintln(os.Stderr, "sudoers remove requires pattern")
-			os.Exit(2)
+	for _, e := range entries {
+		if long && e.Comment != "" {
+			fmt.Println(colorize(colorDim, "# "+e.Comment))
 		}
-		if err := sudoersRemove(args[1]); err != nil {
-			dieErr(err)
+		if disabled[e.Line] {
+			fmt.Println(colorize(colorYellow, e.Raw))
+		} else {
+			fmt.Println(colorizeEntry(e.Raw))
 		}
-	default:
-		fmt.Fprintf(os.Stderr, "sudoers: unknown action %s\n", action)
-		usageAndExit()
 	}
+	return nil
 }
 
-func sudoersList() error {
-	path := sudoersPath()
-	f, err := os.Open(path)
+// selectEntries returns the entries of kind accepted by match; with all,
+// merged in file order with the disabled ones, whose lines are returned in
+// disabled.
+func selectEntries(kind string, match func(shctl.Entry) bool, all bool) ([]shctl.Entry, map[int]bool, error) {
+	entries, err := mgr.Entries(kind, match)
+	if err != nil || !all {
+		return entries, nil, err
+	}
+	off, err := mgr.DisabledEntries(kind)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	defer f.Close()
-	return scanAndPrintNonComment(f)
+	disabled := map[int]bool{}
+	for _, e := range off {
+		if match(e) {
+			entries = append(entries, e)
+			disabled[e.Line] = true
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Line < entries[j].Line })
+	return entries, disabled, nil
 }
 
-// copy to temp, append entry, validate with visudo -c -f <tmp>, then apply
-func sudoersAdd(entry string) error {
-	orig := sudoersPath()
-	tmp, err := copyToTemp(orig)
+// listEntryNames prints the names of the selected entries, each once.
+func listEntryNames(kind string, match func(shctl.Entry) bool) error {
+	entries, err := mgr.Entries(kind, match)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmp)
-
-	// Append entry
-	if err := appendFile(tmp, []byte("\n"+entry+"\n")); err != nil {
-		return err
-	}
-
-	// Validate
-	if err := visudoValidate(tmp); err != nil {
-		return fmt.Errorf("visudo validation failed: %w", err)
-	}
-
-	// Apply (may need sudo if writing to /etc/sudoers)
-	if err := copyBack(tmp, orig); err != nil {
-		return err
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if !seen[e.Name] {
+			seen[e.Name] = true
+			fmt.Println(e.Name)
+		}
 	}
-
-	fmt.Println("Sudoers entry added and applied.")
 	return nil
 }
 
-func sudoersRemove(pattern string) error {
-	orig := sudoersPath()
-	tmp, err := copyToTemp(orig)
+type entryJSON struct {
+	Name     string   `json:"name"`
+	Value    string   `json:"value"`
+	Disabled bool     `json:"disabled,omitempty"`
+	Line     string   `json:"line,omitempty"` // as written to the rc file
+	Comment  string   `json:"comment,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// addFromStdin implements `alias|export add -`: every "name value" line of
+// stdin is added, then the counts are printed. A failing line stops the
+// run with its exit code unless keepGoing, which skips it.
+func addFromStdin(kind string, opts shctl.ExportOptions, keepGoing bool) {
+	if rcFilesFlag != "" {
+		fmt.Fprintf(os.Stderr, "%s add - reads stdin once, so it can't be combined with --rc-files\n", kind)
+		os.Exit(exitUsage)
+	}
+	res, err := mgr.AddEntries(kind, os.Stdin, opts, keepGoing)
 	if err != nil {
-		return err
+		err = fmt.Errorf("stdin: %w", err)
 	}
-	defer os.Remove(tmp)
-
-	// Remove lines containing pattern
-	if err := removeLinesContaining(tmp, pattern); err != nil {
-		return err
+	printDone("Read %s entries from stdin into %s: %d added, %d updated, %d skipped\n", kind, mgr.RCFile, res.Added, res.Updated, res.Skipped)
+	if err != nil {
+		dieErr(err)
 	}
+}
 
-	// Validate
-	if err := visudoValidate(tmp); err != nil {
-		return fmt.Errorf("visudo validation failed after removal: %w", err)
+// printLine prints the rc line of an entry for add --stdout, below its
+// comment if any, or with --json as a {name, value, line, comment} object.
+func printLine(name, value, line, comment string) {
+	comment = strings.TrimSpace(comment)
+	if !jsonOutput {
+		if comment != "" {
+			fmt.Println("# " + comment)
+		}
+		fmt.Println(line)
+		return
+	}
+	if err := printJSON(entryJSON{Name: name, Value: value, Line: line, Comment: comment, Tags: shctl.ParseTags(comment)}); err != nil {
+		dieErr(err)
 	}
+}
 
-	// Apply
-	if err := copyBack(tmp, orig); err != nil {
+// listEntriesJSON prints the selected entries as a JSON array of
+// {name, value} objects with shell quoting removed; with all, disabled
+// entries are included and marked.
+func listEntriesJSON(kind string, match func(shctl.Entry) bool, all bool) error {
+	entries, disabled, err := selectEntries(kind, match, all)
+	if err != nil {
 		return err
 	}
-
-	fmt.Printf("Removed lines containing pattern: %s\n", pattern)
-	return nil
+	out := []entryJSON{}
+	for _, e := range entries {
+		out = append(out, entryJSON{Name: e.Name, Value: e.Value, Disabled: disabled[e.Line], Comment: e.Comment, Tags: e.Tags})
+	}
+	return printJSON(out)
 }
 
-// ----------------- Backup & Restore -----------------
-
-func handleBackup(args []string) {
-	fs := flag.NewFlagSet("backup", flag.ExitOnError)
-	noRc := fs.Bool("no-rc", false, "Don't backup RC file")
-	noSudo := fs.Bool("no-sudoers", false, "Don't backup sudoers")
-	fs.Parse(args)
-
-	results, err := backup(!*noRc, !*noSudo)
+// handleToggle implements `alias|export disable|enable <name>`.
+func handleToggle(kind, action string, args []string) {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "%s %s requires name\n", kind, action)
+		os.Exit(exitUsage)
+	}
+	toggle, done := mgr.DisableEntry, "disabled"
+	if action == "enable" {
+		toggle, done = mgr.EnableEntry, "enabled"
+	}
+	changed, err := toggle(kind, args[0])
 	if err != nil {
 		dieErr(err)
 	}
-	for k, v := range results {
-		fmt.Printf("Backed up %s -> %s\n", k, v)
+	title := strings.ToUpper(kind[:1]) + kind[1:]
+	if changed {
+		printDone("%s '%s' %s in %s\n", title, args[0], done, mgr.RCFile)
+	} else {
+		printDone("%s '%s' is already %s\n", title, args[0], done)
 	}
 }
 
-func handleRestore(args []string) {
-	fs := flag.NewFlagSet("restore", flag.ExitOnError)
-	noRc := fs.Bool("no-rc", false, "Don't restore RC file")
-	noSudo := fs.Bool("no-sudoers", false, "Don't restore sudoers")
+// handleRemove implements `alias remove` and `export remove`.
+func handleRemove(kind string, args []string) {
+	fs := flag.NewFlagSet(kind+" remove", flag.ExitOnError)
+	useRegex := fs.Bool("regex", false, "Remove every "+kind+" whose name matches the argument as a regular expression")
 	fs.Parse(args)
+	if fs.NArg() != 1 {
+		what := "name"
+		if kind == "export" {
+			what = "var"
+		}
+		fmt.Fprintf(os.Stderr, "%s remove requires %s\n", kind, what)
+		os.Exit(exitUsage)
+	}
+	title := strings.ToUpper(kind[:1]) + kind[1:]
+	err := forEachRC(func() error {
+		if !*useRegex {
+			remove := mgr.RemoveAlias
+			if kind == "export" {
+				remove = mgr.RemoveExport
+			}
+			if err := remove(fs.Arg(0)); err != nil {
+				return err
+			}
+			printDone("%s '%s' removed (if present) from %s\n", title, fs.Arg(0), mgr.RCFile)
+			return nil
+		}
+		names, err := mgr.RemoveEntriesMatching(kind, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			printDone("No %s name matches %s in %s\n", kind, fs.Arg(0), mgr.RCFile)
+			return nil
+		}
+		printDone("Removed from %s: %s %s\n", mgr.RCFile, kind, strings.Join(names, ", "))
+		return nil
+	})
+	if err != nil {
+		dieErr(err)
+	}
+}
 
-	results, err := restore(!*noRc, !*noSudo)
+// handleSort implements `alias sort` and `export sort`.
+func handleSort(kind string) {
+	changed, err := mgr.SortEntries(kind)
 	if err != nil {
 		dieErr(err)
 	}
-	for k, v := range results {
-		fmt.Printf("Restored %s -> %s\n", k, v)
+	if changed {
+		printDone("Sorted %s entries in %s\n", kind, mgr.RCFile)
+	} else {
+		printDone("%s entries in %s are already sorted\n", strings.ToUpper(kind[:1])+kind[1:], mgr.RCFile)
 	}
 }
 
-func backup(rc, sudoers bool) (map[string]string, error) {
-	out := map[string]string{}
-	dir := backupDir()
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return nil, err
+// handleDedupe implements `alias dedupe` and `export dedupe`.
+func handleDedupe(kind string) {
+	dups, skipped, err := mgr.DedupeDefinitions(kind)
+	if err != nil {
+		dieErr(err)
 	}
-	ts := time.Now().Format("20060102_150405")
-	if rc {
-		src := rcFilePath()
-		dst := filepath.Join(dir, filepath.Base(src)+".bak."+ts)
-		if err := copyFile(src, dst); err != nil {
-			return nil, err
+	if jsonOutput {
+		out := struct {
+			Collapsed []shctl.Duplicate `json:"collapsed"`
+			Skipped   []string          `json:"skipped"`
+		}{dups, skipped}
+		if out.Collapsed == nil {
+			out.Collapsed = []shctl.Duplicate{}
 		}
-		out["rc"] = dst
-	}
-	if sudoers {
-		src := sudoersPath()
-		dst := filepath.Join(dir, filepath.Base(src)+".bak."+ts)
-		if err := copyFile(src, dst); err != nil {
-			return nil, err
+		if out.Skipped == nil {
+			out.Skipped = []string{}
 		}
-		out["sudoers"] = dst
-	}
-	return out, nil
-}
-
-func restore(rc, sudoers bool) (map[string]string, error) {
-	out := map[string]string{}
-	dir := backupDir()
-	if rc {
-		srcPattern := filepath.Join(dir, filepath.Base(rcFilePath())+".bak.*")
-		matches, _ := filepath.Glob(srcPattern)
-		if len(matches) == 0 {
-			fmt.Printf("No rc backup found in %s\n", dir)
-		} else {
-			latest := latestFile(matches)
-			if err := copyFile(latest, rcFilePath()); err != nil {
-				return nil, err
-			}
-			out["rc"] = rcFilePath()
+		if err := printJSON(out); err != nil {
+			dieErr(err)
 		}
+		return
 	}
-	if sudoers {
-		srcPattern := filepath.Join(dir, filepath.Base(sudoersPath())+".bak.*")
-		matches, _ := filepath.Glob(srcPattern)
-		if len(matches) == 0 {
-			fmt.Printf("No sudoers backup found in %s\n", dir)
-		} else {
-			latest := latestFile(matches)
-			// Validate before applying
-			tmp, err := copyToTemp(latest)
-			if err != nil {
-				return nil, err
-			}
-			defer os.Remove(tmp)
-			if err := visudoValidate(tmp); err != nil {
-				return nil, fmt.Errorf("backup sudoers failed validation: %w", err)
-			}
-			if err := copyBack(tmp, sudoersPath()); err != nil {
-				return nil, err
-			}
-			out["sudoers"] = sudoersPath()
-		}
+	for _, name := range skipped {
+		warnf("warning: %s %s is defined more than once but extends itself; left as is\n", kind, name)
+	}
+	if len(dups) == 0 {
+		printDone("No duplicate %s definitions in %s\n", kind, mgr.RCFile)
+		return
+	}
+	for _, d := range dups {
+		printDone("Collapsed %s %s: removed %d earlier definition(s), kept %s\n", kind, d.Name, d.Removed, d.Kept)
 	}
-	return out, nil
 }
 
-// ----------------- Apply -----------------
+// ----------------- Search -----------------
 
-func handleApply() {
-	// spawn a shell and source file. This won't affect the parent process.
-	rc := rcFilePath()
-	cmd := exec.Command(shellPath, "-c", fmt.Sprintf("source %s", rc))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	_ = cmd.Run()
-	fmt.Println("Sourced rc in a subshell (this does not affect the current shell session).")
+type searchJSON struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Line  int    `json:"line"`
 }
 
-// ----------------- File utilities -----------------
+// handleSearch prints the aliases and exports whose name or value
+// contains term, in file order.
+func handleSearch(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	namesOnly := fs.Bool("names-only", false, "Match names only, not commands or values")
+	ignoreCase := fs.Bool("i", false, "Match case-insensitively")
+	fs.BoolVar(ignoreCase, "ignore-case", false, "Match case-insensitively")
+	useRegex := fs.Bool("regex", false, "Treat term as a regular expression")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "search requires a term")
+		os.Exit(exitUsage)
+	}
 
-func ensureFile(path string) error {
-	dir := filepath.Dir(path)
-	if dir == "" {
-		dir = "."
+	term := fs.Arg(0)
+	switch {
+	case *ignoreCase && *useRegex:
+		term = "(?i)" + term
+	case *ignoreCase:
+		term = strings.ToLower(term)
 	}
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return err
+	m, err := newMatcher(term, *useRegex)
+	if err != nil {
+		dieErr(err)
+	}
+	matches := m
+	if *ignoreCase && !*useRegex {
+		matches = func(s string) bool { return m(strings.ToLower(s)) }
 	}
-	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
-		f, err := os.OpenFile(path, os.O_CREATE, 0o644)
+	match := func(e shctl.Entry) bool {
+		return matches(e.Name) || !*namesOnly && matches(e.Value)
+	}
+
+	var found []shctl.Entry
+	for _, kind := range []string{"alias", "export"} {
+		entries, err := mgr.Entries(kind, match)
 		if err != nil {
-			return err
+			dieErr(err)
 		}
-		f.Close()
+		found = append(found, entries...)
 	}
-	return nil
-}
+	sort.Slice(found, func(i, j int) bool { return found[i].Line < found[j].Line })
 
-func appendAtomic(path string, data []byte) error {
-	// open file for append
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
-	if err != nil {
-		return err
+	if jsonOutput {
+		out := []searchJSON{}
+		for _, e := range found {
+			out = append(out, searchJSON{Kind: e.Kind, Name: e.Name, Value: e.Value, Line: e.Line})
+		}
+		if err := printJSON(out); err != nil {
+			dieErr(err)
+		}
+	} else {
+		for _, e := range found {
+			fmt.Printf("%-6s  %s=%s\n", e.Kind, e.Name, e.Value)
+		}
+	}
+	if len(found) == 0 {
+		os.Exit(exitNotFound)
 	}
-	defer f.Close()
-	_, err = f.Write(data)
-	return err
 }
 
-func scanAndPrintPrefix(r io.Reader, prefix string) error {
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := sc.Text()
-		if strings.HasPrefix(strings.TrimSpace(line), prefix) {
-			fmt.Println(line)
+// newMatcher returns a substring (or, with regex, regular expression) matcher
+// for pattern. An empty pattern matches everything.
+func newMatcher(pattern string, regex bool) (func(string) bool, error) {
+	if pattern == "" {
+		return func(string) bool { return true }, nil
+	}
+	if !regex {
+		return func(s string) bool { return strings.Contains(s, pattern) }, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return re.MatchString, nil
+}
+
+// ----------------- Export commands -----------------
+
+func handleExport(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "export: requires subcommand")
+		usageAndExit()
+	}
+	action := args[0]
+	switch action {
+	case "add":
+		fs := flag.NewFlagSet("export add", flag.ExitOnError)
+		declare := fs.Bool("declare", false, "write `declare -x VAR=value` instead of `export VAR=value`")
+		raw := fs.Bool("raw", false, "write the value unquoted so the shell expands it (e.g. '$PATH:/opt/bin')")
+		single := fs.Bool("single", false, "Single-quote the value so $ references stay literal")
+		double := fs.Bool("double", false, "Double-quote the value so $ references expand (the default when it has any)")
+		stdout := fs.Bool("stdout", false, "Print the line that would be written instead of touching any file")
+		keepGoing := fs.Bool("continue-on-error", false, "With -, skip lines that fail instead of stopping")
+		comment := fs.String("comment", "", "Write `reason` as a comment line above the export")
+		fs.Parse(args[1:])
+		rest := fs.Args()
+		quote := exportQuote(*raw, *single, *double)
+		if len(rest) == 1 && rest[0] == "-" && !*stdout {
+			addFromStdin("export", shctl.ExportOptions{Declare: *declare, Raw: *raw, Quote: quote}, *keepGoing)
+			return
+		}
+		if len(rest) != 2 {
+			fmt.Fprintln(os.Stderr, "export add requires var and value, or - to read them from stdin")
+			os.Exit(exitUsage)
+		}
+		warnLiteralRef(rest[0], rest[1], quote)
+		opts := shctl.ExportOptions{Declare: *declare, Raw: *raw, Quote: quote, Comment: *comment}
+		if *stdout {
+			line, err := mgr.ExportLine(rest[0], rest[1], opts)
+			if err != nil {
+				dieErr(err)
+			}
+			printLine(rest[0], rest[1], line, *comment)
+			return
+		}
+		err := forEachRC(func() error {
+			updated, err := mgr.AddExport(rest[0], rest[1], opts)
+			if err != nil {
+				return err
+			}
+			if updated {
+				printDone("Export '%s' updated in %s\n", rest[0], mgr.RCFile)
+			} else {
+				printDone("Export '%s' added to %s\n", rest[0], mgr.RCFile)
+			}
+			return nil
+		})
+		if err != nil {
+			dieErr(err)
+		}
+	case "update":
+		fs := flag.NewFlagSet("export update", flag.ExitOnError)
+		raw := fs.Bool("raw", false, "write the value unquoted so the shell expands it")
+		single := fs.Bool("single", false, "Single-quote the value so $ references stay literal")
+		double := fs.Bool("double", false, "Double-quote the value so $ references expand (the default when it has any)")
+		fs.Parse(args[1:])
+		rest := fs.Args()
+		if len(rest) != 2 {
+			fmt.Fprintln(os.Stderr, "export update requires var and value")
+			os.Exit(exitUsage)
+		}
+		quote := exportQuote(*raw, *single, *double)
+		warnLiteralRef(rest[0], rest[1], quote)
+		if err := mgr.UpdateExport(rest[0], rest[1], shctl.ExportOptions{Raw: *raw, Quote: quote}); err != nil {
+			dieErr(err)
+		}
+		printDone("Export '%s' updated in %s\n", rest[0], mgr.RCFile)
+	case "list":
+		handleList("export", args[1:])
+	case "disable", "enable":
+		handleToggle("export", action, args[1:])
+	case "sort":
+		handleSort("export")
+	case "dedupe":
+		handleDedupe("export")
+	case "remove":
+		handleRemove("export", args[1:])
+	case "path-add":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "export path-add requires dir")
+			os.Exit(exitUsage)
+		}
+		added, err := mgr.PathAdd(args[1])
+		if err != nil {
+			dieErr(err)
+		}
+		if added {
+			printDone("Added %s to PATH in %s\n", args[1], mgr.RCFile)
+		} else {
+			printDone("%s is already on PATH in %s\n", args[1], mgr.RCFile)
+		}
+	case "path-remove":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "export path-remove requires dir")
+			os.Exit(exitUsage)
+		}
+		removed, err := mgr.PathRemove(args[1])
+		if err != nil {
+			dieErr(err)
+		}
+		if removed {
+			printDone("Removed %s from PATH in %s\n", args[1], mgr.RCFile)
+		} else {
+			printDone("%s is not on PATH in %s\n", args[1], mgr.RCFile)
+		}
+	case "env":
+		script, err := mgr.EvalScript("export")
+		if err != nil {
+			dieErr(err)
+		}
+		fmt.Print(script)
+	case "dump":
+		fs := flag.NewFlagSet("export dump", flag.ExitOnError)
+		format := fs.String("format", "dotenv", "Output format (dotenv)")
+		fs.Parse(args[1:])
+		if *format != "dotenv" {
+			fmt.Fprintf(os.Stderr, "--format must be dotenv, got %q\n", *format)
+			os.Exit(exitUsage)
+		}
+		content, err := mgr.DumpDotenv()
+		if err != nil {
+			dieErr(err)
+		}
+		fmt.Print(content)
+	case "load":
+		fs := flag.NewFlagSet("export load", flag.ExitOnError)
+		format := fs.String("format", "dotenv", "Input format (dotenv)")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "export load requires file")
+			os.Exit(exitUsage)
+		}
+		if *format != "dotenv" {
+			fmt.Fprintf(os.Stderr, "--format must be dotenv, got %q\n", *format)
+			os.Exit(exitUsage)
 		}
+		res, err := mgr.LoadDotenv(fs.Arg(0))
+		if err != nil {
+			dieErr(err)
+		}
+		printDone("Loaded %s into %s: %d added, %d updated\n", fs.Arg(0), mgr.RCFile, res.Added, res.Updated)
+	case "path-list":
+		dirs, err := mgr.PathDirs()
+		if err != nil {
+			dieErr(err)
+		}
+		for _, d := range dirs {
+			fmt.Println(d)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "export: unknown action %s\n", action)
+		usageAndExit()
 	}
-	return sc.Err()
 }
 
-func scanAndPrintNonComment(r io.Reader) error {
-	sc := bufio.NewScanner(r)
-	for sc.Scan() {
-		line := sc.Text()
-		s := strings.TrimSpace(line)
-		if s == "" || strings.HasPrefix(s, "#") {
-			continue
+// exportQuote turns --single/--double into ExportOptions.Quote; at most one
+// of them and --raw may be given.
+func exportQuote(raw, single, double bool) string {
+	n := 0
+	for _, set := range []bool{raw, single, double} {
+		if set {
+			n++
 		}
-		fmt.Println(line)
 	}
-	return sc.Err()
+	if n > 1 {
+		fmt.Fprintln(os.Stderr, "--raw, --single and --double are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+	switch {
+	case single:
+		return "single"
+	case double:
+		return "double"
+	}
+	return ""
+}
+
+// warnLiteralRef warns when --single keeps a reference such as $HOME from
+// expanding, which is rarely what a PATH-like value wants.
+func warnLiteralRef(name, value, quote string) {
+	if ref := shctl.VarRef(value); quote == "single" && ref != "" {
+		warnf("warning: export %s: %s stays literal in single quotes\n", name, ref)
+	}
+}
+
+// ----------------- Sudoers commands -----------------
+
+func handleSudoers(args []string) {
+	if !shctl.SudoersSupported {
+		dieErr(shctl.ErrSudoersUnsupported)
+	}
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "sudoers: requires subcommand")
+		usageAndExit()
+	}
+	action := args[0]
+	switch action {
+	case "remove", "edit":
+		// add checks the entry's shape first
+		requireSudoersTools()
+	case "check":
+		if _, err := mgr.VisudoPath(); err != nil {
+			dieErr(err)
+		}
+	}
+	switch action {
+	case "add":
+		fs := flag.NewFlagSet("sudoers add", flag.ExitOnError)
+		user := fs.String("user", "", "Build the entry for this user (or %group)")
+		hosts := fs.String("hosts", "ALL", "Comma-separated host list for the built entry")
+		runas := fs.String("runas", "ALL", "Runas spec for the built entry")
+		nopasswd := fs.Bool("nopasswd", false, "Add the NOPASSWD tag to the built entry")
+		var commands stringList
+		fs.Var(&commands, "command", "Command for the built entry (repeatable)")
+		file := fs.String("file", "", "Write the entry to this drop-in under sudoers.d instead")
+		yes := fs.Bool("yes", false, "Don't ask for confirmation of a high-risk entry (NOPASSWD, ALL, wildcards)")
+		fs.Parse(args[1:])
+		rest := fs.Args()
+
+		var entry string
+		switch {
+		case *user != "" && len(rest) == 0:
+			var err error
+			entry, err = shctl.BuildSudoersEntry(shctl.SudoersSpec{
+				User:     *user,
+				Hosts:    strings.Split(*hosts, ","),
+				RunAs:    *runas,
+				NoPasswd: *nopasswd,
+				Commands: commands,
+			})
+			if err != nil {
+				dieErr(err)
+			}
+		case *user == "" && len(rest) == 1:
+			entry = rest[0]
+		default:
+			fmt.Fprintln(os.Stderr, "sudoers add requires entry string (wrap it in quotes) or --user and --command")
+			os.Exit(exitUsage)
+		}
+		if err := shctl.CheckSudoersEntry(entry); err != nil {
+			dieErr(err)
+		}
+		requireSudoersTools()
+		if !confirmSudoersRisks(entry, *yes) {
+			fmt.Println("Sudoers entry not added.")
+			return
+		}
+		if *file != "" {
+			path, err := mgr.DropInAdd(*file, entry)
+			if err != nil {
+				dieErr(err)
+			}
+			printDone("Sudoers entry added to %s\n", path)
+			return
+		}
+		if err := mgr.SudoersAdd(entry); err != nil {
+			dieErr(err)
+		}
+		printDone("Sudoers entry added and applied.\n")
+	case "list":
+		fs := flag.NewFlagSet("sudoers list", flag.ExitOnError)
+		file := fs.String("file", "", "List only this drop-in under sudoers.d")
+		numbers := fs.Bool("numbers", false, "Prefix each line with its line number (for remove --line)")
+		source := fs.Bool("source", false, "Prefix each line with the file it comes from instead of printing file headers")
+		fs.Parse(args[1:])
+		if err := sudoersList(*file, *numbers, *source); err != nil {
+			dieErr(err)
+		}
+	case "remove":
+		fs := flag.NewFlagSet("sudoers remove", flag.ExitOnError)
+		file := fs.String("file", "", "Remove from this drop-in under sudoers.d (without a pattern: delete it); with --line, also any file list shows, by path")
+		line := fs.Int("line", 0, "Remove exactly this line (numbered as in list --numbers) instead of matching a pattern; needs --file when several files have a rule on it")
+		useRegex := fs.Bool("regex", false, "Treat the pattern as a regular expression instead of a substring")
+		fs.Parse(args[1:])
+		switch {
+		case *line != 0 && fs.NArg() == 0:
+			f := *file
+			if strings.ContainsAny(f, `/\`) {
+				f = expandPath(f)
+			}
+			path, text, err := mgr.SudoersRemoveLine(f, *line)
+			if err != nil {
+				dieErr(err)
+			}
+			printDone("Removed line %d from %s: %s\n", *line, path, text)
+		case *line != 0:
+			fmt.Fprintln(os.Stderr, "sudoers remove: --line and a pattern are mutually exclusive")
+			os.Exit(exitUsage)
+		case *useRegex && fs.NArg() != 1:
+			fmt.Fprintln(os.Stderr, "sudoers remove --regex requires pattern")
+			os.Exit(exitUsage)
+		case *file != "" && fs.NArg() <= 1:
+			remove, how := mgr.DropInRemove, "containing"
+			if *useRegex {
+				remove, how = mgr.DropInRemoveRegexp, "matching"
+			}
+			path, deleted, err := remove(*file, fs.Arg(0))
+			if err != nil {
+				dieErr(err)
+			}
+			if deleted {
+				printDone("Removed %s\n", path)
+			} else {
+				printDone("Removed lines %s pattern %s from %s\n", how, fs.Arg(0), path)
+			}
+		case *file == "" && fs.NArg() == 1:
+			remove, how := mgr.SudoersRemove, "containing"
+			if *useRegex {
+				remove, how = mgr.SudoersRemoveRegexp, "matching"
+			}
+			if err := remove(fs.Arg(0)); err != nil {
+				dieErr(err)
+			}
+			printDone("Removed lines %s pattern: %s\n", how, fs.Arg(0))
+		default:
+			fmt.Fprintln(os.Stderr, "sudoers remove requires pattern (or --file)")
+			os.Exit(exitUsage)
+		}
+	case "check":
+		fs := flag.NewFlagSet("sudoers check", flag.ExitOnError)
+		file := fs.String("file", "", "Check the entry against this drop-in under sudoers.d instead")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "sudoers check requires entry string (wrap it in quotes)")
+			os.Exit(exitUsage)
+		}
+		for _, r := range shctl.SudoersEntryRisks(fs.Arg(0)) {
+			warnf("warning: %s\n", r)
+		}
+		path, err := mgr.SudoersCheck(*file, fs.Arg(0))
+		if err != nil {
+			dieErr(err)
+		}
+		fmt.Printf("ok: the entry would be valid in %s (nothing was changed)\n", path)
+	case "edit":
+		fs := flag.NewFlagSet("sudoers edit", flag.ExitOnError)
+		file := fs.String("file", "", "Edit this drop-in under sudoers.d instead")
+		fs.Parse(args[1:])
+		if err := sudoersEdit(*file); err != nil {
+			dieErr(err)
+		}
+	case "test":
+		handleSudoersTest(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "sudoers: unknown action %s\n", action)
+		usageAndExit()
+	}
 }
 
-func removeLinesContainingPrefix(path, prefix string) error {
-	data, err := os.ReadFile(path)
+// sudoersList prints the non-comment lines of the main sudoers file and of
+// every file it includes, each included file under a "# <path>" header.
+// With file, only that drop-in is listed. numbers prefixes each line with
+// its line number in its file; source prefixes it with "<path>:" instead
+// of the headers.
+func sudoersList(file string, numbers, source bool) error {
+	files, err := mgr.SudoersRules(file)
 	if err != nil {
 		return err
 	}
-	lines := strings.Split(string(data), "\n")
-	out := []string{}
-	for _, ln := range lines {
-		if strings.HasPrefix(strings.TrimSpace(ln), prefix) {
-			continue
+	for i, f := range files {
+		switch {
+		case f.Unused && source:
+			warnf("warning: %s isn't included by %s; sudo ignores it\n", f.Path, mgr.SudoersPath())
+		case f.Unused:
+			fmt.Printf("# %s (not included by %s; sudo ignores it)\n", f.Path, mgr.SudoersPath())
+		case i > 0 && !source:
+			fmt.Printf("# %s\n", f.Path)
+		}
+		for j, line := range f.Lines {
+			if source {
+				fmt.Printf("%s:", f.Path)
+			}
+			if numbers {
+				fmt.Printf("%4d  ", f.Nums[j])
+			}
+			fmt.Println(line)
 		}
-		out = append(out, ln)
 	}
-	return atomicWriteFile(path, strings.Join(out, "\n"))
+	return nil
 }
 
-func removeLinesContaining(path, pattern string) error {
-	data, err := os.ReadFile(path)
+func handleSudoersTest(args []string) {
+	fs := flag.NewFlagSet("sudoers test", flag.ExitOnError)
+	username := fs.String("user", os.Getenv("USER"), "user to evaluate")
+	command := fs.String("command", "", "command (with optional arguments) to evaluate")
+	hostname, _ := os.Hostname()
+	host := fs.String("host", hostname, "host to evaluate")
+	fs.Parse(args)
+	if *username == "" || *command == "" {
+		fmt.Fprintln(os.Stderr, "sudoers test requires --user and --command")
+		os.Exit(exitUsage)
+	}
+
+	cmdLine := *command
+	if !strings.HasPrefix(cmdLine, "/") {
+		// sudo resolves bare command names through PATH
+		name, rest, _ := strings.Cut(cmdLine, " ")
+		if p, err := exec.LookPath(name); err == nil {
+			cmdLine = strings.TrimSpace(p + " " + rest)
+		}
+	}
+
+	policy, err := mgr.SudoersPolicy()
+	if err != nil {
+		dieErr(err)
+	}
+	allowed, rule := policy.Evaluate(*username, *host, cmdLine)
+	if allowed {
+		fmt.Printf("allow: %s may run %s on %s\n", *username, cmdLine, *host)
+	} else {
+		fmt.Printf("deny: %s may not run %s on %s\n", *username, cmdLine, *host)
+	}
+	if rule != nil {
+		fmt.Printf("  rule: %s\n", rule.Source)
+	} else {
+		fmt.Println("  rule: (no matching rule)")
+	}
+	if !allowed {
+		os.Exit(exitNotFound)
+	}
+}
+
+// requireSudoersTools exits unless visudo is available, since changes are
+// only ever applied after visudo validation, and unless a privilege
+// command chosen explicitly exists.
+func requireSudoersTools() {
+	if _, err := mgr.VisudoPath(); err != nil {
+		dieErr(err)
+	}
+	if mgr.PrivCmd != "" {
+		if _, err := mgr.PrivCmdPath(); err != nil {
+			dieErr(err)
+		}
+	}
+}
+
+// confirmSudoersRisks warns about what makes entry dangerous and asks
+// whether to go ahead, unless yes is set or nothing would be written. It
+// reports whether to add the entry; without a terminal to ask on it
+// exits instead.
+func confirmSudoersRisks(entry string, yes bool) bool {
+	risks := shctl.SudoersEntryRisks(entry)
+	if len(risks) == 0 {
+		return true
+	}
+	warnf("warning: %s\n", entry)
+	for _, r := range risks {
+		warnf("  - %s\n", r)
+	}
+	if yes || dryRun {
+		return true
+	}
+	if !stdinIsTerminal() {
+		dieErr(errors.New("refusing to add a high-risk sudoers entry without confirmation (pass --yes)"))
+	}
+	return confirm("Add this entry anyway?")
+}
+
+// sudoersEdit works like visudo on the sudoers file (or the named drop-in):
+// edit a temp copy in $VISUAL/$EDITOR, validate it, and offer to edit again
+// until it passes before applying. The temp copy is removed on Ctrl-C.
+func sudoersEdit(file string) error {
+	again := func(err error) bool {
+		fmt.Fprintln(os.Stderr, err)
+		return stdinIsTerminal() && confirm("Edit again?")
+	}
+	path, changed, err := mgr.EditSudoers(file, runEditor, again)
 	if err != nil {
 		return err
 	}
-	lines := strings.Split(string(data), "\n")
-	out := []string{}
-	for _, ln := range lines {
-		if strings.Contains(ln, pattern) {
+	if !changed {
+		fmt.Printf("%s unchanged.\n", path)
+		return nil
+	}
+	printDone("Sudoers changes applied to %s\n", path)
+	return nil
+}
+
+// runEditor opens path in $VISUAL, $EDITOR or vi. The variable may include
+// arguments, e.g. "code --wait".
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	args := strings.Fields(editor)
+	if len(args) == 0 {
+		args = []string{"vi"}
+	}
+	cmd := exec.Command(args[0], append(args[1:], path)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor %s: %w", args[0], err)
+	}
+	return nil
+}
+
+// ----------------- Backup & Restore -----------------
+
+func handleBackup(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			handleBackupList(args[1:])
+			return
+		case "prune":
+			handleBackupPrune(args[1:])
+			return
+		case "verify":
+			handleBackupVerify(args[1:])
+			return
+		case "delete":
+			handleBackupDelete(args[1:])
+			return
+		}
+	}
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	noRc := fs.Bool("no-rc", false, "Don't backup RC file")
+	noSudo := fs.Bool("no-sudoers", false, "Don't backup sudoers")
+	var include stringList
+	fs.Var(&include, "include", "Also backup this file (repeatable)")
+	parallel := fs.Int("parallel", 1, "Copy up to N files concurrently")
+	withConfig := fs.Bool("include-config", false, "Also backup the tool's config file")
+	withSecrets := fs.Bool("include-secrets", false, "Keep secret-looking config values in plaintext")
+	compress := fs.Bool("compress", false, "Write gzip-compressed backups (*.bak.<ts>.gz)")
+	bundle := fs.Bool("bundle", false, "Write one tar archive with a manifest instead of separate files")
+	strict := fs.Bool("strict", false, "Stop at the first file that can't be backed up")
+	fs.Parse(args)
+
+	results, err := mgr.Backup(shctl.BackupOptions{
+		RC:             !*noRc,
+		Sudoers:        !*noSudo && shctl.SudoersSupported,
+		Config:         *withConfig,
+		IncludeSecrets: *withSecrets,
+		Compress:       *compress,
+		Bundle:         *bundle,
+		Include:        include,
+		Parallel:       *parallel,
+		Strict:         *strict,
+	})
+	if err != nil && len(results) == 0 {
+		dieErr(err)
+	}
+	verb := "Backed up"
+	if dryRun {
+		verb = "Would back up"
+	}
+	printResults(verb, results)
+	if err != nil {
+		// what could be backed up was; list what couldn't
+		fmt.Fprintln(os.Stderr, "error: some files were not backed up:")
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "  "+line)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+// printResults prints what backup or restore did, one "verb file -> path"
+// line per file in key order, or with --json the map as an object.
+func printResults(verb string, results map[string]string) {
+	if jsonOutput {
+		if results == nil {
+			results = map[string]string{}
+		}
+		if err := printJSON(results); err != nil {
+			dieErr(err)
+		}
+		return
+	}
+	keys := make([]string, 0, len(results))
+	for k := range results {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s %s -> %s\n", verb, k, results[k])
+	}
+}
+
+// handleBackupList prints the backups grouped by source (rc, sudoers,
+// config, then other files by name), newest first within each group.
+func handleBackupList(args []string) {
+	fs := flag.NewFlagSet("backup list", flag.ExitOnError)
+	fs.Parse(args)
+
+	backups, err := mgr.Backups()
+	if err != nil {
+		dieErr(err)
+	}
+	if jsonOutput {
+		if backups == nil {
+			backups = []shctl.BackupFile{}
+		}
+		if err := printJSON(backups); err != nil {
+			dieErr(err)
+		}
+		return
+	}
+	if len(backups) == 0 {
+		fmt.Println("No backups found in", mgr.BackupDir)
+		return
+	}
+	groups := map[string][]shctl.BackupFile{}
+	var others []string
+	for _, b := range backups {
+		if _, ok := groups[b.Source]; !ok && b.Source != "rc" && b.Source != "sudoers" && b.Source != "config" {
+			others = append(others, b.Source)
+		}
+		groups[b.Source] = append(groups[b.Source], b)
+	}
+	sort.Strings(others)
+	for _, src := range append([]string{"rc", "sudoers", "config"}, others...) {
+		if len(groups[src]) == 0 {
 			continue
 		}
-		out = append(out, ln)
+		fmt.Printf("%s:\n", src)
+		for _, b := range groups[src] {
+			fmt.Printf("  %s  %8d  %s\n", b.Time.Format("2006-01-02 15:04:05"), b.Size, b.Path)
+		}
 	}
-	return atomicWriteFile(path, strings.Join(out, "\n"))
 }
 
-func atomicWriteFile(path, content string) error {
-	dir := filepath.Dir(path)
-	tmp := filepath.Join(dir, ".tmp_"+filepath.Base(path))
-	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
-		return err
+func handleBackupPrune(args []string) {
+	fs := flag.NewFlagSet("backup prune", flag.ExitOnError)
+	keep := fs.Int("keep", 0, "Keep the N newest backups of each file")
+	olderThan := fs.Duration("older-than", 0, "Only delete backups older than this (e.g. 720h)")
+	fs.Parse(args)
+
+	pruned, err := mgr.PruneBackups(shctl.PruneOptions{Keep: *keep, OlderThan: *olderThan})
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	for _, p := range pruned {
+		printChange("%s %s\n", verb, p)
+	}
+	if err != nil {
+		dieErr(err)
+	}
+	if len(pruned) == 0 {
+		printChange("No backups to prune.\n")
 	}
-	return os.Rename(tmp, path)
 }
 
-// ----------------- File copy / temp / validation -----------------
+// handleBackupVerify checks every backup against its checksum and exits 3
+// when any of them is damaged.
+func handleBackupVerify(args []string) {
+	fs := flag.NewFlagSet("backup verify", flag.ExitOnError)
+	fs.Parse(args)
 
-func copyFile(src, dst string) error {
-	in, err := os.Open(src)
+	backups, err := mgr.Backups()
 	if err != nil {
-		return err
+		dieErr(err)
+	}
+	failed := 0
+	for _, b := range backups {
+		err := mgr.VerifyBackup(b.Path)
+		switch {
+		case err == nil:
+			fmt.Printf("OK          %s\n", b.Path)
+		case errors.Is(err, shctl.ErrNoChecksum):
+			fmt.Printf("UNVERIFIED  %s (no checksum)\n", b.Path)
+		default:
+			failed++
+			fmt.Printf("FAILED      %s\n", b.Path)
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
 	}
-	defer in.Close()
-	out, err := os.Create(dst)
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d backups failed verification\n", failed, len(backups))
+		os.Exit(exitInvalid)
+	}
+}
+
+func handleBackupDelete(args []string) {
+	fs := flag.NewFlagSet("backup delete", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "backup delete requires a backup file or timestamp")
+		os.Exit(exitUsage)
+	}
+
+	paths, err := mgr.MatchBackups(fs.Arg(0))
 	if err != nil {
-		return err
+		dieErr(err)
 	}
-	defer out.Close()
-	if _, err := io.Copy(out, in); err != nil {
-		return err
+	for _, p := range paths {
+		fmt.Println(p)
+	}
+	if !*yes && !dryRun {
+		if !stdinIsTerminal() {
+			dieErr(errors.New("refusing to delete without confirmation (pass --yes)"))
+		}
+		if !confirm(fmt.Sprintf("Delete %d backup(s)?", len(paths))) {
+			fmt.Println("Delete aborted.")
+			return
+		}
+	}
+	verb := "Deleted"
+	if dryRun {
+		verb = "Would delete"
+	}
+	for _, p := range paths {
+		if err := mgr.DeleteBackup(p); err != nil {
+			dieErr(err)
+		}
+		printChange("%s %s\n", verb, p)
 	}
-	return out.Sync()
 }
 
-func copyToTemp(src string) (string, error) {
-	content, err := os.ReadFile(src)
+func handleUninstall(args []string) {
+	fs := flag.NewFlagSet("uninstall", flag.ExitOnError)
+	fs.Parse(args)
+
+	res, err := mgr.Uninstall()
 	if err != nil {
-		return "", err
+		dieErr(err)
+	}
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	if !res.Block && len(res.DropIns) == 0 {
+		printChange("Nothing to uninstall.\n")
+		return
+	}
+	if res.Block {
+		printChange("%s the managed block (%d entries) from %s\n", verb, res.Entries, mgr.RCFile)
+	}
+	for _, p := range res.DropIns {
+		printChange("%s drop-in %s\n", verb, p)
 	}
-	tmp, err := os.CreateTemp("", "sudoers_*")
+}
+
+// handleStats prints how many entries, sudoers rules and backups there
+// are, as a short summary or with --json as an object.
+func handleStats(args []string) {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	st, err := mgr.Stats()
 	if err != nil {
-		return "", err
+		dieErr(err)
 	}
-	if _, err := tmp.Write(content); err != nil {
-		_ = tmp.Close()
-		return "", err
+	if jsonOutput {
+		if err := printJSON(st); err != nil {
+			dieErr(err)
+		}
+		return
 	}
-	_ = tmp.Close()
-	// preserve original permissions if possible
-	fi, err := os.Stat(src)
-	if err == nil {
-		_ = os.Chmod(tmp.Name(), fi.Mode())
+	fmt.Printf("Aliases:        %d\n", st.Aliases)
+	fmt.Printf("Exports:        %d\n", st.Exports)
+	if st.SudoersError != "" {
+		fmt.Printf("Sudoers rules:  unknown (%s)\n", st.SudoersError)
+	} else {
+		fmt.Printf("Sudoers rules:  %d across %d files (sudoers and drop-ins)\n", st.SudoersRules, st.DropIns+1)
 	}
-	return tmp.Name(), nil
+	fmt.Printf("Backups:        %d, %s in %s\n", st.Backups, formatBytes(st.BackupBytes), st.BackupDir)
 }
 
-func copyBack(tmp, dest string) error {
-	if dest == "/etc/sudoers" {
-		// require sudo cp
-		cmd := exec.Command("sudo", "cp", tmp, dest)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		return cmd.Run()
+// ----------------- Sync -----------------
+
+func handleSync(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "sync: requires subcommand")
+		usageAndExit()
 	}
-	// normal file copy
-	return copyFile(tmp, dest)
+	switch args[0] {
+	case "commit":
+		fs := flag.NewFlagSet("sync commit", flag.ExitOnError)
+		msg := fs.String("m", "", "Commit `message` (default \"Update <rc file> with cli-tool\")")
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "sync commit takes no arguments")
+			os.Exit(exitUsage)
+		}
+		if *msg == "" {
+			*msg = "Update " + filepath.Base(mgr.RCFile) + " with cli-tool"
+		}
+		committed, err := mgr.GitCommit(*msg)
+		if err != nil {
+			dieErr(err)
+		}
+		if !committed {
+			fmt.Printf("%s: nothing to commit\n", mgr.RCFile)
+			return
+		}
+		printDone("Committed %s\n", mgr.RCFile)
+	case "push":
+		fs := flag.NewFlagSet("sync push", flag.ExitOnError)
+		fs.Parse(args[1:])
+		if fs.NArg() != 0 {
+			fmt.Fprintln(os.Stderr, "sync push takes no arguments")
+			os.Exit(exitUsage)
+		}
+		out, err := mgr.GitPush()
+		if err != nil {
+			dieErr(err)
+		}
+		if !quiet {
+			fmt.Print(out)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "sync: unknown action %s\n", args[0])
+		usageAndExit()
+	}
+}
+
+// handleDoctor prints a checklist of setup problems with how to fix them;
+// it exits 4 if any check fails.
+func handleDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.Parse(args)
+
+	checks := mgr.Doctor()
+	failed := false
+	for _, c := range checks {
+		failed = failed || c.Status == "fail"
+	}
+	if jsonOutput {
+		if err := printJSON(checks); err != nil {
+			dieErr(err)
+		}
+	} else {
+		colors := map[string]string{"pass": colorGreen, "warn": colorYellow, "fail": colorRed}
+		for _, c := range checks {
+			fmt.Printf("[%s] %-17s %s\n", colorize(colors[c.Status], c.Status), c.Name, c.Detail)
+			if c.Fix != "" {
+				fmt.Printf("       %-17s fix: %s\n", "", c.Fix)
+			}
+		}
+	}
+	if failed {
+		os.Exit(exitFailure)
+	}
+}
+
+// formatBytes renders n in B, KiB, MiB or GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, i := float64(n)/unit, 0
+	for ; f >= unit && i < 2; i++ {
+		f /= unit
+	}
+	return fmt.Sprintf("%.1f %ciB", f, "KMG"[i])
 }
 
-func visudoValidate(path string) error {
-	cmd := exec.Command("visudo", "-c", "-f", path)
-	out, err := cmd.CombinedOutput()
+// applyManifest converges the files to the manifest at path and reports
+// each change.
+func applyManifest(path string, prune bool) {
+	man, err := mgr.LoadManifest(path)
 	if err != nil {
-		return fmt.Errorf("visudo error: %s (%w)", strings.TrimSpace(string(out)), err)
+		dieErr(err)
+	}
+	if len(man.Sudoers) > 0 || prune && man.SudoersFile != "" {
+		requireSudoersTools()
+	}
+	changes, err := mgr.ApplyManifest(man, prune)
+	if jsonOutput && err == nil {
+		if changes == nil {
+			changes = []shctl.ManifestChange{}
+		}
+		if err := printJSON(changes); err != nil {
+			dieErr(err)
+		}
+		return
+	}
+	prefix := ""
+	if dryRun {
+		prefix = "(dry run) "
+	}
+	for _, c := range changes {
+		fmt.Printf("%s%-7s %-7s %s\n", prefix, c.Op, c.Kind, c.Name)
+	}
+	if err != nil {
+		dieErr(err)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Already up to date.")
 	}
-	return nil
 }
 
-// ----------------- Misc helpers -----------------
+// handleUndo reverts the newest run in the undo journal, or lists the
+// journal with --list.
+func handleUndo(args []string) {
+	fs := flag.NewFlagSet("undo", flag.ExitOnError)
+	list := fs.Bool("list", false, "List the runs that can be undone, newest first")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "undo takes no arguments")
+		os.Exit(exitUsage)
+	}
 
-func dieErr(err error) {
-	fmt.Fprintln(os.Stderr, "error:", err)
-	os.Exit(2)
+	if *list {
+		entries, err := mgr.Journal()
+		if err != nil {
+			dieErr(err)
+		}
+		if len(entries) == 0 {
+			fmt.Println("Nothing to undo.")
+			return
+		}
+		for _, e := range entries {
+			fmt.Printf("%s  %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Command)
+			for _, f := range e.Files {
+				fmt.Printf("    %s\n", f.Path)
+			}
+		}
+		return
+	}
+	e, err := mgr.Undo()
+	if err != nil {
+		dieErr(err)
+	}
+	for _, f := range e.Files {
+		if f.Existed {
+			printDone("Restored %s\n", f.Path)
+		} else {
+			printDone("Removed %s\n", f.Path)
+		}
+	}
+	printDone("Undid %q from %s\n", e.Command, e.Time.Local().Format("2006-01-02 15:04:05"))
 }
 
-func appendFile(path string, data []byte) error {
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+func handleRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	noRc := fs.Bool("no-rc", false, "Don't restore RC file")
+	noSudo := fs.Bool("no-sudoers", false, "Don't restore sudoers")
+	withConfig := fs.Bool("include-config", false, "Also restore the tool's config file")
+	previewDiff := fs.Bool("preview-diff", false, "Show a diff (current -> backup) and ask before restoring")
+	showDiff := fs.Bool("diff", false, "Show a diff (current -> backup) before restoring, without asking")
+	yes := fs.Bool("yes", false, "Don't ask for confirmation")
+	timestamp := fs.String("timestamp", "", "Restore the backups taken at this time (as in `backup list`) instead of the latest")
+	from := fs.String("from", "", "Restore this backup file to the file it was taken from")
+	bundle := fs.String("bundle", "", "Restore the files in this bundle (from backup --bundle)")
+	fs.Parse(args)
+	n := 0
+	for _, v := range []string{*timestamp, *from, *bundle} {
+		if v != "" {
+			n++
+		}
+	}
+	if n > 1 {
+		fmt.Fprintln(os.Stderr, "restore: --timestamp, --from and --bundle are mutually exclusive")
+		os.Exit(exitUsage)
+	}
+
+	opts := shctl.RestoreOptions{RC: !*noRc, Sudoers: !*noSudo && shctl.SudoersSupported, Config: *withConfig, Timestamp: *timestamp, From: *from, Bundle: *bundle}
+	if *previewDiff || *showDiff {
+		if err := previewRestore(opts); err != nil {
+			dieErr(err)
+		}
+		if dryRun {
+			// the diffs are shown; the dry run only checks the backups
+			mgr.Preview = func(string, string) {}
+		}
+	}
+	if *previewDiff && !dryRun {
+		if !*yes {
+			if !stdinIsTerminal() {
+				dieErr(errors.New("refusing to restore without confirmation (pass --yes)"))
+			}
+			if !confirm("Restore these files?") {
+				fmt.Println("Restore aborted.")
+				return
+			}
+		}
+	}
+
+	results, err := mgr.Restore(opts)
+	if err != nil {
+		dieErr(err)
+	}
+	if dryRun {
+		return
+	}
+	printResults("Restored", results)
+}
+
+// previewRestore prints the diff each selected restore would apply.
+func previewRestore(opts shctl.RestoreOptions) error {
+	diffs, err := mgr.RestoreDiffs(opts)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = f.Write(data)
-	return err
+	for _, d := range diffs {
+		if d.Diff == "" {
+			fmt.Printf("%s is identical to %s\n", d.Target, d.Backup)
+			continue
+		}
+		fmt.Print(colorizeDiff(d.Diff))
+	}
+	return nil
 }
 
-func latestFile(files []string) string {
-	latest := files[0]
-	var latestTime time.Time
-	for _, f := range files {
-		fi, err := os.Stat(f)
+// handleDiff shows what changed in the live files since a backup, without
+// restoring anything.
+func handleDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	against := fs.String("against", "", "Backup file or timestamp (as shown by backup list) to compare with")
+	fs.Parse(args)
+	if *against == "" || fs.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "diff requires --against <backup|timestamp> and no arguments")
+		os.Exit(exitUsage)
+	}
+
+	diffs, err := mgr.BackupDiffs(*against)
+	if err != nil {
+		dieErr(err)
+	}
+	for _, d := range diffs {
+		if d.Diff == "" {
+			fmt.Printf("%s is unchanged since %s\n", d.Target, d.Backup)
+			continue
+		}
+		fmt.Print(colorizeDiff(d.Diff))
+	}
+}
+
+// ----------------- Migrate -----------------
+
+// handleMigrate translates the aliases and exports of one shell's rc file
+// into another's. The target is --to-file, else --rc-file/--profile/
+// BASM_RC_FILE when --to matches the target shell, else the --to shell's
+// default rc file.
+func handleMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "bash", "Shell whose rc file is read: bash, zsh or fish")
+	to := fs.String("to", "fish", "Shell to write for: bash, zsh or fish")
+	fromFile := fs.String("from-file", "", "Read this rc file (default: the --from shell's)")
+	toFile := fs.String("to-file", "", "Write to this rc file (default: the --to shell's)")
+	fs.Parse(args)
+	for _, sh := range []string{*from, *to} {
+		switch sh {
+		case "bash", "zsh", "fish":
+		default:
+			fmt.Fprintf(os.Stderr, "migrate: --from and --to must be bash, zsh or fish, got %q\n", sh)
+			os.Exit(exitUsage)
+		}
+	}
+
+	home, _ := os.UserHomeDir()
+	src := expandPath(*fromFile)
+	if src == "" {
+		rc, _ := defaultRCFiles(*from)
+		src = filepath.Join(home, rc)
+	}
+	switch {
+	case *toFile != "":
+		mgr.RCFile = expandPath(*toFile)
+	case *to != targetShell():
+		rc, _ := defaultRCFiles(*to)
+		mgr.RCFile = filepath.Join(home, rc)
+	}
+	mgr.Shell = *to
+
+	res, err := mgr.Migrate(*from, src)
+	if err != nil {
+		dieErr(err)
+	}
+	for _, p := range res.Problems {
+		fmt.Fprintf(os.Stderr, "skipped %s:%d: %s (%s)\n", src, p.Line, p.Text, p.Reason)
+	}
+	printDone("Migrated %d definitions from %s to %s\n", res.Written, src, mgr.RCFile)
+	if len(res.Problems) > 0 {
+		fmt.Fprintf(os.Stderr, "%d definitions could not be translated; add them by hand\n", len(res.Problems))
+	}
+}
+
+// ----------------- RC file -----------------
+
+func handleRC(args []string) {
+	if len(args) > 0 && args[0] == "edit" {
+		handleRCEdit(args[1:])
+		return
+	}
+	if len(args) < 1 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "rc: need subcommand validate or edit")
+		os.Exit(exitUsage)
+	}
+	fs := flag.NewFlagSet("rc validate", flag.ExitOnError)
+	fs.Parse(args[1:])
+
+	if err := mgr.CheckSyntax(mgr.RCFile); err != nil {
+		var se *shctl.SyntaxError
+		if !errors.As(err, &se) {
+			dieErr(err)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitInvalid)
+	}
+	fmt.Printf("%s: syntax OK\n", mgr.RCFile)
+}
+
+// handleRCEdit opens the rc file in the editor after backing it up and
+// offers to put the backup back if the edit broke the file's syntax.
+func handleRCEdit(args []string) {
+	fs := flag.NewFlagSet("rc edit", flag.ExitOnError)
+	fs.Parse(args)
+
+	revert := func(err error) bool {
+		fmt.Fprintln(os.Stderr, err)
+		return stdinIsTerminal() && confirm("Revert to the backup?")
+	}
+	changed, reverted, err := mgr.EditRC(runEditor, revert)
+	var se *shctl.SyntaxError
+	switch {
+	case errors.As(err, &se):
+		fmt.Fprintf(os.Stderr, "error: %s was left as edited and doesn't parse; `cli-tool undo` puts the previous version back\n", mgr.RCFile)
+		os.Exit(exitInvalid)
+	case err != nil:
+		dieErr(err)
+	case reverted:
+		fmt.Printf("%s reverted to the backup.\n", mgr.RCFile)
+	case !changed:
+		fmt.Printf("%s unchanged.\n", mgr.RCFile)
+	default:
+		printDone("%s edited; syntax OK\n", mgr.RCFile)
+	}
+}
+
+// ----------------- Dump -----------------
+
+func handleDump(args []string) {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := fs.String("format", "shell", "Output format (shell)")
+	shellFile := fs.String("shell-file", "", "Write a sourceable file to this path instead of stdout")
+	fs.Parse(args)
+	if *format != "shell" {
+		fmt.Fprintf(os.Stderr, "--format must be shell, got %q\n", *format)
+		os.Exit(exitUsage)
+	}
+
+	content, err := mgr.DumpShell()
+	if err != nil {
+		dieErr(err)
+	}
+	if *shellFile == "" {
+		fmt.Print(content)
+		return
+	}
+	out := expandPath(*shellFile)
+	if err := mgr.WriteFile(out, content); err != nil {
+		dieErr(err)
+	}
+	printDone("Wrote %s\n", out)
+}
+
+// ----------------- Apply -----------------
+
+func handleApply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	mark := fs.Bool("mark", false, "Record the rc file's state as applied")
+	check := fs.Bool("check-applied", false, "Exit 0 if the rc file matches the last applied state, 1 otherwise")
+	printOnly := fs.Bool("print", false, `Print the managed aliases and exports for eval "$(cli-tool apply --print)"`)
+	login := fs.Bool("login", false, "Source the files a login shell reads (default: detected from the parent shell)")
+	file := fs.String("file", "", "Converge the rc file and sudoers to the aliases, exports and sudoers entries of this manifest")
+	prune := fs.Bool("prune", false, "With --file, also remove managed aliases/exports (and drop-in rules) the manifest doesn't list")
+	fs.Parse(args)
+
+	if *file != "" {
+		applyManifest(*file, *prune)
+		return
+	}
+	if *prune {
+		fmt.Fprintln(os.Stderr, "apply: --prune requires --file")
+		os.Exit(exitUsage)
+	}
+	rc := mgr.RCFile
+	if *printOnly {
+		script, err := mgr.EvalScript()
 		if err != nil {
+			dieErr(err)
+		}
+		fmt.Print(script)
+		if *mark {
+			// keep the dry-run preview out of the output being eval'd
+			if mgr.Stdout != nil {
+				mgr.Stdout = os.Stderr
+			}
+			if err := mgr.MarkApplied(appliedStatePath()); err != nil {
+				dieErr(err)
+			}
+		}
+		return
+	}
+	if *check {
+		ok, err := mgr.IsApplied(appliedStatePath())
+		if err != nil {
+			dieErr(err)
+		}
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s changed since it was last applied\n", rc)
+			os.Exit(exitNotFound)
+		}
+		return
+	}
+
+	var sources []string
+	for _, f := range applyFiles(*login || isLoginShell()) {
+		if _, err := os.Stat(f); err != nil {
+			warnf("warning: %s does not exist; not sourcing it\n", f)
 			continue
 		}
-		t := fi.ModTime()
-		if t.After(latestTime) {
-			latest = f
-			latestTime = t
+		if err := mgr.CheckSyntax(f); err != nil {
+			var se *shctl.SyntaxError
+			if !errors.As(err, &se) {
+				dieErr(err)
+			}
+			fmt.Fprintln(os.Stderr, "error: not sourcing:", err)
+			os.Exit(exitInvalid)
 		}
+		sources = append(sources, "source "+shctl.ShellQuote(f))
+	}
+	if len(sources) == 0 {
+		dieErr(errors.New("no rc file to source"))
 	}
-	return latest
+
+	// spawn a shell and source the files. This won't affect the parent process.
+	sh := shellPath
+	if filepath.Base(sh) != targetShell() {
+		p, err := exec.LookPath(targetShell())
+		if err != nil {
+			dieErr(err)
+		}
+		sh = p
+	}
+	cmd := exec.Command(sh, "-c", strings.Join(sources, "; "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			fmt.Fprintf(os.Stderr, "sourcing %s failed with exit code %d\n", rc, exitErr.ExitCode())
+			os.Exit(exitErr.ExitCode())
+		}
+		dieErr(err)
+	}
+	fmt.Println("Sourced rc in a subshell (this does not affect the current shell session).")
+	if *mark {
+		if err := mgr.MarkApplied(appliedStatePath()); err != nil {
+			dieErr(err)
+		}
+	}
+}
+
+// applyFiles returns the files a new session of the target shell would
+// read, in order. An explicitly chosen rc file (--rc-file, --profile or
+// BASM_RC_FILE or rc_file in the config) is used as is.
+func applyFiles(login bool) []string {
+	if rcFileFlag != "" || useProfile || envRCFile != "" || fileSettings["rc_file"] != "" {
+		return []string{mgr.RCFile}
+	}
+	home, _ := os.UserHomeDir()
+	rc, profile := defaultRCFiles(targetShell())
+	switch {
+	case !login || targetShell() == "fish":
+		return []string{filepath.Join(home, rc)}
+	case targetShell() == "zsh":
+		// login zsh reads .zprofile, then .zshrc
+		return []string{filepath.Join(home, profile), filepath.Join(home, rc)}
+	}
+	// login bash reads only the first of these that exists
+	for _, f := range []string{profile, ".bash_login", ".profile"} {
+		if _, err := os.Stat(filepath.Join(home, f)); err == nil {
+			return []string{filepath.Join(home, f)}
+		}
+	}
+	return []string{filepath.Join(home, profile)}
+}
+
+// isLoginShell reports whether the shell that ran us is a login shell:
+// its argv[0] starts with "-" or it was started with -l/--login. Without
+// /proc, macOS is assumed to run login shells, as Terminal does.
+func isLoginShell() bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", os.Getppid()))
+	if err != nil {
+		return runtime.GOOS == "darwin"
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	if strings.HasPrefix(args[0], "-") {
+		return true
+	}
+	for _, a := range args[1:] {
+		if a == "-l" || a == "--login" {
+			return true
+		}
+	}
+	return false
+}
+
+// appliedStatePath is where the state of the last applied rc file is kept.
+func appliedStatePath() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		home, _ := os.UserHomeDir()
+		dir = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(dir, "cli-tool", "last-applied")
+}
+
+// ----------------- Misc helpers -----------------
+
+// printDone prints a success message; with --dry-run nothing was done, so
+// it prints nothing, and with --quiet only data is printed.
+func printDone(format string, a ...any) {
+	if !dryRun && !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// printChange prints a "Deleted ..."/"Would delete ..." line. Unlike
+// printDone it prints in a dry run, where the line is the preview, so
+// --quiet only silences it when the change was made.
+func printChange(format string, a ...any) {
+	if dryRun || !quiet {
+		fmt.Printf(format, a...)
+	}
+}
+
+// Exit codes. A check that answers "no" (alias get, list --strict,
+// apply --check-applied, sudoers test) exits exitNotFound too.
+const (
+	exitOK       = 0
+	exitNotFound = 1 // the alias, export, backup or file doesn't exist
+	exitUsage    = 2 // bad command line
+	exitInvalid  = 3 // validation failed: bad name or spec, visudo or shell -n error, damaged backup
+	exitFailure  = 4 // permission denied, I/O error, lock timeout, or any other failure
+)
+
+// exitCode maps err to the exit code that describes it.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, shctl.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return exitNotFound
+	case errors.Is(err, shctl.ErrInvalid):
+		return exitInvalid
+	}
+	return exitFailure
+}
+
+func dieErr(err error) {
+	fmt.Fprintln(os.Stderr, "error:", err)
+	os.Exit(exitCode(err))
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// confirm asks a yes/no question on the terminal; anything but y/yes is no.
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
 }
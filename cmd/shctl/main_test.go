@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marcelodevops/go-cli-tool/pkg/shctl"
+)
+
+func TestListGrepNameAndValue(t *testing.T) {
+	fsys := &shctl.MemFS{}
+	m := &shctl.Manager{RCFile: "/home/u/.bashrc", FS: fsys}
+	rc := "# >>> cli-tool managed >>>\n" +
+		"alias dps='docker ps'\n" +
+		"alias docker-clean='echo prune'\n" +
+		"alias ll='ls -la'\n" +
+		"alias dc='docker compose'\n" +
+		"# <<< cli-tool managed <<<\n"
+	if err := fsys.WriteFile(m.RCFile, []byte(rc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		grepName, value string
+		regex           bool
+		want            []string
+	}{
+		{"no filter", "", "", false, []string{"dps", "docker-clean", "ll", "dc"}},
+		{"value only", "", "docker", false, []string{"dps", "dc"}},
+		{"name only", "docker", "", false, []string{"docker-clean"}},
+		{"both", "d", "compose", false, []string{"dc"}},
+		{"value regex", "", "^docker (ps|compose)$", true, []string{"dps", "dc"}},
+		{"name regex", "^d.$", "", true, []string{"dc"}},
+		{"no match", "", "kubectl", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nameMatch, err := newMatcher(tt.grepName, tt.regex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			valueMatch, err := newMatcher(tt.value, tt.regex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := m.Entries("alias", func(e shctl.Entry) bool { return nameMatch(e.Name) && valueMatch(e.Value) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("matched %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMatcherInvalidRegex(t *testing.T) {
+	if _, err := newMatcher("(", true); err == nil {
+		t.Error("newMatcher accepted an invalid regex")
+	}
+	if _, err := newMatcher("(", false); err != nil {
+		t.Errorf("newMatcher rejected a plain substring: %v", err)
+	}
+}
+
+func TestApplyPrintMark(t *testing.T) {
+	for _, dry := range []bool{false, true} {
+		t.Run(map[bool]string{false: "marks", true: "dry run"}[dry], func(t *testing.T) {
+			t.Setenv("XDG_CACHE_HOME", "/home/u/.cache")
+			fsys := &shctl.MemFS{}
+			mgr = &shctl.Manager{RCFile: "/home/u/.bashrc", FS: fsys, DryRun: dry, Stdout: io.Discard}
+			rc := "# >>> cli-tool managed >>>\nalias ll='ls -la'\n# <<< cli-tool managed <<<\n"
+			if err := fsys.WriteFile(mgr.RCFile, []byte(rc), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var script, notes string
+			notes = capture(t, &os.Stderr, func() {
+				script = capture(t, &os.Stdout, func() { handleApply([]string{"--print", "--mark"}) })
+			})
+			// the preview goes to stderr, leaving stdout fit for eval
+			if !strings.Contains(script, "alias ll=") || strings.Contains(script, "last-applied") {
+				t.Errorf("apply --print printed:\n%s", script)
+			}
+			if dry != strings.Contains(notes, "last-applied") {
+				t.Errorf("stderr with DryRun %v:\n%s", dry, notes)
+			}
+			applied, err := mgr.IsApplied(appliedStatePath())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied == dry {
+				t.Errorf("applied = %v with DryRun %v", applied, dry)
+			}
+		})
+	}
+}
+
+// capture returns what fn writes to *f, which it points at a pipe.
+func capture(t *testing.T, f **os.File, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := *f
+	*f = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	fn()
+	*f = old
+	w.Close()
+	return string(<-out)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ----------------- Usage -----------------
+//
+// The full usage is the header, every command's block and the footer;
+// `cli-tool <command> --help` prints just that command's block.
+
+const usageHeader = `cli-tool (Go)
+
+Usage:
+  cli-tool [global flags] <command> [subcommand] [args...]
+
+Global flags:
+  --retries N          : retry transient file errors (EAGAIN, ESTALE, ...) N times (default 0)
+  --retry-delay D      : initial delay between retries, doubled each attempt (default 100ms)
+  --verbose            : show extra diagnostics (e.g. visudo warnings on success)
+  --json               : print JSON where supported (alias/export list)
+  --dry-run            : print the diff each change would make and write nothing
+                         (sudoers changes are still checked with visudo)
+  --lock-timeout D     : wait up to D for another run editing the same file (default 10s)
+  --timeout D          : kill visudo or sudo if still running after D, e.g. sudo waiting
+                         for a password in a script (default 30s; 0 waits forever)
+  --color WHEN         : color names and values, diffs and warnings: auto (default; off with
+                         NO_COLOR or when the output isn't a terminal), always or never
+  --no-color           : the same as --color never
+  --quiet              : print only data on stdout: no "added"/"removed" confirmations or
+                         backup notices (errors and warnings still go to stderr)
+  --check-syntax       : refuse alias/export changes the shell can't parse (shell -n);
+                         also check_syntax = true in the config
+  --follow-symlinks    : when the file to change is a symlink (e.g. into a dotfiles repo),
+                         write the file it points to; without it such changes are refused;
+                         also follow_symlinks = true in the config
+  --mode MODE          : permission bits (octal, e.g. 0600) of the rc file and other files
+                         the tool creates, before the umask (default 0644); existing files
+                         keep their mode; also file_mode = "0600" in the config
+  --rc-file PATH       : operate on PATH (overrides --profile and BASM_RC_FILE)
+  --profile            : operate on the login profile (~/.bash_profile, or ~/.zprofile for zsh)
+  --rc-files A,B,...   : alias/export add and remove: change each file, in the syntax its
+                         name implies (.zshrc zsh, *.fish fish, else bash); all or nothing
+  --priv-cmd CMD       : copy into /etc with CMD: sudo, doas or pkexec (default: sudo;
+                         also BASM_PRIV_CMD or priv_cmd in the config)
+  --shell SHELL        : write bash, zsh or fish syntax (default: from $SHELL; fish
+                         targets ~/.config/fish/config.fish)
+  --config PATH        : read settings from PATH instead of ~/.config/cli-tool/config.toml
+  --version            : print the version, commit and build date (also: cli-tool version)
+  --entry-prefix K=P   : recognize and write K (alias|export) entries with prefix P
+                         (repeatable; overrides alias_prefix/export_prefix in the config)
+
+Commands:
+`
+
+// commandUsage holds each command's actions and flags, in usage order.
+var commandUsage = []struct{ name, text string }{
+	{"alias", `  alias    add [--comment <reason>] [--tag <name>]... [--strict] [--stdout] <name> <command>
+                                   : add alias (replaces an existing alias of the same name);
+                                     warns when the name shadows a shell builtin or a command
+                                     on $PATH, or with --strict refuses it (exit 3);
+                                     --comment writes "# reason" above it (removed with it);
+                                     --tag adds "@tag:name" to that comment line (replacing
+                                     the alias's old tags);
+                                     --stdout prints the line instead of writing it (with
+                                     --json: {name, value, line})
+           add [--continue-on-error] -
+                                   : add a "name command" pair per stdin line; stops at the
+                                     first failing line (exit non-zero) unless
+                                     --continue-on-error, which skips it
+           list [--since-backup [--strict]] [--grep-name P] [--grep-value P] [--regex]
+                [--names] [--all] [--long] [--tag <name>]
+                                   : list aliases, or what changed since the latest backup;
+                                     --all includes disabled ones; --long shows comments;
+                                     --tag only shows aliases tagged with name;
+                                     --grep-* filter by name or by value only
+           import [--strict] <file> : add/update aliases from "name=command" lines
+           rename [--force] <old> <new>
+                                   : rename alias, keeping its command as-is
+           get [--value-only] <name>
+                                   : print one alias (exit 1 if it doesn't exist)
+           remove <name>           : remove alias
+           remove --regex <pattern>
+                                   : remove every alias whose name matches pattern
+           disable <name>          : comment the alias out ("# alias ...") without deleting it
+           enable <name>           : uncomment a disabled alias
+           sort                    : order the managed aliases by name, leaving comments and
+                                     other lines in place
+           dedupe                  : keep only the last definition of each managed alias and
+                                     report the ones collapsed`},
+	{"export", `  export   add [--declare] [--raw | --single | --double] [--comment <reason>] [--stdout]
+               <VAR> <value>
+                                   : add export, or update it if it exists (--declare writes
+                                     "declare -x", bash/zsh only); --comment as for alias add;
+                                     --stdout prints the line instead of writing it
+           add [--declare] [--raw | --single | --double] [--continue-on-error] -
+                                   : add a "VAR value" pair per stdin line, as alias add -
+           update [--raw | --single | --double] <VAR> <value>
+                                   : change the value of an existing export in place
+                                     (error if VAR isn't exported)
+                                     values referring to variables ($HOME/bin) are double-quoted
+                                     so they expand, other values with shell-special characters
+                                     single-quoted; --single or --double forces either, --raw
+                                     writes the value as-is, e.g. '$PATH:/opt/bin'
+           list [--since-backup [--strict]] [--grep-name P] [--grep-value P] [--regex]
+                [--names] [--all] [--long] [--tag <name>]
+                                   : list exports, or what changed since the latest backup;
+                                     --grep-* filter by name or by value only
+           remove <VAR>            : remove export
+           remove --regex <pattern>
+                                   : remove every export whose name matches pattern
+           disable <VAR>           : comment the export out without deleting it
+           enable <VAR>            : uncomment a disabled export
+           sort                    : order the managed exports by name (refused if an export
+                                     would move ahead of one it references)
+           dedupe                  : keep only the last definition of each managed export
+                                     (exports that extend themselves, PATH="$PATH:...", are
+                                     left as is)
+           path-add <dir>          : append export PATH="$PATH:<dir>" unless a PATH export has it
+           path-remove <dir>       : take <dir> out of every PATH export
+           path-list               : list the directories PATH exports add
+           env                     : print the managed exports for the current shell:
+                                     eval "$(cli-tool export env)"
+           dump [--format dotenv]  : print the managed exports as a .env file (KEY=value)
+           load [--format dotenv] <file>
+                                   : add/update an export for each KEY=value of a .env file
+                                     (nothing is written if a line is malformed)`},
+	{"search", `  search [--names-only] [-i] [--regex] <term>
+                                   : list the aliases and exports whose name or value contains
+                                     term, with their type (exit 1 if none); --names-only
+                                     matches names only, -i ignores case`},
+	{"migrate", `  migrate [--from bash] [--to fish] [--from-file P] [--to-file P]
+                                   : translate the aliases and exports of one shell's rc file
+                                     into another's syntax, in the target's managed block;
+                                     definitions that can't be translated are listed, not written`},
+	{"sudoers", `  sudoers  add [--file <name>] [--yes] <entry>
+                                   : add sudoers entry (uses visudo validation); --file
+                                     writes it to sudoers.d/<name> (mode 0440) instead;
+                                     NOPASSWD, ALL and wildcard commands are explained
+                                     and need confirmation (or --yes)
+           add --user <u> --command <c>... [--hosts h1,h2] [--runas R] [--nopasswd]
+                                   : build the entry from parts, e.g.
+                                     "deploy h1,h2=(ALL) /usr/bin/x"
+           list [--file <name>] [--numbers] [--source]
+                                   : list non-comment sudoers lines, then those of each file
+                                     it includes (#include, #includedir, @include...), under
+                                     "# <path>" headers; drop-ins nothing includes come last,
+                                     flagged; --numbers shows each line's number in its file,
+                                     --source prefixes each line with its file instead
+           remove [--file <name>] [--regex] <pattern>
+                                   : remove lines containing pattern, or matching it as
+                                     a regular expression with --regex (validates)
+           remove [--file <name|path>] --line N
+                                   : remove exactly line N, as numbered by list --numbers
+                                     (validates); --file picks a drop-in or any listed
+                                     file, and is required when N is a rule in several
+           remove --file <name>    : delete a drop-in
+           check [--file <name>] <entry>
+                                   : validate the entry as add would (visudo included)
+                                     without adding it; exits non-zero if it's invalid
+           edit [--file <name>]    : edit in $VISUAL/$EDITOR like visudo; validated before
+                                     applying, with the option to edit again on errors
+           test --user <u> --command <c> [--host <h>]
+                                   : best-effort check whether a rule allows the command
+                                     (read-only; exits 1 on deny)`},
+	{"backup", `  backup   [--no-rc] [--no-sudoers] [--include <file>]... [--parallel N]
+           [--include-config [--include-secrets]] [--compress] [--bundle] [--strict]
+                                   : backup files to backup dir (N concurrent copies);
+                                     a file that can't be read is reported at the end (exit
+                                     non-zero) without stopping the others, unless --strict;
+                                     secret-looking config values are redacted by default;
+                                     --compress writes .gz backups, which restore reads as-is;
+                                     --bundle writes one cli-tool.bak.<ts>.tar with a manifest;
+                                     --json prints {"rc": "<backup>", ...}
+           list                    : list backups by source, newest first, with size
+           verify                  : check every backup against its .sha256 checksum
+                                     (exit 3 if any is damaged)
+           delete [--yes] <file|timestamp>
+                                   : delete one backup, or all taken at a timestamp, with
+                                     their checksums (only inside the backup dir)
+           prune [--keep N] [--older-than D]
+                                   : delete all but the N newest backups of each file, or
+                                     only those older than D (both: backups that are both)`},
+	{"restore", `  restore  [--no-rc] [--no-sudoers] [--include-config] [--diff | --preview-diff [--yes]]
+           [--timestamp <ts> | --from <backup> | --bundle <file>]
+                                   : restore from the latest backups (sudo may be required);
+                                     --preview-diff shows current -> backup and asks first,
+                                     --diff shows it without asking (nothing is written
+                                     with --dry-run);
+                                     --timestamp picks the backups named *.bak.<ts>, --from
+                                     one backup file (both as shown by backup list);
+                                     --bundle restores each file in a bundle;
+                                     --json prints {"rc": "<file>", ...}`},
+	{"diff", `  diff     --against <backup|ts>  : show what changed in the rc file (and sudoers or config)
+                                     since that backup or bundle, as a unified diff
+                                     backup -> current; writes nothing`},
+	{"dump", `  dump     [--format shell] [--shell-file <path>]
+                                   : print managed aliases/exports normalized and deduped,
+                                     or write them to a standalone sourceable file`},
+	{"uninstall", `  uninstall                        : back up, then remove the managed block from the rc file
+                                     and the sudoers drop-ins the tool created`},
+	{"stats", `  stats                            : count the managed aliases and exports, the sudoers rules
+                                     (sudoers and drop-ins) and the backups with their disk
+                                     usage; --json for an object`},
+	{"doctor", `  doctor                           : check the setup (rc file writable and read by new shells,
+                                     shell matching it, visudo and sudo found, backup dir
+                                     writable and private, sudoers readable) and suggest fixes;
+                                     exits 4 if a check fails; --json for an array`},
+	{"undo", `  undo     [--list]               : revert the files changed by the last command that changed
+                                     any (sudoers and drop-ins only if they still validate);
+                                     run again to go further back (up to 20 commands);
+                                     --list shows what can be undone, newest first`},
+	{"sync", `  sync     commit [-m <message>]  : if the rc file (symlinks followed) is in a git working tree,
+                                     stage and commit it, and nothing else
+           push                    : push that repo's current branch (--dry-run: push --dry-run)`},
+	{"rc", `  rc       validate               : check the rc file with the shell's -n mode; exits 3 and lists
+                                     the errors by line if it doesn't parse
+           edit                    : back up the rc file and open it in $VISUAL/$EDITOR; if it
+                                     no longer parses, offers to revert to the backup (exit 3
+                                     if kept broken)`},
+	{"version", `  version                          : print the version, git commit and build date`},
+	{"completion", `  completion bash|zsh|fish        : print a completion script for commands and alias/export
+                                     names: source <(cli-tool completion bash)`},
+	{"apply", `  apply    --file <manifest> [--prune]
+           : make the rc file define each alias and export of a TOML manifest exactly once
+             and put each sudoers entry in place exactly once (validated), reporting every
+             change; running it again changes nothing. --prune also removes managed
+             aliases/exports (and rules of the manifest's drop-in) it doesn't list.
+             Manifest sections: [aliases] name = "cmd", [exports] VAR = "value",
+             [sudoers] file = "<drop-in>" (optional), entries = ["...", ...]
+  apply    [--mark] [--check-applied] [--print] [--login]
+           : source the RC file in a shell (spawns shell - won't affect current process);
+             a login shell (detected, or --login) sources ~/.bash_profile (else ~/.bash_login,
+             ~/.profile), or ~/.zprofile and ~/.zshrc; fails with the shell's exit code;
+             a file that fails "rc validate" is not sourced (exit 3);
+             --print instead prints the managed aliases and exports to load them into
+             the current shell: eval "$(cli-tool apply --print)";
+             --mark records the rc state in ~/.cache/cli-tool/last-applied,
+             --check-applied exits 1 if the rc changed since then`},
+}
+
+const usageFooter = `Aliases and exports are written between "# >>> cli-tool managed >>>" and
+"# <<< cli-tool managed <<<" (or the managed_begin/managed_end markers of the
+config) in the rc file; list, update, rename and remove only look inside that
+block and never touch hand-written lines.
+
+Config file (~/.config/cli-tool/config.toml); flags and BASM_* variables win over it:
+  rc_file = "/path"           : rc file (like BASM_RC_FILE)
+  sudoers_path = "/path"      : sudoers file (like BASM_SUDOERS_PATH)
+  backup_dir = "/path"        : backup directory (like BASM_BACKUP_DIR)
+  visudo_path = "/path"       : visudo binary (like BASM_VISUDO_PATH)
+  priv_cmd = "doas"           : privilege command for /etc (like BASM_PRIV_CMD)
+  audit_log = "/path"         : sudoers audit log (like BASM_AUDIT_LOG)
+  alias_prefix = "alias "     : prefix that marks an alias line
+  export_prefix = "export "   : prefix that marks an export line
+  managed_begin = "# BEGIN"   : comment line that opens the managed block
+  managed_end = "# END"       : comment line that closes it
+  follow_symlinks = true      : write through symlinked files (like --follow-symlinks)
+  file_mode = "0600"          : mode of files the tool creates (like --mode)
+
+Paths given in flags, BASM_* variables and the config may start with ~ and use $VAR.
+
+Environment overrides:
+  BASM_RC_FILE        - path to rc file (default: ~/.bashrc or ~/.zshrc)
+  BASM_SUDOERS_PATH   - path to sudoers (default: /etc/sudoers)
+  BASM_BACKUP_DIR     - backup directory (default: $XDG_STATE_HOME/cli-tool/backups,
+                        i.e. ~/.local/state/cli-tool/backups; the undo journal is kept
+                        in $XDG_STATE_HOME/cli-tool/journal)
+  BASM_CONFIG         - config file (default: ~/.config/cli-tool/config.toml)
+  BASM_VISUDO_PATH    - visudo binary (default: visudo in PATH)
+  BASM_PRIV_CMD       - sudo, doas or pkexec, for copies into /etc (default: sudo)
+  BASM_AUDIT_LOG      - where every sudoers change (entry, checksum, outcome) is logged
+                        as a JSON line (default: $XDG_STATE_HOME/cli-tool/audit.log)
+
+Exit codes:
+  0  success
+  1  not found (alias, export, backup, file), or a check answered no
+     (alias get, list --strict, apply --check-applied, sudoers test)
+  2  usage error
+  3  validation failed (bad name or spec, visudo or shell -n error, damaged backup)
+  4  permission denied, I/O error, lock timeout, or any other failure
+  apply passes on the exit code of the shell that sourced the rc file.
+
+Examples:
+  cli-tool alias add ll "ls -la"
+  cli-tool alias list
+  cli-tool sudoers add "myuser ALL=(ALL) NOPASSWD: /usr/bin/somebinary"
+`
+
+// writeUsage writes the full usage to w.
+func writeUsage(w io.Writer) {
+	var blocks []string
+	for _, c := range commandUsage {
+		blocks = append(blocks, c.text)
+	}
+	fmt.Fprint(w, usageHeader+strings.Join(blocks, "\n\n")+"\n\n"+usageFooter)
+}
+
+// usageAndExit prints the full usage to stderr and exits with exitUsage;
+// it is the response to a command line that can't be run.
+func usageAndExit() {
+	writeUsage(os.Stderr)
+	os.Exit(exitUsage)
+}
+
+// isHelpArg reports whether a asks for help.
+func isHelpArg(a string) bool {
+	return a == "-h" || a == "--help" || a == "-help" || a == "help"
+}
+
+// hasCommandHelp reports whether cmd has its own help.
+func hasCommandHelp(cmd string) bool {
+	for _, c := range commandUsage {
+		if c.name == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// helpAndExit prints the usage of cmd, or the full usage when cmd is
+// empty, to stdout and exits 0: help was asked for, so it isn't an error.
+func helpAndExit(cmd string) {
+	if cmd == "" {
+		writeUsage(os.Stdout)
+		os.Exit(exitOK)
+	}
+	for _, c := range commandUsage {
+		if c.name == cmd {
+			fmt.Printf("Usage:\n  cli-tool [global flags] %s ...\n\n%s\n\nRun 'cli-tool help' for the global flags, config file and exit codes.\n", cmd, c.text)
+			os.Exit(exitOK)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "help: unknown command %s\n\n", cmd)
+	usageAndExit()
+}
@@ -0,0 +1,99 @@
+package shctl
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// ----------------- Audit log -----------------
+//
+// Every change to the sudoers file or a drop-in, successful or not, is
+// appended to Manager.AuditLog as one JSON object per line. Logging is
+// best effort: a log that can't be written is warned about on Stderr but
+// never fails or blocks the change itself. Dry runs change nothing and
+// aren't logged.
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	SudoUser string    `json:"sudo_user,omitempty"` // who ran the tool through sudo
+	Op       string    `json:"op"`                  // e.g. "sudoers add", "drop-in remove"
+	File     string    `json:"file"`
+	Entry    string    `json:"entry,omitempty"` // the entry or pattern asked for
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	SHA256   string    `json:"sha256,omitempty"` // of File afterwards; empty once deleted
+	OK       bool      `json:"ok"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// audit starts recording op on path; the returned func, given the
+// operation's error, writes the record. Use it as
+//
+//	defer m.audit("sudoers add", path, entry)(&err)
+func (m *Manager) audit(op, path, entry string) func(*error) {
+	if m.AuditLog == "" || m.DryRun {
+		return func(*error) {}
+	}
+	before, _ := m.readFileRetry(path)
+	return func(errp *error) {
+		rec := AuditRecord{Time: time.Now(), Op: op, File: path, Entry: entry, OK: *errp == nil}
+		if *errp != nil {
+			rec.Error = (*errp).Error()
+		}
+		rec.User, rec.SudoUser = auditUser()
+		after, err := m.readFileRetry(path)
+		if err == nil {
+			rec.SHA256 = fmt.Sprintf("%x", sha256.Sum256(after))
+		}
+		for _, d := range diffLines(splitLines(string(before)), splitLines(string(after))) {
+			switch d.Kind {
+			case '+':
+				rec.Added = append(rec.Added, d.Text)
+			case '-':
+				rec.Removed = append(rec.Removed, d.Text)
+			}
+		}
+		if err := m.appendAudit(rec); err != nil {
+			m.warnf("warning: audit log %s: %v\n", m.AuditLog, err)
+		}
+	}
+}
+
+func auditUser() (name, sudoUser string) {
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	} else {
+		name = fmt.Sprint(os.Getuid())
+	}
+	return name, os.Getenv("SUDO_USER")
+}
+
+// appendAudit appends rec to the audit log in a single write, so
+// concurrent runs don't interleave their lines.
+func (m *Manager) appendAudit(rec AuditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := m.fsys().MkdirAll(filepath.Dir(m.AuditLog), 0o700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	f, err := m.fsys().OpenFile(m.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
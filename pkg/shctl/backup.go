@@ -0,0 +1,778 @@
+package shctl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------- Backup & Restore -----------------
+
+// backupTimeLayout is the timestamp in backup names, e.g. .bashrc.bak.20240131_235959.
+const backupTimeLayout = "20060102_150405"
+
+// backupPerm is the mode of backups and their checksums: they may hold the
+// sudoers file or secrets, whatever the mode of the file they copy.
+const backupPerm fs.FileMode = 0o600
+
+// BackupOptions selects the files Backup copies.
+type BackupOptions struct {
+	RC             bool
+	Sudoers        bool
+	Config         bool     // the file in Manager.ConfigFile
+	IncludeSecrets bool     // don't redact secret-looking config values
+	Compress       bool     // gzip each backup, named *.bak.<ts>.gz
+	Bundle         bool     // write one tar archive with a manifest (see bundle.go)
+	Include        []string // extra files, keyed by their path in the result
+	Parallel       int      // max concurrent copies; < 1 means 1
+	// Strict stops at the first file that can't be backed up and returns
+	// no result. Otherwise every other file is still backed up (see
+	// Backup).
+	Strict bool
+}
+
+type backupJob struct {
+	key, src, dst string
+	copy          func(src, dst string) error
+}
+
+// Backup copies the selected files into the backup dir and returns the
+// backup of each, keyed by "rc", "sudoers", "config" or the included path.
+// A file that can't be read (e.g. sudoers without root) doesn't stop the
+// others: the backups taken are returned along with an error joining the
+// failures, one per file, unless opts.Strict. With DryRun it returns the
+// names the backups would get.
+func (m *Manager) Backup(opts BackupOptions) (map[string]string, error) {
+	dir := m.backupDir()
+	if !m.DryRun {
+		// backups include sudoers: keep them away from other users
+		if err := m.fsys().MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	ts := time.Now().Format(backupTimeLayout)
+	ext, copier := "", m.copyBackup
+	if opts.Compress {
+		ext, copier = gzipExt, m.copyGzip
+	}
+	var jobs []backupJob
+	claimed := map[string]bool{} // destinations of earlier jobs
+	add := func(key, src string) {
+		for _, j := range jobs {
+			if j.key == key {
+				return // the same --include twice
+			}
+		}
+		dst := m.freeBackupPath(filepath.Join(dir, filepath.Base(src)+".bak."+ts), ext, claimed)
+		claimed[dst] = true
+		jobs = append(jobs, backupJob{key: key, src: src, dst: dst, copy: copier})
+	}
+	if opts.RC {
+		add("rc", m.RCFile)
+	}
+	if opts.Sudoers {
+		add("sudoers", m.SudoersPath())
+	}
+	if opts.Config {
+		add("config", m.ConfigFile)
+		if !opts.IncludeSecrets {
+			jobs[len(jobs)-1].copy = m.copyRedactedConfig
+		}
+	}
+	for _, p := range opts.Include {
+		add(p, p)
+	}
+
+	if opts.Bundle {
+		if m.DryRun {
+			return map[string]string{"bundle": m.freeBackupPath(filepath.Join(dir, bundleBase+".bak."+ts), ".tar"+ext, nil)}, nil
+		}
+		p, err := m.writeBundle(dir, ts, jobs, opts)
+		if p == "" {
+			return nil, err
+		}
+		return map[string]string{"bundle": p}, err
+	}
+
+	if m.DryRun {
+		out := map[string]string{}
+		for _, j := range jobs {
+			out[j.key] = j.dst
+		}
+		return out, nil
+	}
+	return m.runBackupJobs(jobs, opts.Parallel, opts.Strict)
+}
+
+// runBackupJobs copies every job with a bounded worker pool and writes the
+// checksum of each copy. Results and errors are collected per job index so
+// the outcome does not depend on scheduling order. With strict, no job is
+// started once one has failed, and no result is returned.
+func (m *Manager) runBackupJobs(jobs []backupJob, parallel int, strict bool) (map[string]string, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	errs := make([]error, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	anyFailed := false
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = jobs[i].copy(jobs[i].src, jobs[i].dst)
+				if errs[i] == nil {
+					errs[i] = m.writeChecksum(jobs[i].dst)
+				}
+				if errs[i] != nil {
+					failedMu.Lock()
+					anyFailed = true
+					failedMu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range jobs {
+		failedMu.Lock()
+		stop := strict && anyFailed
+		failedMu.Unlock()
+		if stop {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	out := map[string]string{}
+	var failed []error
+	for i, j := range jobs {
+		if errs[i] != nil {
+			failed = append(failed, fmt.Errorf("backup %s: %w", j.src, errs[i]))
+			continue
+		}
+		out[j.key] = j.dst
+	}
+	switch {
+	case len(failed) > 0 && strict:
+		return nil, errors.Join(failed...)
+	case len(failed) > 0:
+		return out, errors.Join(failed...)
+	}
+	return out, nil
+}
+
+// freeBackupPath returns dst+ext, or dst_N+ext when an earlier backup taken
+// within the same second, or a path in claimed, already uses that name.
+// claimed lets one Backup give files with the same base name their own
+// backups.
+func (m *Manager) freeBackupPath(dst, ext string, claimed map[string]bool) string {
+	p := dst + ext
+	for n := 1; ; n++ {
+		if _, err := m.fsys().Lstat(p); errors.Is(err, fs.ErrNotExist) && !claimed[p] {
+			return p
+		}
+		p = fmt.Sprintf("%s_%d%s", dst, n, ext)
+	}
+}
+
+// ----------------- Compressed backups -----------------
+
+const gzipExt = ".gz"
+
+// copyGzip writes a gzip-compressed copy of src to dst.
+func (m *Manager) copyGzip(src, dst string) error {
+	data, err := m.readFileRetry(src)
+	if err != nil {
+		return err
+	}
+	return m.writeBackupFile(dst, data, backupPerm)
+}
+
+// writeBackupFile writes data to dst, gzip-compressed when dst ends in .gz,
+// and gives it perm.
+func (m *Manager) writeBackupFile(dst string, data []byte, perm fs.FileMode) error {
+	if strings.HasSuffix(dst, gzipExt) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Name = strings.TrimSuffix(filepath.Base(dst), gzipExt)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+	if err := m.fsys().WriteFile(dst, data, perm); err != nil {
+		return err
+	}
+	return m.fsys().Chmod(dst, perm)
+}
+
+// readFileDecompressed reads path, decompressing it when its name ends in
+// .gz, so compressed backups can be used wherever a plain one can.
+func (m *Manager) readFileDecompressed(path string) ([]byte, error) {
+	data, err := m.readFileRetry(path)
+	if err != nil || !strings.HasSuffix(path, gzipExt) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer zr.Close()
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return out, nil
+}
+
+// RestoreOptions selects the files Restore puts back and the backups they
+// come from: the latest one by default.
+type RestoreOptions struct {
+	RC      bool
+	Sudoers bool
+	Config  bool
+	// Timestamp picks the backups taken at that time, as in their names
+	// (e.g. "20240131_235959" or "20240131_235959_1").
+	Timestamp string
+	// From restores this backup file to whichever selected file it is a
+	// backup of.
+	From string
+	// Bundle restores the selected files from this bundle instead; files
+	// it holds besides rc, sudoers and config go back to where they were
+	// backed up from.
+	Bundle string
+}
+
+// backupFor returns the backup of target that opts selects. ok is false
+// when target has no backup, or when opts.From is a backup of another file.
+func (m *Manager) backupFor(target string, opts RestoreOptions) (path string, ok bool, err error) {
+	switch {
+	case opts.From != "":
+		ok, _ = filepath.Match(backupPattern(target), filepath.Base(opts.From))
+		return opts.From, ok, nil
+	case opts.Timestamp != "":
+		if !validBackupStamp(opts.Timestamp) {
+			return "", false, invalid(fmt.Errorf("invalid backup timestamp %q (want e.g. %s)", opts.Timestamp, backupTimeLayout))
+		}
+		path = filepath.Join(m.backupDir(), filepath.Base(target)+".bak."+opts.Timestamp)
+		for _, p := range []string{path, path + gzipExt} {
+			_, err := m.fsys().Stat(p)
+			if err == nil {
+				return p, true, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", false, err
+			}
+		}
+		return "", false, notFound(fmt.Errorf("no backup of %s with timestamp %s in %s", target, opts.Timestamp, m.backupDir()))
+	}
+	path, ok = m.LatestBackup(target)
+	return path, ok, nil
+}
+
+// validBackupStamp reports whether ts is a timestamp as in backup names:
+// backupTimeLayout, maybe followed by the _N freeBackupPath adds.
+func validBackupStamp(ts string) bool {
+	if len(ts) < len(backupTimeLayout) {
+		return false
+	}
+	if _, err := time.Parse(backupTimeLayout, ts[:len(backupTimeLayout)]); err != nil {
+		return false
+	}
+	n := ts[len(backupTimeLayout):]
+	if n == "" {
+		return true
+	}
+	if n[0] != '_' || len(n) == 1 {
+		return false
+	}
+	for _, c := range n[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreTargets returns the files opts selects, keyed like Backup's result,
+// in restore order.
+func (m *Manager) restoreTargets(opts RestoreOptions) (keys, targets []string, err error) {
+	if opts.RC {
+		keys, targets = append(keys, "rc"), append(targets, m.RCFile)
+	}
+	if opts.Sudoers {
+		keys, targets = append(keys, "sudoers"), append(targets, m.SudoersPath())
+	}
+	if opts.Config {
+		keys, targets = append(keys, "config"), append(targets, m.ConfigFile)
+	}
+	if opts.From == "" {
+		return keys, targets, nil
+	}
+	if _, err := m.fsys().Stat(opts.From); err != nil {
+		return nil, nil, err
+	}
+	for i, t := range targets {
+		if ok, _ := filepath.Match(backupPattern(t), filepath.Base(opts.From)); ok {
+			return keys[i : i+1], targets[i : i+1], nil
+		}
+	}
+	return nil, nil, invalid(fmt.Errorf("%s is not a backup of any file being restored", opts.From))
+}
+
+// Restore replaces each selected file with its backup (see RestoreOptions)
+// and returns the restored files keyed like Backup's result. A file without
+// a backup is warned about on Stderr and skipped, unless none of them has
+// one: then nothing is restored and the error is ErrNotFound. A sudoers
+// backup that no longer validates is not restored.
+func (m *Manager) Restore(opts RestoreOptions) (map[string]string, error) {
+	if opts.Bundle != "" {
+		return m.restoreBundle(opts)
+	}
+	keys, targets, err := m.restoreTargets(opts)
+	if err != nil {
+		return nil, err
+	}
+	// find and verify every backup before restoring any, so a missing or
+	// damaged one changes nothing
+	backups := make([]string, len(targets))
+	var missing []string
+	for i, target := range targets {
+		bak, ok, err := m.backupFor(target, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			missing = append(missing, keys[i])
+			continue
+		}
+		if err := m.verifyBeforeRestore(bak); err != nil {
+			return nil, err
+		}
+		backups[i] = bak
+	}
+	if len(missing) > 0 && len(missing) == len(targets) {
+		return nil, notFound(fmt.Errorf("nothing restored: no %s backup found in %s", strings.Join(missing, " or "), m.backupDir()))
+	}
+	for _, key := range missing {
+		m.warnf("warning: no %s backup found in %s; %s not restored\n", key, m.backupDir(), key)
+	}
+	out := map[string]string{}
+	for i, target := range targets {
+		key, bak := keys[i], backups[i]
+		if bak == "" {
+			continue
+		}
+		data, err := m.readFileDecompressed(bak)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.restoreData(key, target, data); err != nil {
+			return nil, err
+		}
+		out[key] = target
+	}
+	return out, nil
+}
+
+// restoreData puts data back as target, the file Backup stored under key.
+func (m *Manager) restoreData(key, target string, data []byte) error {
+	switch key {
+	case "sudoers":
+		return m.restoreSudoers(data, target)
+	case "config":
+		return m.restoreConfig(data, target)
+	}
+	unlock, err := m.lockFile(target)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return m.WriteFile(target, string(data))
+}
+
+func (m *Manager) restoreSudoers(data []byte, sudoers string) (err error) {
+	unlock, err := m.lockFile(sudoers)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.audit("restore", sudoers, "")(&err)
+	// Validate before applying
+	tmp, err := m.tempFileNear(sudoers)
+	if err != nil {
+		return err
+	}
+	defer m.removeTemp(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := m.visudoValidate(tmp.Name()); err != nil {
+		return fmt.Errorf("backup sudoers failed validation: %w", err)
+	}
+	return m.commitCopy(tmp.Name(), sudoers)
+}
+
+// backupBeforeChange snapshots a sudoers file into the backup dir so that
+// Restore has the pre-change copy to go back to. A file that doesn't exist
+// yet has nothing to snapshot; any other failure aborts the change.
+func (m *Manager) backupBeforeChange(path string) error {
+	if m.DryRun {
+		return nil
+	}
+	if _, err := m.fsys().Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	res, err := m.Backup(BackupOptions{Include: []string{path}})
+	if err != nil {
+		return fmt.Errorf("not modifying %s, backup failed: %w", path, err)
+	}
+	m.notef("Backed up %s -> %s\n", path, res[path])
+	return nil
+}
+
+// RestoreDiff is the change restoring Target from Backup would make.
+type RestoreDiff struct {
+	Target string
+	Backup string
+	Diff   string // unified diff, "" when the two are identical
+}
+
+// RestoreDiffs returns the diff each selected restore would apply. Files
+// without a backup are left out.
+func (m *Manager) RestoreDiffs(opts RestoreOptions) ([]RestoreDiff, error) {
+	if opts.Bundle != "" {
+		return m.bundleDiffs(opts)
+	}
+	_, targets, err := m.restoreTargets(opts)
+	if err != nil {
+		return nil, err
+	}
+	var out []RestoreDiff
+	for _, target := range targets {
+		bak, ok, err := m.backupFor(target, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		d, err := m.diffFiles(target, bak)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RestoreDiff{Target: target, Backup: bak, Diff: d})
+	}
+	return out, nil
+}
+
+// BackupDiffs returns what changed since the backups ref names (a backup
+// file or a timestamp, as MatchBackups resolves it): for each, a unified
+// diff from the backup to the live file it is a backup of. A bundle gives
+// one diff per file it holds. Nothing is written.
+func (m *Manager) BackupDiffs(ref string) ([]RestoreDiff, error) {
+	paths, err := m.MatchBackups(ref)
+	if err != nil {
+		return nil, err
+	}
+	targets := map[string]string{filepath.Base(m.RCFile): m.RCFile, filepath.Base(m.SudoersPath()): m.SudoersPath()}
+	if m.ConfigFile != "" {
+		targets[filepath.Base(m.ConfigFile)] = m.ConfigFile
+	}
+	var out []RestoreDiff
+	for _, p := range paths {
+		name, _, _ := strings.Cut(filepath.Base(p), ".bak.")
+		if name == bundleBase {
+			manifest, contents, err := m.ReadBundle(p)
+			if err != nil {
+				return nil, err
+			}
+			files, paths := m.bundleTargets(manifest, RestoreOptions{RC: true, Sudoers: true, Config: true})
+			for i, f := range files {
+				cur, err := m.readFileOrEmpty(paths[i])
+				if err != nil {
+					return nil, err
+				}
+				member := p + ":" + f.Name
+				d := UnifiedDiff(member, paths[i], splitLines(string(contents[f.Name])), splitLines(string(cur)))
+				out = append(out, RestoreDiff{Target: paths[i], Backup: member, Diff: d})
+			}
+			continue
+		}
+		target, ok := targets[name]
+		if !ok {
+			return nil, invalid(fmt.Errorf("%s is not a backup of the rc, sudoers or config file", p))
+		}
+		d, err := m.diffFiles(p, target)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RestoreDiff{Target: target, Backup: p, Diff: d})
+	}
+	return out, nil
+}
+
+// backupPattern matches the names Backup gives to backups of src; an
+// empty src matches every backup.
+func backupPattern(src string) string {
+	if src == "" {
+		return "*.bak.*"
+	}
+	return filepath.Base(src) + ".bak.*"
+}
+
+// backupsMatching returns the files in the backup dir matching pattern.
+func (m *Manager) backupsMatching(pattern string) []string {
+	dir := m.backupDir()
+	ents, _ := m.fsys().ReadDir(dir)
+	var matches []string
+	for _, e := range ents {
+		if ok, _ := filepath.Match(pattern, e.Name()); ok && !e.IsDir() && !strings.HasSuffix(e.Name(), checksumExt) {
+			matches = append(matches, filepath.Join(dir, e.Name()))
+		}
+	}
+	return matches
+}
+
+// LatestBackup returns the newest backup of src in the backup dir.
+func (m *Manager) LatestBackup(src string) (string, bool) {
+	matches := m.backupsMatching(backupPattern(src))
+	if len(matches) == 0 {
+		return "", false
+	}
+	return m.latestFile(matches), true
+}
+
+// BackupFile is a backup found in the backup dir.
+type BackupFile struct {
+	Path   string    `json:"path"`
+	Source string    `json:"source"` // "rc", "sudoers", "config", "bundle" or the backed-up file's name
+	Time   time.Time `json:"time"`   // from the name, or the mtime for names without one
+	Size   int64     `json:"size"`
+}
+
+// Backups returns every backup in the backup dir, newest first.
+func (m *Manager) Backups() ([]BackupFile, error) {
+	sources := map[string]string{filepath.Base(m.RCFile): "rc", filepath.Base(m.SudoersPath()): "sudoers", bundleBase: "bundle"}
+	if m.ConfigFile != "" {
+		sources[filepath.Base(m.ConfigFile)] = "config"
+	}
+	var out []BackupFile
+	for _, p := range m.backupsMatching(backupPattern("")) {
+		fi, err := m.fsys().Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		name, stamp, _ := strings.Cut(filepath.Base(p), ".bak.")
+		b := BackupFile{Path: p, Source: name, Time: fi.ModTime(), Size: fi.Size()}
+		if s, ok := sources[name]; ok {
+			b.Source = s
+		}
+		if len(stamp) >= len(backupTimeLayout) {
+			if t, err := time.ParseInLocation(backupTimeLayout, stamp[:len(backupTimeLayout)], time.Local); err == nil {
+				b.Time = t
+			}
+		}
+		out = append(out, b)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].Time.Equal(out[j].Time) {
+			return out[i].Time.After(out[j].Time)
+		}
+		return out[i].Path > out[j].Path
+	})
+	return out, nil
+}
+
+// MatchBackups resolves ref, a backup file (by path or name) or a timestamp
+// as shown by backup list, to the backups in the backup dir it names.
+// Paths outside the backup dir are refused.
+func (m *Manager) MatchBackups(ref string) ([]string, error) {
+	dir := m.backupDir()
+	if strings.ContainsRune(ref, filepath.Separator) || strings.Contains(ref, ".bak.") {
+		p := ref
+		if !strings.ContainsRune(ref, filepath.Separator) {
+			p = filepath.Join(dir, ref)
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Dir(abs) != absDir {
+			return nil, invalid(fmt.Errorf("%s is not in the backup dir %s", ref, dir))
+		}
+		if ok, _ := filepath.Match(backupPattern(""), filepath.Base(abs)); !ok || strings.HasSuffix(abs, checksumExt) {
+			return nil, invalid(fmt.Errorf("%s is not a backup", ref))
+		}
+		if _, err := m.fsys().Stat(abs); err != nil {
+			return nil, err
+		}
+		return []string{abs}, nil
+	}
+	backups, err := m.Backups()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, b := range backups {
+		_, stamp, _ := strings.Cut(filepath.Base(b.Path), ".bak.")
+		stamp = strings.TrimSuffix(strings.TrimSuffix(stamp, gzipExt), ".tar")
+		if stamp == ref {
+			out = append(out, b.Path)
+		}
+	}
+	if len(out) == 0 {
+		return nil, notFound(fmt.Errorf("no backup with timestamp %s in %s", ref, dir))
+	}
+	return out, nil
+}
+
+// DeleteBackup removes the backup at path, which must come from
+// MatchBackups or Backups, together with its checksum. With DryRun it does
+// nothing.
+func (m *Manager) DeleteBackup(path string) error {
+	if m.DryRun {
+		return nil
+	}
+	if err := m.fsys().Remove(path); err != nil {
+		return err
+	}
+	if err := m.fsys().Remove(path + checksumExt); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// PruneOptions selects the backups PruneBackups deletes.
+type PruneOptions struct {
+	Keep      int           // keep this many newest backups of each source
+	OlderThan time.Duration // only delete backups older than this; 0 means any age
+}
+
+// PruneBackups deletes the backups beyond the Keep newest (by mtime) of
+// each source that are also older than OlderThan, and returns them. With
+// DryRun it only returns what it would delete.
+func (m *Manager) PruneBackups(opts PruneOptions) ([]string, error) {
+	if opts.Keep < 0 || opts.OlderThan < 0 {
+		return nil, invalid(errors.New("prune: --keep and --older-than must not be negative"))
+	}
+	if opts.Keep == 0 && opts.OlderThan == 0 {
+		return nil, invalid(errors.New("prune: need --keep or --older-than"))
+	}
+	backups, err := m.Backups()
+	if err != nil {
+		return nil, err
+	}
+	bySource := map[string][]string{}
+	var sources []string
+	for _, b := range backups {
+		if _, ok := bySource[b.Source]; !ok {
+			sources = append(sources, b.Source)
+		}
+		bySource[b.Source] = append(bySource[b.Source], b.Path)
+	}
+	cutoff := time.Now().Add(-opts.OlderThan)
+	var pruned []string
+	for _, src := range sources {
+		for i, p := range m.byModTime(bySource[src]) {
+			if i < opts.Keep {
+				continue
+			}
+			if opts.OlderThan > 0 {
+				fi, err := m.fsys().Stat(p)
+				if err != nil || !fi.ModTime().Before(cutoff) {
+					continue
+				}
+			}
+			if err := m.DeleteBackup(p); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, p)
+		}
+	}
+	return pruned, nil
+}
+
+// ----------------- Checksums -----------------
+//
+// Every backup gets a sidecar <backup>.sha256 in sha256sum format, so a
+// truncated or damaged backup is caught before it is restored.
+
+const checksumExt = ".sha256"
+
+// ErrNoChecksum is returned by VerifyBackup for backups taken before
+// checksums were written.
+var ErrNoChecksum = errors.New("no checksum recorded")
+
+// writeChecksum writes the sidecar checksum of the backup at path.
+func (m *Manager) writeChecksum(path string) error {
+	data, err := m.readFileRetry(path)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%x  %s\n", sha256.Sum256(data), filepath.Base(path))
+	if err := m.fsys().WriteFile(path+checksumExt, []byte(line), backupPerm); err != nil {
+		return err
+	}
+	return m.fsys().Chmod(path+checksumExt, backupPerm)
+}
+
+// VerifyBackup checks the backup at path against its sidecar checksum.
+func (m *Manager) VerifyBackup(path string) error {
+	want, err := m.readFileRetry(path + checksumExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: %w", path, ErrNoChecksum)
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(want))
+	if len(fields) == 0 {
+		return invalid(fmt.Errorf("%s: empty checksum file", path))
+	}
+	data, err := m.readFileRetry(path)
+	if err != nil {
+		return err
+	}
+	if got := fmt.Sprintf("%x", sha256.Sum256(data)); got != fields[0] {
+		return invalid(fmt.Errorf("%s: checksum mismatch (recorded %s, now %s): the backup is damaged", path, fields[0], got))
+	}
+	return nil
+}
+
+// verifyBeforeRestore refuses a backup whose checksum doesn't match. Backups
+// without a checksum are restored with a warning.
+func (m *Manager) verifyBeforeRestore(path string) error {
+	err := m.VerifyBackup(path)
+	if errors.Is(err, ErrNoChecksum) {
+		m.warnf("warning: %s has no checksum; restoring it unverified\n", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("not restoring: %w", err)
+	}
+	return nil
+}
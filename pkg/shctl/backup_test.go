@@ -0,0 +1,233 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupParallelManyFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    int
+		parallel int
+		missing  int  // included files that don't exist
+		sameBase bool // every included file is named "config"
+	}{
+		{"serial", 40, 1, 0, false},
+		{"parallel", 40, 8, 0, false},
+		{"more workers than files", 3, 16, 0, false},
+		{"with failures", 40, 8, 3, false},
+		{"same base name", 10, 4, 0, true},
+		{"same base name with failures", 10, 4, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, "alias ll='ls -la'\n")
+			var include []string
+			for i := 0; i < tt.files+tt.missing; i++ {
+				p := fmt.Sprintf("/home/u/conf/file%02d", i)
+				if tt.sameBase {
+					p = fmt.Sprintf("/home/u/conf/d%02d/config", i)
+				}
+				if i < tt.files {
+					writeTestFile(t, fsys, p, fmt.Sprintf("content %d\n", i))
+				}
+				include = append(include, p)
+			}
+			got, err := m.Backup(BackupOptions{RC: true, Include: include, Parallel: tt.parallel})
+			if tt.missing == 0 && err != nil {
+				t.Fatalf("Backup: %v", err)
+			}
+			if tt.missing > 0 && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Backup error = %v, want the missing files reported", err)
+			}
+			if len(got) != tt.files+1 {
+				t.Fatalf("Backup returned %d backups, want %d", len(got), tt.files+1)
+			}
+			dsts := map[string]string{}
+			for i, p := range include[:tt.files] {
+				bak, ok := got[p]
+				if !ok {
+					t.Fatalf("no backup of %s", p)
+				}
+				if other, ok := dsts[bak]; ok {
+					t.Fatalf("%s and %s were both backed up to %s", other, p, bak)
+				}
+				dsts[bak] = p
+				if data := readTestFile(t, fsys, bak); data != fmt.Sprintf("content %d\n", i) {
+					t.Errorf("backup of %s = %q", p, data)
+				}
+				if err := m.VerifyBackup(bak); err != nil {
+					t.Errorf("VerifyBackup: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestBackupParallelStrict(t *testing.T) {
+	m, fsys := newTestManager(t, "")
+	include := []string{"/home/u/missing"}
+	for i := 0; i < 10; i++ {
+		p := fmt.Sprintf("/home/u/f%d", i)
+		writeTestFile(t, fsys, p, "x\n")
+		include = append(include, p)
+	}
+	got, err := m.Backup(BackupOptions{Include: include, Parallel: 4, Strict: true})
+	if err == nil || got != nil {
+		t.Fatalf("strict Backup = %v, %v; want no result and an error", got, err)
+	}
+}
+
+func BenchmarkBackupParallel(b *testing.B) {
+	dir := b.TempDir()
+	var include []string
+	for i := 0; i < 64; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("file%02d", i))
+		if err := os.WriteFile(p, make([]byte, 64<<10), 0o644); err != nil {
+			b.Fatal(err)
+		}
+		include = append(include, p)
+	}
+	for _, parallel := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallel=%d", parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				m := &Manager{RCFile: filepath.Join(dir, "rc"), BackupDir: filepath.Join(b.TempDir(), "bak")}
+				if _, err := m.Backup(BackupOptions{Include: include, Parallel: parallel}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRestoreDiffs(t *testing.T) {
+	const bak = "/home/u/backups/.bashrc.bak.20240101_000000"
+	tests := []struct {
+		name, cur, backup string
+		want              string
+	}{
+		{"identical", "a\nb\n", "a\nb\n", ""},
+		{"changed line", "one\ntwo\nthree\n", "one\n2\nthree\n",
+			"--- /home/u/.bashrc\n+++ " + bak + "\n@@ -1,3 +1,3 @@\n one\n-two\n+2\n three\n"},
+		{"backup has more", "a\n", "a\nb\n",
+			"--- /home/u/.bashrc\n+++ " + bak + "\n@@ -1 +1,2 @@\n a\n+b\n"},
+		{"hunks apart", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "x\n2\n3\n4\n5\n6\n7\n8\n9\ny\n",
+			"--- /home/u/.bashrc\n+++ " + bak + "\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+y\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, tt.cur)
+			writeTestFile(t, fsys, bak, tt.backup)
+			diffs, err := m.RestoreDiffs(RestoreOptions{RC: true})
+			if err != nil {
+				t.Fatalf("RestoreDiffs: %v", err)
+			}
+			if len(diffs) != 1 || diffs[0].Target != m.RCFile || diffs[0].Backup != bak {
+				t.Fatalf("RestoreDiffs = %+v, want one diff of %s against %s", diffs, m.RCFile, bak)
+			}
+			if diffs[0].Diff != tt.want {
+				t.Errorf("diff =\n%s\nwant\n%s", diffs[0].Diff, tt.want)
+			}
+			// previewing changes nothing
+			if got := readTestFile(t, fsys, m.RCFile); got != tt.cur {
+				t.Errorf("rc file changed to %q", got)
+			}
+		})
+	}
+}
+
+func TestRestoreTimestamp(t *testing.T) {
+	tests := []struct {
+		timestamp string
+		want      error // nil: the backup is found
+	}{
+		{"20240101_000000", nil},
+		{"20240101_000000_1", nil},
+		{"20240102_000000", ErrNotFound},
+		{"../../../etc/passwd", ErrInvalid},
+		{"20240101_000000/../../../etc/passwd", ErrInvalid},
+		{"20240101_000000_../x", ErrInvalid},
+		{"20240101_000000_", ErrInvalid},
+		{"20241301_000000", ErrInvalid},
+		{"latest", ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.timestamp, func(t *testing.T) {
+			m, fsys := newTestManager(t, "cur\n")
+			writeTestFile(t, fsys, "/home/u/backups/.bashrc.bak.20240101_000000", "old\n")
+			writeTestFile(t, fsys, "/home/u/backups/.bashrc.bak.20240101_000000_1", "older\n")
+			_, err := m.RestoreDiffs(RestoreOptions{RC: true, Timestamp: tt.timestamp})
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("RestoreDiffs = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode fs.FileMode // of the rc file
+		opts BackupOptions
+	}{
+		{"plain", 0o644, BackupOptions{RC: true}},
+		{"world writable source", 0o666, BackupOptions{RC: true}},
+		{"compressed", 0o644, BackupOptions{RC: true, Compress: true}},
+		{"redacted config", 0o644, BackupOptions{Config: true}},
+		{"bundle", 0o644, BackupOptions{RC: true, Bundle: true}},
+		{"compressed bundle", 0o644, BackupOptions{RC: true, Bundle: true, Compress: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, "")
+			m.ConfigFile = "/home/u/.config/cli-tool/config"
+			for _, p := range []string{m.RCFile, m.ConfigFile} {
+				if err := fsys.WriteFile(p, []byte("token=abc\n"), tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := m.Backup(tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, bak := range got {
+				for _, p := range []string{bak, bak + checksumExt} {
+					fi, err := fsys.Stat(p)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if perm := fi.Mode().Perm(); perm != backupPerm {
+						t.Errorf("%s: mode %v, want %v", p, perm, backupPerm)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCopyFileKeepsSourceMode(t *testing.T) {
+	m, fsys := newTestManager(t, "")
+	if err := fsys.WriteFile("/src", []byte("x\n"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFile("/existing", []byte("old\n"), 0o604); err != nil {
+		t.Fatal(err)
+	}
+	for dst, want := range map[string]fs.FileMode{"/new": 0o640, "/existing": 0o604} {
+		if err := m.copyFile("/src", dst); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := fsys.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != want {
+			t.Errorf("%s: mode %v, want %v", dst, perm, want)
+		}
+	}
+}
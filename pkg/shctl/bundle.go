@@ -0,0 +1,255 @@
+package shctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// ----------------- Backup bundles -----------------
+//
+// A bundle is one tar archive (gzipped with Compress) holding every file of
+// a backup run plus manifest.json, which records where each file came from.
+// It is named cli-tool.bak.<ts>.tar[.gz] in the backup dir.
+
+const (
+	bundleBase     = "cli-tool"
+	bundleManifest = "manifest.json"
+)
+
+// BundleManifest describes the files in a bundle.
+type BundleManifest struct {
+	Created time.Time    `json:"created"`
+	Files   []BundleFile `json:"files"`
+}
+
+// BundleFile is one file in a bundle.
+type BundleFile struct {
+	Key     string      `json:"key"`  // "rc", "sudoers", "config" or the included path
+	Name    string      `json:"name"` // member name in the archive
+	Path    string      `json:"path"` // where it was backed up from
+	ModTime time.Time   `json:"mod_time"`
+	Mode    fs.FileMode `json:"mode"`
+}
+
+// writeBundle archives the sources of jobs into a new bundle in dir and
+// returns its path. Unless opts.Strict, sources that can't be read are
+// left out and their errors returned along with the path; the bundle is
+// only written if some source could be read.
+func (m *Manager) writeBundle(dir, ts string, jobs []backupJob, opts BackupOptions) (string, error) {
+	ext := ".tar"
+	if opts.Compress {
+		ext += gzipExt
+	}
+	dst := m.freeBackupPath(filepath.Join(dir, bundleBase+".bak."+ts), ext, nil)
+
+	manifest := BundleManifest{Created: time.Now()}
+	var contents [][]byte
+	var failed []error
+	for i, j := range jobs {
+		data, err := m.readFileRetry(j.src)
+		var fi fs.FileInfo
+		if err == nil {
+			fi, err = m.fsys().Stat(j.src)
+		}
+		if err != nil {
+			if opts.Strict {
+				return "", fmt.Errorf("backup %s: %w", j.src, err)
+			}
+			failed = append(failed, fmt.Errorf("backup %s: %w", j.src, err))
+			continue
+		}
+		if j.key == "config" && !opts.IncludeSecrets {
+			data = []byte(redactConfig(string(data)))
+		}
+		name := j.key
+		if name != "rc" && name != "sudoers" && name != "config" {
+			name = fmt.Sprintf("include/%d-%s", i, filepath.Base(j.src))
+		}
+		contents = append(contents, data)
+		manifest.Files = append(manifest.Files, BundleFile{
+			Key: j.key, Name: name, Path: j.src, ModTime: fi.ModTime(), Mode: fi.Mode().Perm(),
+		})
+	}
+	if len(manifest.Files) == 0 {
+		return "", errors.Join(failed...)
+	}
+	mdata, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if opts.Compress {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	add := func(name string, data []byte, mode fs.FileMode, mtime time.Time) error {
+		hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: mtime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(bundleManifest, append(mdata, '\n'), 0o644, manifest.Created); err != nil {
+		return "", err
+	}
+	for i, f := range manifest.Files {
+		if err := add(f.Name, contents[i], f.Mode, f.ModTime); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return "", err
+		}
+	}
+	// the bundle may hold the sudoers file and unredacted secrets
+	if err := m.fsys().WriteFile(dst, buf.Bytes(), backupPerm); err != nil {
+		return "", err
+	}
+	if err := m.fsys().Chmod(dst, backupPerm); err != nil {
+		return "", err
+	}
+	if err := m.writeChecksum(dst); err != nil {
+		return "", err
+	}
+	return dst, errors.Join(failed...)
+}
+
+// ReadBundle returns the manifest of the bundle at path and the content of
+// each file in it, keyed by member name.
+func (m *Manager) ReadBundle(path string) (BundleManifest, map[string][]byte, error) {
+	var manifest BundleManifest
+	data, err := m.readFileDecompressed(path)
+	if err != nil {
+		return manifest, nil, err
+	}
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		files[hdr.Name] = b
+	}
+	mdata, ok := files[bundleManifest]
+	if !ok {
+		return manifest, nil, invalid(fmt.Errorf("%s: not a backup bundle (no %s)", path, bundleManifest))
+	}
+	if err := json.Unmarshal(mdata, &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("%s: %s: %w", path, bundleManifest, err)
+	}
+	for _, f := range manifest.Files {
+		if _, ok := files[f.Name]; !ok {
+			return manifest, nil, invalid(fmt.Errorf("%s: %s is listed in the manifest but missing", path, f.Name))
+		}
+	}
+	return manifest, files, nil
+}
+
+// bundleTargets returns the files of manifest that opts selects and where
+// each is restored: rc, sudoers and config to the Manager's current files,
+// included files to the path they were backed up from. The sudoers file
+// comes first so a backup that no longer validates stops the restore
+// before anything was written.
+func (m *Manager) bundleTargets(manifest BundleManifest, opts RestoreOptions) (files []BundleFile, targets []string) {
+	for _, pass := range []bool{true, false} {
+		for _, f := range manifest.Files {
+			if (f.Key == "sudoers") != pass {
+				continue
+			}
+			var target string
+			switch f.Key {
+			case "rc":
+				if !opts.RC {
+					continue
+				}
+				target = m.RCFile
+			case "sudoers":
+				if !opts.Sudoers {
+					continue
+				}
+				target = m.SudoersPath()
+			case "config":
+				if !opts.Config || m.ConfigFile == "" {
+					continue
+				}
+				target = m.ConfigFile
+			default:
+				target = f.Path
+			}
+			files, targets = append(files, f), append(targets, target)
+		}
+	}
+	return files, targets
+}
+
+// restoreBundle restores the files of the bundle opts.Bundle.
+func (m *Manager) restoreBundle(opts RestoreOptions) (map[string]string, error) {
+	if err := m.verifyBeforeRestore(opts.Bundle); err != nil {
+		return nil, err
+	}
+	manifest, contents, err := m.ReadBundle(opts.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	files, targets := m.bundleTargets(manifest, opts)
+	if len(files) == 0 {
+		return nil, notFound(fmt.Errorf("nothing restored: %s holds none of the files selected", opts.Bundle))
+	}
+	out := map[string]string{}
+	for i, f := range files {
+		if err := m.restoreData(f.Key, targets[i], contents[f.Name]); err != nil {
+			return out, err
+		}
+		out[f.Key] = targets[i]
+	}
+	return out, nil
+}
+
+// bundleDiffs returns the change restoring each selected file of the bundle
+// opts.Bundle would make.
+func (m *Manager) bundleDiffs(opts RestoreOptions) ([]RestoreDiff, error) {
+	manifest, contents, err := m.ReadBundle(opts.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	files, targets := m.bundleTargets(manifest, opts)
+	var out []RestoreDiff
+	for i, f := range files {
+		cur, err := m.readFileOrEmpty(targets[i])
+		if err != nil {
+			return nil, err
+		}
+		member := opts.Bundle + ":" + f.Name
+		d := UnifiedDiff(targets[i], member, splitLines(string(cur)), splitLines(string(contents[f.Name])))
+		out = append(out, RestoreDiff{Target: targets[i], Backup: member, Diff: d})
+	}
+	return out, nil
+}
@@ -0,0 +1,185 @@
+package shctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// ----------------- Config file -----------------
+//
+// The config file is a small subset of TOML: `key = value` pairs, `# comments`
+// and `[section]` headers (keys inside a section are stored as
+// "section.key"). Values may be "basic strings", 'literal strings' or bare
+// words such as numbers and booleans.
+
+// Config maps config keys to their values.
+type Config map[string]string
+
+// LoadConfig reads and parses the config file at path.
+func (m *Manager) LoadConfig(path string) (Config, error) {
+	f, err := m.openRetry(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, invalid(fmt.Errorf("%s: %w", path, err))
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses config file content.
+func ParseConfig(r io.Reader) (Config, error) {
+	cfg := Config{}
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		cfg[key] = value
+	}
+	return cfg, sc.Err()
+}
+
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'") {
+		value, _, err := cutConfigString(raw)
+		return value, err
+	}
+	value, _, _ := strings.Cut(raw, "#")
+	return strings.TrimSpace(value), nil
+}
+
+// cutConfigString parses the "basic" or 'literal' string raw starts with
+// and returns it along with the rest of raw.
+func cutConfigString(raw string) (value, rest string, err error) {
+	if strings.HasPrefix(raw, "'") {
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return raw[1 : end+1], raw[end+2:], nil
+	}
+	end := 1
+	for ; end < len(raw); end++ {
+		if raw[end] == '\\' {
+			end++
+		} else if raw[end] == '"' {
+			break
+		}
+	}
+	if end >= len(raw) {
+		return "", "", errors.New("unterminated string")
+	}
+	value, err = strconv.Unquote(raw[:end+1])
+	return value, raw[end+1:], err
+}
+
+// ----------------- Config backup -----------------
+
+const redactedValue = "<redacted>"
+
+// IsSecretKey reports whether a config key looks like it holds a credential.
+func IsSecretKey(key string) bool {
+	k := strings.ToLower(key)
+	for _, w := range []string{"secret", "token", "password", "passphrase", "credential", "api_key"} {
+		if strings.Contains(k, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteConfigValues calls rewrite for every key/value in a config file's
+// content and replaces the value when rewrite returns true. Comments and
+// layout are preserved.
+func rewriteConfigValues(content string, rewrite func(key, value string) (string, bool)) string {
+	lines := strings.Split(content, "\n")
+	section := ""
+	for i, line := range lines {
+		t := strings.TrimSpace(line)
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+			section = strings.TrimSpace(t[1 : len(t)-1])
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		full := strings.TrimSpace(key)
+		if section != "" {
+			full = section + "." + full
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			continue
+		}
+		if nv, ok := rewrite(full, value); ok {
+			lines[i] = key + "= " + strconv.Quote(nv)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redactConfig replaces the secret values in config file content.
+func redactConfig(content string) string {
+	return rewriteConfigValues(content, func(key, _ string) (string, bool) {
+		return redactedValue, IsSecretKey(key)
+	})
+}
+
+// copyRedactedConfig backs up a config file with secret values replaced.
+func (m *Manager) copyRedactedConfig(src, dst string) error {
+	data, err := m.readFileRetry(src)
+	if err != nil {
+		return err
+	}
+	return m.writeBackupFile(dst, []byte(redactConfig(string(data))), backupPerm)
+}
+
+// restoreConfig restores the config backup data to target. Values that were
+// redacted in the backup keep their current value from target.
+func (m *Manager) restoreConfig(data []byte, target string) error {
+	current, err := m.LoadConfig(target)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	restored := rewriteConfigValues(string(data), func(key, value string) (string, bool) {
+		if value != redactedValue {
+			return "", false
+		}
+		if v, ok := current[key]; ok {
+			return v, true
+		}
+		m.warnf("warning: %s was redacted in the backup and has no current value\n", key)
+		return "", false
+	})
+	return m.WriteFile(target, restored)
+}
@@ -0,0 +1,116 @@
+package shctl
+
+import (
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigSelectsFile(t *testing.T) {
+	m, fsys := newTestManager(t, "")
+	writeTestFile(t, fsys, "/home/u/work.toml", "rc_file = \"/home/u/.work_rc\"\nbackup_dir = '/srv/backups'\n")
+	writeTestFile(t, fsys, "/home/u/home.toml", "# home setup\nrc_file = \"/home/u/.bashrc\"\ncheck_syntax = true\n")
+	writeTestFile(t, fsys, "/home/u/broken.toml", "rc_file = \"/home/u/.bashrc\nnot a setting\n")
+
+	tests := []struct {
+		path    string
+		want    Config
+		wantErr error
+	}{
+		{"/home/u/work.toml", Config{"rc_file": "/home/u/.work_rc", "backup_dir": "/srv/backups"}, nil},
+		{"/home/u/home.toml", Config{"rc_file": "/home/u/.bashrc", "check_syntax": "true"}, nil},
+		{"/home/u/missing.toml", nil, fs.ErrNotExist},
+		{"/home/u/broken.toml", nil, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := m.LoadConfig(tt.path)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("LoadConfig error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadConfig = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name, in string
+		want     Config
+		wantErr  bool
+	}{
+		{"basic string", `a = "x \"y\""`, Config{"a": `x "y"`}, false},
+		{"literal string", `a = 'C:\path'`, Config{"a": `C:\path`}, false},
+		{"bare value with comment", "n = 3 # three", Config{"n": "3"}, false},
+		{"section", "[profile.work]\nrc_file = \"/w\"", Config{"profile.work.rc_file": "/w"}, false},
+		{"missing equals", "rc_file", nil, true},
+		{"unterminated string", `a = "x`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConfig(strings.NewReader(tt.in))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseConfig = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseConfig: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseConfig = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigBackupRoundTrip(t *testing.T) {
+	const original = "rc_file = \"/home/u/.bashrc\"\n[sync]\napi_token = \"s3cret\"\n"
+	tests := []struct {
+		name           string
+		includeSecrets bool
+		wantInBackup   string // the token as stored in the backup
+		wantRestored   string
+	}{
+		{"redacted", false, redactedValue, "rc_file = \"/home/u/.bashrc\"\n[sync]\napi_token = \"rotated\"\n"},
+		{"with secrets", true, "s3cret", original},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, "")
+			m.ConfigFile = "/home/u/.config/cli-tool/config.toml"
+			writeTestFile(t, fsys, m.ConfigFile, original)
+
+			res, err := m.Backup(BackupOptions{Config: true, IncludeSecrets: tt.includeSecrets})
+			if err != nil {
+				t.Fatalf("Backup: %v", err)
+			}
+			cfg, err := m.LoadConfig(res["config"])
+			if err != nil {
+				t.Fatalf("LoadConfig(backup): %v", err)
+			}
+			if cfg["sync.api_token"] != tt.wantInBackup || cfg["rc_file"] != "/home/u/.bashrc" {
+				t.Errorf("backup holds %v", cfg)
+			}
+
+			writeTestFile(t, fsys, m.ConfigFile, "rc_file = \"/tmp/other\"\n[sync]\napi_token = \"rotated\"\n")
+			if _, err := m.Restore(RestoreOptions{Config: true}); err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			if got := readTestFile(t, fsys, m.ConfigFile); got != tt.wantRestored {
+				t.Errorf("restored config =\n%s\nwant\n%s", got, tt.wantRestored)
+			}
+		})
+	}
+}
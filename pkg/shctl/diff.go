@@ -0,0 +1,162 @@
+package shctl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ----------------- Line diff -----------------
+
+type diffOp struct {
+	Kind byte // ' ', '-' or '+'
+	Text string
+}
+
+// diffLines computes a shortest edit script from a to b (Myers' algorithm).
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	off := n + m + 1
+	v := make([]int, 2*off+1)
+	var trace [][]int
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	var rev []diffOp
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, diffOp{' ', a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				rev = append(rev, diffOp{'+', b[y-1]})
+			} else {
+				rev = append(rev, diffOp{'-', a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	ops := make([]diffOp, len(rev))
+	for i, op := range rev {
+		ops[len(rev)-1-i] = op
+	}
+	return ops
+}
+
+// UnifiedDiff renders the difference between a and b as a unified diff with
+// three lines of context. It returns "" when the inputs are equal.
+func UnifiedDiff(aName, bName string, a, b []string) string {
+	const context = 3
+	ops := diffLines(a, b)
+
+	// aPos/bPos[i] is the 0-based line index in a/b where ops[i] starts.
+	aPos := make([]int, len(ops)+1)
+	bPos := make([]int, len(ops)+1)
+	var changes []int
+	for i, op := range ops {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if op.Kind != '+' {
+			aPos[i+1]++
+		}
+		if op.Kind != '-' {
+			bPos[i+1]++
+		}
+		if op.Kind != ' ' {
+			changes = append(changes, i)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+	for i := 0; i < len(changes); {
+		start := changes[i] - context
+		if start < 0 {
+			start = 0
+		}
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*context {
+			j++
+		}
+		end := changes[j] + context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		aCount, bCount := aPos[end]-aPos[start], bPos[end]-bPos[start]
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aPos[start], aCount), hunkRange(bPos[start], bCount))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.Kind)
+			sb.WriteString(op.Text)
+			sb.WriteByte('\n')
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits file content into lines without a trailing empty element.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// diffFiles returns the unified diff from file a to file b; either may be
+// a compressed backup.
+func (m *Manager) diffFiles(a, b string) (string, error) {
+	ad, err := m.readFileDecompressed(a)
+	if err != nil {
+		return "", err
+	}
+	bd, err := m.readFileDecompressed(b)
+	if err != nil {
+		return "", err
+	}
+	return UnifiedDiff(a, b, splitLines(string(ad)), splitLines(string(bd))), nil
+}
@@ -0,0 +1,187 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// ----------------- Doctor -----------------
+//
+// Doctor looks for the setup problems that otherwise surface as cryptic
+// errors halfway through a command: an rc file that can't be written or
+// that new terminals don't read, a shell that doesn't match the file, no
+// visudo or privilege command, an unusable backup dir, an unreadable
+// sudoers. Nothing is written, apart from probe files that show whether a
+// directory is writable and are removed again.
+
+// Check is the outcome of one Doctor check.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"` // "pass", "warn" or "fail"
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"` // what to do about a warn or fail
+}
+
+// Doctor runs every check, in a fixed order.
+func (m *Manager) Doctor() []Check {
+	var out []Check
+	out = append(out, m.checkRCFile()...)
+	out = append(out, m.checkShell())
+	if !SudoersSupported {
+		out = append(out, checkWarn("sudoers", "", "%v", ErrSudoersUnsupported))
+		return append(out, m.checkBackupDir())
+	}
+	out = append(out, m.checkTool("visudo", m.VisudoPath,
+		"install sudo (it ships visudo), or set BASM_VISUDO_PATH; sudoers commands need it"))
+	out = append(out, m.checkTool("privilege command", m.PrivCmdPath,
+		"install sudo, or set BASM_PRIV_CMD to doas or pkexec; writing files under /etc needs it"))
+	out = append(out, m.checkBackupDir())
+	out = append(out, m.checkSudoers())
+	return out
+}
+
+func checkPass(name, format string, a ...any) Check {
+	return Check{Name: name, Status: "pass", Detail: fmt.Sprintf(format, a...)}
+}
+
+func checkWarn(name, fix, format string, a ...any) Check {
+	return Check{Name: name, Status: "warn", Detail: fmt.Sprintf(format, a...), Fix: fix}
+}
+
+func checkFail(name, fix, format string, a ...any) Check {
+	return Check{Name: name, Status: "fail", Detail: fmt.Sprintf(format, a...), Fix: fix}
+}
+
+// checkRCFile checks that the rc file can be written and is one new
+// interactive shells read.
+func (m *Manager) checkRCFile() []Check {
+	const name = "rc file"
+	rc := m.RCFile
+	var out []Check
+	if fi, err := m.fsys().Lstat(rc); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+		target, err := m.resolveSymlinks(rc)
+		switch {
+		case err != nil:
+			out = append(out, checkFail(name, "fix or remove the link", "%s: %v", rc, err))
+		case !m.FollowSymlinks:
+			out = append(out, checkWarn(name, "pass --follow-symlinks or set follow_symlinks = true in the config",
+				"%s is a symlink to %s; changes are refused unless symlinks are followed", rc, target))
+		}
+		if err == nil {
+			rc = target
+		}
+	}
+	switch _, err := m.fsys().Stat(rc); {
+	case errors.Is(err, fs.ErrNotExist):
+		if m.dirWritable(filepath.Dir(rc)) {
+			out = append(out, checkPass(name, "%s doesn't exist yet; it is created on the first change", rc))
+		} else {
+			out = append(out, checkFail(name, "create the file, or point --rc-file at one you can write",
+				"%s doesn't exist and %s isn't writable", rc, filepath.Dir(rc)))
+		}
+	case err != nil:
+		out = append(out, checkFail(name, "check the path and the permissions of its directories", "%s: %v", rc, err))
+	default:
+		f, err := m.fsys().OpenFile(rc, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			out = append(out, checkFail(name, "check its owner and mode with ls -l, e.g. chmod u+w "+rc, "%s isn't writable: %v", rc, err))
+			break
+		}
+		f.Close()
+		out = append(out, checkPass(name, "%s is writable", rc))
+	}
+	switch filepath.Base(m.RCFile) {
+	case ".bash_profile", ".bash_login", ".profile", ".zprofile", ".zlogin":
+		out = append(out, checkWarn("rc file kind", "use ~/.bashrc or ~/.zshrc (the default), or have the profile source it",
+			"%s is only read by login shells; most new terminals on Linux won't see changes to it", m.RCFile))
+	}
+	return out
+}
+
+// checkShell compares the target shell with the one the rc file's name
+// implies.
+func (m *Manager) checkShell() Check {
+	const name = "shell"
+	implied := ShellForRC(m.RCFile, "")
+	if implied != "" && implied != m.shell() {
+		return checkWarn(name, "pass --shell "+implied+", or point --rc-file at the "+m.shell()+" rc file",
+			"writing %s syntax, but %s looks like a %s file", m.shell(), m.RCFile, implied)
+	}
+	return checkPass(name, "writing %s syntax", m.shell())
+}
+
+// checkTool checks that an external command can be found.
+func (m *Manager) checkTool(name string, find func() (string, error), fix string) Check {
+	p, err := find()
+	if err != nil {
+		return checkWarn(name, fix, "%v", err)
+	}
+	return checkPass(name, "%s", p)
+}
+
+// checkBackupDir checks that backups can be written and that other users
+// can't read them: they may hold sudoers and secrets from the config.
+func (m *Manager) checkBackupDir() Check {
+	const name = "backup dir"
+	dir := m.backupDir()
+	fi, err := m.fsys().Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// MkdirAll creates it under the nearest directory that exists
+		parent := filepath.Dir(dir)
+		for parent != filepath.Dir(parent) {
+			if _, err := m.fsys().Stat(parent); !errors.Is(err, fs.ErrNotExist) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if !m.dirWritable(parent) {
+			return checkFail(name, "set BASM_BACKUP_DIR to a directory you can write",
+				"%s doesn't exist and can't be created: %s isn't writable", dir, parent)
+		}
+		return checkPass(name, "%s doesn't exist yet; it is created (mode 0700) on the first backup", dir)
+	case err != nil:
+		return checkFail(name, "set BASM_BACKUP_DIR to a directory you can write", "%s: %v", dir, err)
+	case !fi.IsDir():
+		return checkFail(name, "set BASM_BACKUP_DIR to a directory", "%s isn't a directory", dir)
+	case !m.dirWritable(dir):
+		return checkFail(name, "check its owner and mode with ls -ld, or set BASM_BACKUP_DIR", "%s isn't writable", dir)
+	// Windows has no group or other permission bits worth checking
+	case fi.Mode().Perm()&0o077 != 0 && fi.Mode()&fs.ModeSticky == 0 && runtime.GOOS != "windows":
+		return checkWarn(name, "chmod 700 "+dir, "%s is writable but has mode %04o, so other users can read backups of sudoers", dir, fi.Mode().Perm())
+	}
+	return checkPass(name, "%s is writable", dir)
+}
+
+// checkSudoers checks that the sudoers file can be read.
+func (m *Manager) checkSudoers() Check {
+	const name = "sudoers"
+	path := m.SudoersPath()
+	_, err := m.readFileRetry(path)
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return checkWarn(name, "run sudoers commands with sudo, or set BASM_SUDOERS_PATH to a copy you can read",
+			"%s can't be read without root", path)
+	case errors.Is(err, fs.ErrNotExist):
+		return checkWarn(name, "install sudo, or set BASM_SUDOERS_PATH", "%s doesn't exist", path)
+	case err != nil:
+		return checkFail(name, "check the path and its permissions", "%s: %v", path, err)
+	}
+	return checkPass(name, "%s is readable", path)
+}
+
+// dirWritable reports whether a file can be created in dir, by creating
+// and removing one.
+func (m *Manager) dirWritable(dir string) bool {
+	f, err := m.fsys().CreateTemp(dir, ".cli-tool-doctor-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	m.fsys().Remove(f.Name())
+	return true
+}
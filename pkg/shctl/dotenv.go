@@ -0,0 +1,216 @@
+package shctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ----------------- Dotenv -----------------
+//
+// The managed exports can be written as a .env file (KEY=value lines, no
+// export keyword) and read back from one. Literal values are written
+// unquoted when that is safe and single-quoted otherwise, which dotenv
+// tools read as-is; values that expand variables ("$HOME/bin") are
+// double-quoted so tools that interpolate expand them too.
+
+// DotenvVar is one KEY=value line of a .env file.
+type DotenvVar struct {
+	Name  string
+	Value string // unquoted; literal unless Expand
+	// Expand means Value refers to other variables ($NAME or ${NAME})
+	// and is shell double-quoted text (without the quotes), with \ " `
+	// and any literal $ escaped.
+	Expand bool
+}
+
+var dotenvSafeRe = regexp.MustCompile(`^[A-Za-z0-9_./:@%+,=-]+$`)
+
+// DumpDotenv renders the effective managed exports as a .env file. Exports
+// that extend themselves (PATH="$PATH:/x") have no .env equivalent; they
+// are left out with a warning.
+func (m *Manager) DumpDotenv() (string, error) {
+	doc, err := m.loadRCDocument(m.RCFile)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Generated by cli-tool from %s.\n", m.RCFile)
+	for _, e := range DedupeEntries(doc.Entries) {
+		if e.Kind != "export" {
+			continue
+		}
+		refs := varRefRe.FindAllStringSubmatch(singleQuotedRe.ReplaceAllString(e.Raw, ""), -1)
+		self := false
+		for _, ref := range refs {
+			self = self || ref[1] == e.Name
+		}
+		switch {
+		case self:
+			m.warnf("warning: export %s extends itself; left out of the .env file\n", e.Name)
+			continue
+		case strings.Contains(e.Value, "\n"):
+			m.warnf("warning: export %s spans lines; left out of the .env file\n", e.Name)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s=%s\n", e.Name, dotenvQuote(e.Value, len(refs) > 0))
+	}
+	return sb.String(), nil
+}
+
+// dotenvQuote quotes v for a .env file; with expand, its $ references stay
+// live inside double quotes.
+func dotenvQuote(v string, expand bool) string {
+	switch {
+	case expand:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	case v == "" || dotenvSafeRe.MatchString(v):
+		return v
+	case !strings.Contains(v, "'"):
+		return "'" + v + "'"
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`).Replace(v) + `"`
+}
+
+// ParseDotenv reads KEY=value lines, with an optional export keyword,
+// blank lines and # comments. Single-quoted values are literal;
+// double-quoted ones take \ escapes and may refer to variables, as may
+// unquoted ones, which end at a " #" comment.
+func ParseDotenv(r io.Reader) ([]DotenvVar, error) {
+	var vars []DotenvVar
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxLineSize)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, raw, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=value", n)
+		}
+		if !exportNameRe.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid variable name %q", n, name)
+		}
+		v, err := parseDotenvValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		v.Name = name
+		vars = append(vars, v)
+	}
+	return vars, sc.Err()
+}
+
+func parseDotenvValue(raw string) (DotenvVar, error) {
+	var v DotenvVar
+	var rest string
+	switch {
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return v, errors.New("unterminated single quote")
+		}
+		v.Value, rest = raw[1:1+end], raw[2+end:]
+	case strings.HasPrefix(raw, `"`):
+		// lit is the value as a literal, sh as shell double-quoted text
+		// keeping the references live; which one is used depends on
+		// whether there are any
+		var lit, sh strings.Builder
+		i := 1
+		for ; i < len(raw) && raw[i] != '"'; i++ {
+			c := raw[i]
+			switch {
+			case c == '\\' && i+1 < len(raw):
+				i++
+				c = raw[i]
+				switch c {
+				case 'n':
+					return v, errors.New("multi-line values aren't supported")
+				case '$', '"', '\\':
+				default:
+					lit.WriteByte('\\')
+					sh.WriteString(`\\`)
+				}
+			case c == '$' && startsWithVarRef(raw[i:]):
+				v.Expand = true
+				lit.WriteByte(c)
+				sh.WriteByte(c)
+				continue
+			}
+			lit.WriteByte(c)
+			sh.WriteString(shellDoubleQuote(string(c), false))
+		}
+		if i == len(raw) {
+			return v, errors.New("unterminated double quote")
+		}
+		v.Value, rest = lit.String(), raw[i+1:]
+		if v.Expand {
+			v.Value = sh.String()
+		}
+	default:
+		v.Value = raw
+		if i := strings.Index(raw, " #"); i >= 0 {
+			v.Value = strings.TrimSpace(raw[:i])
+		}
+		if varRefRe.MatchString(v.Value) {
+			v.Value, v.Expand = shellDoubleQuote(v.Value, true), true
+		}
+	}
+	if t := strings.TrimSpace(rest); t != "" && !strings.HasPrefix(t, "#") {
+		return v, fmt.Errorf("unexpected %q after the value", t)
+	}
+	return v, nil
+}
+
+func startsWithVarRef(s string) bool {
+	loc := varRefRe.FindStringIndex(s)
+	return loc != nil && loc[0] == 0
+}
+
+// shellDoubleQuote escapes s for use between double quotes in a shell; with
+// keepRefs, $ is left alone so references expand.
+func shellDoubleQuote(s string, keepRefs bool) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", "$", `\$`)
+	if keepRefs {
+		r = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	}
+	return r.Replace(s)
+}
+
+// LoadDotenv adds or updates an export for every variable of the .env file
+// at path. The whole file is parsed before anything is written, so a
+// malformed line changes nothing.
+func (m *Manager) LoadDotenv(path string) (ImportResult, error) {
+	var res ImportResult
+	f, err := m.openRetry(path)
+	if err != nil {
+		return res, err
+	}
+	vars, err := ParseDotenv(f)
+	f.Close()
+	if err != nil {
+		return res, invalid(fmt.Errorf("%s: %w", path, err))
+	}
+	for _, v := range vars {
+		value, opts := v.Value, ExportOptions{Quote: "single"}
+		if v.Expand {
+			value, opts = `"`+v.Value+`"`, ExportOptions{Raw: true}
+		}
+		updated, err := m.AddExport(v.Name, value, opts)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", v.Name, err)
+		}
+		if updated {
+			res.Updated++
+		} else {
+			res.Added++
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,343 @@
+package shctl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ----------------- Entry parsing -----------------
+
+// DefaultAliasPrefixes are the forms recognized as an alias definition.
+var DefaultAliasPrefixes = []string{"alias "}
+
+// DefaultExportPrefixes are the forms recognized as an exported variable;
+// the first one is used when writing POSIX shell syntax.
+var DefaultExportPrefixes = []string{"export ", "declare -x ", "set -gx ", "set -xg ", "set -x "}
+
+func (m *Manager) aliasPrefixes() []string {
+	if m.AliasPrefixes != nil {
+		return m.AliasPrefixes
+	}
+	return DefaultAliasPrefixes
+}
+
+func (m *Manager) exportPrefixes() []string {
+	if m.ExportPrefixes != nil {
+		return m.ExportPrefixes
+	}
+	return DefaultExportPrefixes
+}
+
+// SetEntryPrefix makes prefix the way entries of kind ("alias" or "export")
+// are recognized and written. For exports it replaces only the first,
+// written form; the other forms are still recognized. Every prefix must
+// identify exactly one kind of entry.
+func (m *Manager) SetEntryPrefix(kind, prefix string) error {
+	if strings.TrimSpace(prefix) == "" {
+		return invalid(fmt.Errorf("%s prefix must not be empty", kind))
+	}
+	aliases, exports := m.aliasPrefixes(), m.exportPrefixes()
+	switch kind {
+	case "alias":
+		aliases = []string{prefix}
+	case "export":
+		exports = append([]string{prefix}, exports[1:]...)
+	default:
+		return invalid(fmt.Errorf("unknown entry kind %q", kind))
+	}
+	for _, a := range aliases {
+		for _, e := range exports {
+			if strings.HasPrefix(a, e) || strings.HasPrefix(e, a) {
+				return invalid(fmt.Errorf("alias prefix %q and export prefix %q are ambiguous", a, e))
+			}
+		}
+	}
+	m.AliasPrefixes, m.ExportPrefixes = aliases, exports
+	return nil
+}
+
+// Entry is a single alias or export definition found in an rc file.
+type Entry struct {
+	Kind  string // "alias" or "export"
+	Name  string
+	Value string // with shell quoting removed
+	Line  int    // 1-based line number
+	Raw   string
+	// Comment is the text of the "# ..." line right above the entry, if
+	// any (see AddAliasWithComment).
+	Comment string
+	// Tags are the "@tag:name" words of Comment (see AddAliasTagged).
+	Tags []string
+}
+
+// ParseEntry recognizes `alias name=value` and `export NAME=value` lines
+// (in any of the configured prefix forms) as well as fish's
+// `alias name value` and `set -gx NAME value`.
+func (m *Manager) ParseEntry(line string) (Entry, bool) {
+	s := strings.TrimSpace(line)
+	kinds := []struct {
+		kind     string
+		prefixes []string
+	}{{"alias", m.aliasPrefixes()}, {"export", m.exportPrefixes()}}
+	for _, k := range kinds {
+		for _, p := range k.prefixes {
+			if !strings.HasPrefix(s, p) {
+				continue
+			}
+			rest := s[len(p):]
+			i := strings.IndexAny(rest, "= \t")
+			if i <= 0 {
+				return Entry{}, false
+			}
+			e := Entry{Kind: k.kind, Name: rest[:i], Raw: line}
+			if rest[i] == '=' {
+				e.Value = shellUnquote(rest[i+1:])
+			} else {
+				e.Value = fishUnquote(rest[i+1:])
+			}
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// entryMatcher returns a line matcher for the definition of kind/name.
+func (m *Manager) entryMatcher(kind, name string) func(string) bool {
+	return func(line string) bool {
+		e, ok := m.ParseEntry(line)
+		return ok && e.Kind == kind && e.Name == name
+	}
+}
+
+// shellUnquote returns the first shell word of s with quoting removed:
+// 'single', "double" (with backslash escapes) and bare words, concatenated.
+// Parsing stops at the first unquoted whitespace.
+func shellUnquote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				b.WriteString(s[i+1:])
+				return b.String()
+			}
+			b.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		case c == ' ' || c == '\t':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// fishUnquote parses fish words and joins them with spaces, so list values
+// such as `$PATH /opt/bin` round-trip.
+func fishUnquote(s string) string {
+	return strings.Join(fishWords(s), " ")
+}
+
+// fishWords parses fish words ('single' with \' and \\ escapes, "double",
+// bare) up to a comment.
+func fishWords(s string) []string {
+	var words []string
+	var b strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'':
+			inWord = true
+			for i++; i < len(s) && s[i] != '\''; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '\'' || s[i+1] == '\\') {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		case c == '"':
+			inWord = true
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\$", s[i+1]) >= 0 {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+		case c == '\\' && i+1 < len(s):
+			inWord = true
+			i++
+			b.WriteByte(s[i])
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, b.String())
+				b.Reset()
+				inWord = false
+			}
+		case c == '#' && !inWord:
+			i = len(s)
+		default:
+			inWord = true
+			b.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, b.String())
+	}
+	return words
+}
+
+// ----------------- Entry rendering -----------------
+
+// ShellQuote single-quotes s for POSIX shells. Embedded single quotes are
+// written as close quote, backslash-escaped quote, reopen quote.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// DoubleQuote double-quotes s, escaping the characters that stay special
+// inside double quotes except `$`, so variable references still expand.
+func DoubleQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
+
+// QuoteExportValue keeps expansion semantics: values referencing variables
+// are double-quoted, everything else is single-quoted.
+func QuoteExportValue(v string) string {
+	if strings.Contains(v, "$") {
+		return DoubleQuote(v)
+	}
+	return ShellQuote(v)
+}
+
+// FishQuote single-quotes s for fish, where only \ and ' are escaped.
+func FishQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + r.Replace(s) + "'"
+}
+
+// FishQuoteExportValue double-quotes values referencing variables so they
+// still expand, and single-quotes everything else.
+func FishQuoteExportValue(v string) string {
+	if strings.Contains(v, "$") {
+		return DoubleQuote(v)
+	}
+	return FishQuote(v)
+}
+
+// FormatShellEntry renders e in canonical POSIX shell syntax.
+func FormatShellEntry(e Entry) string {
+	if e.Kind == "alias" {
+		return "alias " + e.Name + "=" + ShellQuote(e.Value)
+	}
+	return "export " + e.Name + "=" + QuoteExportValue(e.Value)
+}
+
+// FormatFishEntry renders e in fish syntax. Exports written with fish's set
+// keep their list elements, so `set -gx PATH $PATH /opt/bin` round-trips.
+func FormatFishEntry(e Entry) string {
+	if e.Kind == "alias" {
+		return "alias " + e.Name + " " + FishQuote(e.Value)
+	}
+	words := []string{e.Value}
+	if t := strings.TrimSpace(e.Raw); strings.HasPrefix(t, "set ") {
+		if _, rest, ok := strings.Cut(t, " "+e.Name+" "); ok {
+			words = fishWords(rest)
+		}
+	}
+	for i, w := range words {
+		// quoting a list variable would join its elements into one
+		if !isVarRef(w) {
+			words[i] = FishQuoteExportValue(w)
+		}
+	}
+	return "set -gx " + e.Name + " " + strings.Join(words, " ")
+}
+
+// isVarRef reports whether w is a bare variable reference such as $PATH.
+func isVarRef(w string) bool {
+	if len(w) < 2 || w[0] != '$' {
+		return false
+	}
+	for i, r := range w[1:] {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// DedupeEntries keeps the last definition of every kind/name pair, in the
+// order those definitions appear.
+func DedupeEntries(es []Entry) []Entry {
+	last := map[[2]string]int{}
+	for i, e := range es {
+		last[[2]string{e.Kind, e.Name}] = i
+	}
+	var out []Entry
+	for i, e := range es {
+		if last[[2]string{e.Kind, e.Name}] == i {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// ----------------- Entry diff -----------------
+
+// EntryChange is one difference DiffEntries found between two sets of entries.
+type EntryChange struct {
+	Op   string `json:"op"` // "added", "removed" or "changed"
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// DiffEntries compares two sets of entries by kind and name; when a name is
+// defined more than once the last definition wins, as it does in the shell.
+// Changes are sorted by kind, then name.
+func DiffEntries(old, cur []Entry) []EntryChange {
+	index := func(es []Entry) map[[2]string]string {
+		m := map[[2]string]string{}
+		for _, e := range es {
+			m[[2]string{e.Kind, e.Name}] = e.Value
+		}
+		return m
+	}
+	before, after := index(old), index(cur)
+
+	var out []EntryChange
+	for k, v := range after {
+		if ov, ok := before[k]; !ok {
+			out = append(out, EntryChange{Op: "added", Kind: k[0], Name: k[1], New: v})
+		} else if ov != v {
+			out = append(out, EntryChange{Op: "changed", Kind: k[0], Name: k[1], Old: ov, New: v})
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			out = append(out, EntryChange{Op: "removed", Kind: k[0], Name: k[1], Old: v})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Kind != out[j].Kind {
+			return out[i].Kind < out[j].Kind
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
@@ -0,0 +1,72 @@
+package shctl
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestAliasQuoting(t *testing.T) {
+	tests := []struct {
+		name, command, line string
+	}{
+		{"plain", "ls -la", `alias a='ls -la'`},
+		{"single quotes", "echo 'hi there'", `alias a='echo '\''hi there'\'''`},
+		{"double quotes", `echo "$HOME"`, `alias a='echo "$HOME"'`},
+		{"backslashes", `printf '%s\n' x\ y`, `alias a='printf '\''%s\n'\'' x\ y'`},
+		{"only a quote", "'", `alias a=''\'''`},
+	}
+	sh, shErr := exec.LookPath("sh")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, managedRC())
+			if _, err := m.AddAlias("a", tt.command); err != nil {
+				t.Fatal(err)
+			}
+			if rc := readTestFile(t, m.FS, m.RCFile); !containsLine(rc, tt.line) {
+				t.Errorf("rc file has no line %s:\n%s", tt.line, rc)
+			}
+			e, ok, err := m.Lookup("alias", "a")
+			if err != nil || !ok {
+				t.Fatalf("Lookup = %v, %v", ok, err)
+			}
+			if e.Value != tt.command {
+				t.Errorf("parsed value = %q, want %q", e.Value, tt.command)
+			}
+			if shErr != nil {
+				return
+			}
+			// The shell must read the quoted word back as the command.
+			out, err := exec.Command(sh, "-c", "printf %s "+ShellQuote(tt.command)).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.command {
+				t.Errorf("sh reads %q, want %q", out, tt.command)
+			}
+		})
+	}
+}
+
+func TestAliasMultilineCommand(t *testing.T) {
+	for _, command := range []string{"ls\nalias rm='rm -rf'", "ls\r\necho hi", "ls\r"} {
+		rc := managedRC("alias ll='ls -la'")
+		m, _ := newTestManager(t, rc)
+		if _, err := m.AddAlias("a", command); !errors.Is(err, ErrInvalid) {
+			t.Errorf("AddAlias(%q) = %v, want ErrInvalid", command, err)
+		}
+		if _, err := m.AddAliasTagged("a", command, "", []string{"x"}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("AddAliasTagged(%q) = %v, want ErrInvalid", command, err)
+		}
+		writeTestFile(t, m.FS, "/home/u/import", "ok=ls\na="+ShellQuote(command)+"\n")
+		if _, err := m.ImportAliases("/home/u/import", true); !errors.Is(err, ErrInvalid) {
+			t.Errorf("ImportAliases of %q = %v, want ErrInvalid", command, err)
+		}
+		if err := m.RemoveAlias("a"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, m.FS, m.RCFile); got != rc {
+			t.Errorf("after adding and removing %q the rc file is:\n%s", command, got)
+		}
+	}
+}
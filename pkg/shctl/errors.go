@@ -0,0 +1,32 @@
+package shctl
+
+import "errors"
+
+// ----------------- Error kinds -----------------
+//
+// Errors returned by a Manager can be classified with errors.Is so callers
+// (the command's exit codes, scripts using the library) can tell a missing
+// entry from bad input without matching messages. Missing files report
+// fs.ErrNotExist and unreadable ones fs.ErrPermission, as usual.
+
+var (
+	// ErrNotFound marks a missing alias, export or backup.
+	ErrNotFound = errors.New("not found")
+	// ErrInvalid marks input or content that failed validation: a bad
+	// name or sudoers spec, a file visudo or the shell rejects, a damaged
+	// backup.
+	ErrInvalid = errors.New("invalid")
+)
+
+// kindError tags err with one of the kinds above without changing its
+// message.
+type kindError struct {
+	err  error
+	kind error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.err, e.kind} }
+
+func notFound(err error) error { return &kindError{err, ErrNotFound} }
+func invalid(err error) error  { return &kindError{err, ErrInvalid} }
@@ -0,0 +1,628 @@
+package shctl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ----------------- Dry run -----------------
+//
+// With DryRun every write goes through one of the commit helpers below,
+// which hand the diff the write would make to Preview instead of making it.
+// Otherwise they record the file in the undo journal before writing it.
+
+// WriteFile replaces the content of path, creating its directory first.
+func (m *Manager) WriteFile(path, content string) error {
+	if !m.DryRun {
+		if err := m.fsys().MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+	}
+	return m.commitFile(path, content)
+}
+
+// commitFile replaces the content of path.
+func (m *Manager) commitFile(path, content string) error {
+	if m.DryRun {
+		return m.previewWrite(path, content)
+	}
+	m.journal(path)
+	return m.atomicWriteFile(path, content)
+}
+
+// commitAppend appends data to path by writing the whole new content
+// through commitFile, so a crash or a concurrent reader never sees half of
+// it. Callers hold the file's lock, as for any read-modify-write.
+func (m *Manager) commitAppend(path string, data []byte) error {
+	cur, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return err
+	}
+	return m.commitFile(path, string(cur)+string(data))
+}
+
+// commitCopy replaces dst with the temp file src, using PrivCmd when dst
+// isn't ours to write.
+func (m *Manager) commitCopy(src, dst string) error {
+	if m.DryRun {
+		data, err := m.readFileRetry(src)
+		if err != nil {
+			return err
+		}
+		return m.previewWrite(dst, string(data))
+	}
+	m.journal(dst)
+	return m.copyBack(src, dst)
+}
+
+// previewWrite reports the unified diff between path and content.
+func (m *Manager) previewWrite(path, content string) error {
+	cur, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return err
+	}
+	d := UnifiedDiff(path, path+" (dry run)", splitLines(string(cur)), splitLines(content))
+	switch {
+	case m.Preview != nil:
+		m.Preview(path, d)
+	case d == "":
+		m.notef("%s: no changes\n", path)
+	default:
+		m.notef("%s", d)
+	}
+	return nil
+}
+
+// readFileOrEmpty reads path, treating a missing file as empty.
+func (m *Manager) readFileOrEmpty(path string) ([]byte, error) {
+	data, err := m.readFileRetry(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// ----------------- File utilities -----------------
+
+func (m *Manager) ensureFile(path string) error {
+	if m.DryRun {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := m.fsys().MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if _, err := m.fsys().Stat(path); errors.Is(err, fs.ErrNotExist) {
+		f, err := m.fsys().OpenFile(path, os.O_CREATE, m.fileMode())
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// upsertLine replaces the first line of path's managed block accepted by
+// match with line and drops later matches, or appends line to the block
+// when none matches. A non-empty comment line goes right above line (see
+// replaceEntry).
+func (m *Manager) upsertLine(path, line, comment string, match func(string) bool) (replaced bool, err error) {
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		out, found := m.replaceEntry(block, match, comment, func(string) string { return line })
+		if replaced = found; found {
+			return out, nil
+		}
+		return appendEntry(block, comment, line), nil
+	})
+	return replaced, err
+}
+
+// removeLinesMatching removes the lines of path's managed block accepted by
+// match, along with the entry comment right above each of them.
+func (m *Manager) removeLinesMatching(path string, match func(string) bool) error {
+	return m.editManagedBlock(path, func(block []string) ([]string, error) {
+		drop := m.markWithComments(block, func(i int) bool { return match(block[i]) })
+		return dropIndexes(block, func(i int) bool { return drop[i] }), nil
+	})
+}
+
+// removeLinesToTemp writes path without the lines for which match, given
+// the line number (from 1) and the line, returns true, to a new temp file
+// and returns its name; the caller commits it with commitCopy and removes
+// it with removeTemp. The file is streamed line by line, so memory stays
+// bounded however large it is; the result is the same as
+// joinLines(dropLines(...)) on the whole content.
+func (m *Manager) removeLinesToTemp(path string, match func(n int, ln []byte) bool) (string, error) {
+	in, err := m.openRetry(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	tmp, err := m.tempFileNear(path)
+	if err != nil {
+		return "", err
+	}
+
+	sc, w := bufio.NewScanner(in), bufio.NewWriter(tmp)
+	sc.Buffer(nil, maxLineSize)
+	sc.Split(scanRawLines)
+	var blanks []string // blank lines held back until a non-blank one follows
+	removed := false
+	for n := 1; sc.Scan(); n++ {
+		ln := sc.Bytes()
+		switch {
+		case match(n, ln):
+			removed = true
+		case len(bytes.TrimSpace(ln)) == 0:
+			// as in dropLines, a removal doesn't leave two blanks in a row
+			if !removed || len(blanks) == 0 {
+				blanks = append(blanks, string(ln))
+				removed = false
+			}
+		default:
+			for _, b := range blanks {
+				w.WriteString(b + "\n")
+			}
+			blanks = blanks[:0]
+			w.Write(ln)
+			w.WriteByte('\n')
+			removed = false
+		}
+	}
+	err = sc.Err()
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		m.removeTemp(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// maxLineSize bounds a single line read by removeLines.
+const maxLineSize = 64 << 20
+
+// scanRawLines is bufio.ScanLines without the removal of a trailing \r, so
+// streamed files keep their line endings byte for byte.
+func scanRawLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// dropLines returns lines without those accepted by match. Where a removed
+// line sat between two blank lines only one of them is kept, so repeated
+// edits don't leave runs of blanks behind.
+func dropLines(lines []string, match func(string) bool) []string {
+	return dropIndexes(lines, func(i int) bool { return match(lines[i]) })
+}
+
+// dropIndexes is dropLines with match given the index of each line.
+func dropIndexes(lines []string, match func(i int) bool) []string {
+	var out []string
+	removed := false
+	for i, ln := range lines {
+		if match(i) {
+			removed = true
+			continue
+		}
+		blank := strings.TrimSpace(ln) == ""
+		if removed && blank && len(out) > 0 && strings.TrimSpace(out[len(out)-1]) == "" {
+			continue
+		}
+		removed = false
+		out = append(out, ln)
+	}
+	return out
+}
+
+// joinLines joins lines into file content ending in exactly one newline,
+// dropping trailing blank lines.
+func joinLines(lines []string) string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// atomicWriteFile replaces path with content through a temp file and a
+// rename, keeping the mode and ownership of an existing path; a new one
+// gets FileMode.
+func (m *Manager) atomicWriteFile(path, content string) error {
+	return m.atomicWriteFileMode(path, content, 0)
+}
+
+// atomicWriteFileMode is atomicWriteFile with the new file given mode
+// before it is renamed into place; 0 keeps the mode of the file it
+// replaces.
+func (m *Manager) atomicWriteFileMode(path, content string, mode fs.FileMode) error {
+	defer m.invalidateRCDocument(path)
+	path, err := m.writeTarget(path)
+	if err != nil {
+		return err
+	}
+	perm := mode
+	if perm == 0 {
+		perm = m.fileMode()
+		if fi, err := m.fsys().Stat(path); err == nil {
+			perm = fi.Mode().Perm()
+		}
+	}
+	// the temp file is created 0600 and only gets its final mode once
+	// written, so it is never more open than the file it replaces
+	f, err := m.tempFileNear(path)
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer m.removeTemp(tmp)
+	err = writeSynced(f, []byte(content))
+	if err == nil {
+		err = m.copyFileMode(path, tmp)
+	}
+	if err == nil {
+		err = m.fsys().Chmod(tmp, perm)
+	}
+	if err != nil {
+		return err
+	}
+	return m.renameOrCopy(tmp, path)
+}
+
+// writeSynced writes data to f and, where the FS's files support it,
+// flushes it to disk before closing it, so the rename that follows can't
+// leave an empty or partial file behind after a crash.
+func writeSynced(f File, data []byte) error {
+	_, err := f.Write(data)
+	if s, ok := f.(interface{ Sync() error }); ok && err == nil {
+		err = s.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// maxSymlinks bounds the links writeTarget follows, as the kernel does.
+const maxSymlinks = 40
+
+// writeTarget returns the file that replacing path must replace: path, or
+// with FollowSymlinks the file at the end of the symlinks path is. A
+// symlink is refused otherwise.
+func (m *Manager) writeTarget(path string) (string, error) {
+	target, err := m.resolveSymlinks(path)
+	if err != nil || target == path || m.FollowSymlinks {
+		return target, err
+	}
+	return "", fmt.Errorf("%s is a symlink to %s; not replacing it with a regular file (use --follow-symlinks to write %s instead)", path, target, target)
+}
+
+// resolveSymlinks follows path while it is a symlink and returns the file
+// at the end of the chain (which need not exist).
+func (m *Manager) resolveSymlinks(path string) (string, error) {
+	for i := 0; i < maxSymlinks; i++ {
+		fi, err := m.fsys().Lstat(path)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			return path, nil
+		}
+		link, err := m.fsys().Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(path), link)
+		}
+		path = link
+	}
+	return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+}
+
+// appendLine appends line to path, first terminating an unterminated last
+// line so the two don't run together.
+func (m *Manager) appendLine(path, line string) error {
+	data, err := m.fsys().ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		line = "\n" + line
+	}
+	return m.appendFile(path, []byte(line+"\n"))
+}
+
+func (m *Manager) appendFile(path string, data []byte) error {
+	defer m.invalidateRCDocument(path)
+	f, err := m.fsys().OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(data)
+	return err
+}
+
+func (m *Manager) latestFile(files []string) string {
+	return m.byModTime(files)[0]
+}
+
+// byModTime returns files sorted newest first by modification time; files
+// that can't be stat'ed sort last.
+func (m *Manager) byModTime(files []string) []string {
+	times := map[string]time.Time{}
+	for _, f := range files {
+		if fi, err := m.fsys().Stat(f); err == nil {
+			times[f] = fi.ModTime()
+		}
+	}
+	out := append([]string{}, files...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return times[out[i]].After(times[out[j]])
+	})
+	return out
+}
+
+// ----------------- File copy / temp -----------------
+
+// copyFile copies src to dst. A dst it creates gets src's permissions.
+func (m *Manager) copyFile(src, dst string) error {
+	return m.withRetry(func() error { return m.copyFileOnce(src, dst, 0) })
+}
+
+// copyBackup copies src to the new backup dst, readable by its owner only.
+func (m *Manager) copyBackup(src, dst string) error {
+	return m.withRetry(func() error { return m.copyFileOnce(src, dst, backupPerm) })
+}
+
+// copyFileOnce copies src to dst. A dst it creates starts out 0600 and is
+// given perm (0: src's permissions) only once written, so the copy is
+// never more open than it should be; an existing dst keeps its mode.
+func (m *Manager) copyFileOnce(src, dst string, perm fs.FileMode) error {
+	defer m.invalidateRCDocument(dst)
+	in, err := m.fsys().Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = m.fsys().Lstat(dst)
+	created := errors.Is(err, fs.ErrNotExist)
+	out, err := m.fsys().OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if s, ok := out.(interface{ Sync() error }); ok {
+		if err := s.Sync(); err != nil {
+			return err
+		}
+	}
+	if !created {
+		return nil
+	}
+	if perm == 0 {
+		fi, err := m.fsys().Stat(src)
+		if err != nil {
+			return err
+		}
+		perm = fi.Mode().Perm()
+	}
+	return m.fsys().Chmod(dst, perm)
+}
+
+// copyToTemp copies src (which may be a compressed backup) to a temp file
+// next to dest, for copyBack to move into place.
+func (m *Manager) copyToTemp(src, dest string) (string, error) {
+	content, err := m.readFileDecompressed(src)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := m.tempFileNear(dest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		m.removeTemp(tmp.Name())
+		return "", err
+	}
+	_ = tmp.Close()
+	// preserve original permissions if possible, but keep the copy
+	// writable for us: a 0440 sudoers is still edited through it
+	fi, err := m.fsys().Stat(src)
+	if err == nil {
+		_ = m.fsys().Chmod(tmp.Name(), fi.Mode()|0o600)
+	}
+	return tmp.Name(), nil
+}
+
+// tempFileNear creates a temp file in dest's directory so that renaming it
+// over dest stays on one filesystem. The name contains a '.', which keeps
+// sudo's #includedir from reading it. When that directory isn't writable
+// (e.g. /etc without root) the system temp dir is used instead.
+func (m *Manager) tempFileNear(dest string) (File, error) {
+	f, err := m.createTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".tmp_*")
+	if err != nil {
+		return m.createTemp("", filepath.Base(dest)+".tmp_*")
+	}
+	return f, nil
+}
+
+// copyBack moves the temp file tmp over dest, keeping dest's permissions.
+// When dest's directory can't be written it overwrites dest in place, and
+// when dest can't be written either it copies through PrivCmd: what needs
+// root is decided by the permissions, not by the path.
+func (m *Manager) copyBack(tmp, dest string) error {
+	defer m.invalidateRCDocument(dest)
+	dest, err := m.writeTarget(dest)
+	if err != nil {
+		return err
+	}
+	err = m.copyFileMode(dest, tmp)
+	if err == nil {
+		err = m.renameOrCopy(tmp, dest)
+	}
+	if !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	if err := m.copyFile(tmp, dest); !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	return m.privileged("cp", tmp, dest)
+}
+
+// PrivCmdPath locates the privilege command (Manager.PrivCmd, or sudo in
+// PATH). With a custom Runner the name is passed to it as is.
+func (m *Manager) PrivCmdPath() (string, error) {
+	if !SudoersSupported {
+		return "", fmt.Errorf("no privilege command on %s: files you can't write can't be changed", runtime.GOOS)
+	}
+	name := m.PrivCmd
+	if name == "" {
+		name = "sudo"
+	}
+	if m.Runner != nil {
+		return name, nil
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("privilege command not found (%s): install it, or set BASM_PRIV_CMD to sudo, doas or pkexec", name)
+	}
+	return p, nil
+}
+
+// privileged runs a command through the privilege command, passing its
+// output to Stdout.
+func (m *Manager) privileged(args ...string) error {
+	priv, err := m.PrivCmdPath()
+	if err != nil {
+		return err
+	}
+	out, err := m.runner().Run(priv, args...)
+	if len(out) > 0 {
+		m.notef("%s", out)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w; if %s was waiting for a password, authenticate first (e.g. `sudo -v`) or raise the timeout",
+			err, filepath.Base(priv))
+	}
+	return err
+}
+
+// copyFileMode gives dst the permissions of ref and, where allowed, its
+// owner and group. A missing ref leaves dst alone.
+func (m *Manager) copyFileMode(ref, dst string) error {
+	fi, err := m.fsys().Stat(ref)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := m.fsys().Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if uid, gid, ok := fileOwner(fi); ok {
+		// only root may give a file away; keeping our own ownership is fine
+		if err := m.fsys().Lchown(dst, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameOrCopy renames src to dst, falling back to copy-then-remove when
+// they are on different filesystems.
+func (m *Manager) renameOrCopy(src, dst string) error {
+	err := m.withRetry(func() error { return m.fsys().Rename(src, dst) })
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := m.copyFile(src, dst); err != nil {
+		return err
+	}
+	return m.fsys().Remove(src)
+}
+
+// ----------------- Retry -----------------
+
+// isTransient reports whether err is one of the errors network filesystems
+// (NFS, SMB) return spuriously and that are worth retrying.
+func isTransient(err error) bool {
+	for _, e := range []syscall.Errno{syscall.EAGAIN, syscall.ESTALE, syscall.EINTR, syscall.EBUSY} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry runs op and retries it up to Retries times with exponential
+// backoff while it keeps failing with a transient error. The last error is
+// returned unchanged once retries are exhausted.
+func (m *Manager) withRetry(op func() error) error {
+	delay := m.RetryDelay
+	err := op()
+	for i := 0; i < m.Retries && err != nil && isTransient(err); i++ {
+		time.Sleep(delay)
+		delay *= 2
+		err = op()
+	}
+	return err
+}
+
+func (m *Manager) readFileRetry(path string) ([]byte, error) {
+	var data []byte
+	err := m.withRetry(func() error {
+		var err error
+		data, err = m.fsys().ReadFile(path)
+		return err
+	})
+	return data, err
+}
+
+func (m *Manager) openRetry(path string) (File, error) {
+	var f File
+	err := m.withRetry(func() error {
+		var err error
+		f, err = m.fsys().Open(path)
+		return err
+	})
+	return f, err
+}
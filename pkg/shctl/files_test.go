@@ -0,0 +1,299 @@
+package shctl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// flakyFS fails the first failures calls to Rename and Open with err.
+type flakyFS struct {
+	*MemFS
+	err      error
+	failures int
+}
+
+func (f *flakyFS) fail() error {
+	if f.failures > 0 {
+		f.failures--
+		return &os.LinkError{Op: "rename", Err: f.err}
+	}
+	return nil
+}
+
+func (f *flakyFS) Rename(oldpath, newpath string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemFS.Rename(oldpath, newpath)
+}
+
+func (f *flakyFS) Open(name string) (File, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.MemFS.Open(name)
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		failures int
+		retries  int
+		wantErr  error
+	}{
+		{"no failure", syscall.ESTALE, 0, 0, nil},
+		{"retries off", syscall.ESTALE, 1, 0, syscall.ESTALE},
+		{"recovers", syscall.ESTALE, 2, 3, nil},
+		{"recovers from EAGAIN", syscall.EAGAIN, 1, 1, nil},
+		{"exhausted", syscall.ESTALE, 3, 2, syscall.ESTALE},
+		{"not transient", syscall.EACCES, 1, 3, syscall.EACCES},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mem := newTestManager(t, "# rc\n")
+			flaky := &flakyFS{MemFS: mem, err: tt.err, failures: tt.failures}
+			m.FS = flaky
+			m.Retries = tt.retries
+			_, err := m.AddAlias("ll", "ls -la")
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("AddAlias: %v", err)
+				}
+				if got := readTestFile(t, mem, m.RCFile); !containsLine(got, "alias ll='ls -la'") {
+					t.Errorf("rc file lacks the alias:\n%s", got)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AddAlias error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopyFileRetries(t *testing.T) {
+	m, mem := newTestManager(t, "")
+	writeTestFile(t, mem, "/src", "data\n")
+	m.FS = &flakyFS{MemFS: mem, err: syscall.ESTALE, failures: 2}
+	m.Retries = 2
+	if err := m.copyFile("/src", "/dst"); err != nil {
+		t.Fatalf("copyFile: %v", err)
+	}
+	if got := readTestFile(t, mem, "/dst"); got != "data\n" {
+		t.Errorf("copy = %q", got)
+	}
+}
+
+func TestAtomicWriteFile(t *testing.T) {
+	const stale = "/home/u/.tmp_.bashrc"
+	tests := []struct {
+		name     string
+		existing fs.FileMode // 0: no file yet
+		mode     fs.FileMode
+		want     fs.FileMode
+	}{
+		{"new file", 0, 0, 0o644},
+		{"keeps mode", 0o600, 0, 0o600},
+		{"explicit mode", 0o644, 0o440, 0o440},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, "")
+			if tt.existing != 0 {
+				if err := fsys.WriteFile(m.RCFile, []byte("old\n"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// a file at the old fixed temp name belongs to someone else
+			writeTestFile(t, fsys, stale, "not ours\n")
+			if err := m.atomicWriteFileMode(m.RCFile, "new\n", tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, fsys, m.RCFile); got != "new\n" {
+				t.Errorf("content = %q, want %q", got, "new\n")
+			}
+			fi, err := fsys.Stat(m.RCFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != tt.want {
+				t.Errorf("mode = %v, want %v", got, tt.want)
+			}
+			if got := readTestFile(t, fsys, stale); got != "not ours\n" {
+				t.Errorf("%s = %q, want it untouched", stale, got)
+			}
+			ents, err := fsys.ReadDir("/home/u")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range ents {
+				if name := e.Name(); name != ".bashrc" && name != ".tmp_.bashrc" && !e.IsDir() {
+					t.Errorf("left behind %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveLinesToTempMatchesDropLines(t *testing.T) {
+	tests := []struct {
+		name, content string
+	}{
+		{"no match", "a\nb\n"},
+		{"middle", "a\nx\nb\n"},
+		{"blank pair collapses", "a\n\nx\n\nb\n"},
+		{"leading blank kept", "\na\nx\n"},
+		{"no trailing newline", "a\nx"},
+		{"crlf", "a\r\nx\r\nb\r\n"},
+		{"all removed", "x\nx\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, tt.content)
+			match := func(ln string) bool { return strings.TrimSuffix(ln, "\r") == "x" }
+			tmp, err := m.removeLinesToTemp(m.RCFile, func(_ int, ln []byte) bool { return match(string(ln)) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.removeTemp(tmp)
+			want := joinLines(dropLines(splitLines(tt.content), match))
+			if got := readTestFile(t, fsys, tmp); got != want {
+				t.Errorf("streamed = %q, want %q", got, want)
+			}
+			if got := readTestFile(t, fsys, m.RCFile); got != tt.content {
+				t.Errorf("source changed to %q", got)
+			}
+		})
+	}
+}
+
+func BenchmarkRemoveLinesToTemp(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "user%d ALL=(ALL) /usr/bin/cmd%d\n", i, i)
+	}
+	path := filepath.Join(b.TempDir(), "sudoers")
+	if err := os.WriteFile(path, []byte(sb.String()), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	m := &Manager{}
+	match := []byte("user50000 ")
+	b.SetBytes(int64(sb.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmp, err := m.removeLinesToTemp(path, func(_ int, ln []byte) bool { return bytes.HasPrefix(ln, match) })
+		if err != nil {
+			b.Fatal(err)
+		}
+		m.removeTemp(tmp)
+	}
+}
+
+func TestSymlinkedTarget(t *testing.T) {
+	const entry = "deploy ALL=(ALL) /usr/bin/x"
+	tests := []struct {
+		name    string
+		follow  bool
+		links   []string // each links to the next, the last to the real file
+		sudoers bool
+		wantErr bool
+	}{
+		{"refused", false, []string{"rc"}, false, true},
+		{"followed", true, []string{"rc"}, false, false},
+		{"followed through a chain", true, []string{"rc", "dotfiles/rc.link"}, false, false},
+		{"sudoers refused", false, []string{"sudoers"}, true, true},
+		{"sudoers followed", true, []string{"sudoers"}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sudoers && !SudoersSupported {
+				t.Skip(ErrSudoersUnsupported)
+			}
+			dir := t.TempDir()
+			real := filepath.Join(dir, "dotfiles", "real")
+			before := managedRC("alias ll='ls -la'")
+			if tt.sudoers {
+				before = "root ALL=(ALL:ALL) ALL\n" + entry + "\n"
+			}
+			if err := os.MkdirAll(filepath.Dir(real), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(real, []byte(before), 0o640); err != nil {
+				t.Fatal(err)
+			}
+			next := real
+			for i := len(tt.links) - 1; i >= 0; i-- {
+				link := filepath.Join(dir, tt.links[i])
+				rel, err := filepath.Rel(filepath.Dir(link), next)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(rel, link); err != nil {
+					t.Skip(err)
+				}
+				next = link
+			}
+			m := &Manager{BackupDir: filepath.Join(dir, "backups"), Runner: &fakeRunner{}, FollowSymlinks: tt.follow}
+			var err error
+			if tt.sudoers {
+				m.SudoersFile = next
+				err = m.SudoersRemove("deploy")
+			} else {
+				m.RCFile = next
+				_, err = m.AddAlias("gs", "git status")
+			}
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "is a symlink to "+real) {
+					t.Fatalf("error = %v, want a refusal naming %s", err, real)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range tt.links {
+				if fi, err := os.Lstat(filepath.Join(dir, l)); err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+					t.Errorf("%s is no longer a symlink (%v)", l, err)
+				}
+			}
+			data, err := os.ReadFile(real)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch got := string(data); {
+			case tt.wantErr && got != before:
+				t.Errorf("refused write changed the target to %q", got)
+			case !tt.wantErr && got == before:
+				t.Error("the target was not changed")
+			}
+			fi, err := os.Stat(real)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perm := fi.Mode().Perm(); perm != 0o640 {
+				t.Errorf("target mode = %v, want 0640", perm)
+			}
+		})
+	}
+}
+
+func TestSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	if err := os.Symlink(b, a); err != nil {
+		t.Skip(err)
+	}
+	if err := os.Symlink(a, b); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manager{RCFile: a, BackupDir: dir, FollowSymlinks: true}
+	if _, err := m.writeTarget(a); err == nil || !strings.Contains(err.Error(), "too many levels") {
+		t.Errorf("writeTarget error = %v, want a symlink loop", err)
+	}
+}
@@ -0,0 +1,73 @@
+package shctl
+
+import (
+	"io"
+	"io/fs"
+	"os"
+)
+
+// ----------------- Filesystem -----------------
+//
+// Every file the package reads or writes goes through a Manager's FS. The
+// default is the real filesystem (OSFS); MemFS keeps everything in memory,
+// so whole add/list/remove sequences can run without touching disk. Paths
+// are OS paths, not the slash-separated relative names of io/fs.
+
+// File is an open file of an FS.
+type File interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// FS is the filesystem a Manager works on. Its methods behave like the os
+// functions of the same name.
+type FS interface {
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	CreateTemp(dir, pattern string) (File, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	Readlink(name string) (string, error)
+	MkdirAll(path string, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Lchown(name string, uid, gid int) error
+}
+
+// OSFS is the real filesystem, used when Manager.FS is nil.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (File, error) { return os.Open(name) }
+
+func (OSFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFS) CreateTemp(dir, pattern string) (File, error) { return os.CreateTemp(dir, pattern) }
+
+func (OSFS) ReadFile(name string) ([]byte, error) { return os.ReadFile(name) }
+
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (OSFS) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (OSFS) Lstat(name string) (fs.FileInfo, error)       { return os.Lstat(name) }
+func (OSFS) Readlink(name string) (string, error)         { return os.Readlink(name) }
+func (OSFS) MkdirAll(path string, perm fs.FileMode) error { return os.MkdirAll(path, perm) }
+func (OSFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (OSFS) Remove(name string) error                     { return os.Remove(name) }
+func (OSFS) Chmod(name string, mode fs.FileMode) error    { return os.Chmod(name, mode) }
+func (OSFS) Lchown(name string, uid, gid int) error       { return os.Lchown(name, uid, gid) }
+
+func (m *Manager) fsys() FS {
+	if m.FS != nil {
+		return m.FS
+	}
+	return OSFS{}
+}
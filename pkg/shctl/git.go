@@ -0,0 +1,97 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ----------------- Git sync -----------------
+//
+// An rc file kept in a git working tree (a dotfiles repo, often reached
+// through a symlink) can be committed and pushed from here, so every
+// managed change can be tracked. git runs through the Manager's Runner
+// with -C set to the file's directory.
+
+// GitRepo returns the top of the git working tree holding the rc file,
+// with the rc file's path (symlinks resolved) relative to it. A file
+// outside any working tree is ErrNotFound.
+func (m *Manager) GitRepo() (top, rel string, err error) {
+	path, err := m.resolveSymlinks(m.RCFile)
+	if err != nil {
+		return "", "", err
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", "", err
+	}
+	out, err := m.git(filepath.Dir(path), "rev-parse", "--show-toplevel")
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", "", err
+	}
+	if err != nil {
+		return "", "", notFound(fmt.Errorf("%s is not in a git working tree", path))
+	}
+	top = strings.TrimSpace(out)
+	if rel, err = filepath.Rel(top, path); err != nil {
+		return "", "", err
+	}
+	return top, rel, nil
+}
+
+// GitCommit commits the rc file's changes, and only those, with message.
+// It reports false when the file has nothing to commit. With DryRun it
+// says what it would commit and commits nothing.
+func (m *Manager) GitCommit(message string) (committed bool, err error) {
+	top, rel, err := m.GitRepo()
+	if err != nil {
+		return false, err
+	}
+	status, err := m.git(top, "status", "--porcelain", "--", rel)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(status) == "" {
+		return false, nil
+	}
+	if m.DryRun {
+		m.notef("would commit %s in %s: %s\n", rel, top, message)
+		return true, nil
+	}
+	if _, err := m.git(top, "add", "--", rel); err != nil {
+		return false, err
+	}
+	// with paths, commit leaves anything else already staged alone
+	if _, err := m.git(top, "commit", "-m", message, "--", rel); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GitPush pushes the current branch of the rc file's repo to its
+// upstream and returns git's output. With DryRun it runs push --dry-run.
+func (m *Manager) GitPush() (string, error) {
+	top, _, err := m.GitRepo()
+	if err != nil {
+		return "", err
+	}
+	args := []string{"push"}
+	if m.DryRun {
+		args = append(args, "--dry-run")
+	}
+	return m.git(top, args...)
+}
+
+// git runs git in dir; a failure carries git's output.
+func (m *Manager) git(dir string, args ...string) (string, error) {
+	out, err := m.runner().Run("git", append([]string{"-C", dir}, args...)...)
+	if err != nil {
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			return "", fmt.Errorf("git %s: %w", args[0], err)
+		}
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, msg)
+	}
+	return string(out), nil
+}
@@ -0,0 +1,239 @@
+package shctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ----------------- Undo journal -----------------
+//
+// Before the first write to a file, a run records the file's content in
+// its journal entry (one JSON file per run in Manager.JournalDir); Undo
+// puts back every file of the newest entry and drops it, so repeated
+// undos walk further back. Only the newest JournalDepth entries are kept.
+
+// DefaultJournalDepth is how many runs the journal keeps when
+// Manager.JournalDepth is zero.
+const DefaultJournalDepth = 20
+
+// JournalEntry is what one run changed.
+type JournalEntry struct {
+	ID      string        `json:"id"`
+	Time    time.Time     `json:"time"`
+	Command string        `json:"command,omitempty"`
+	Files   []JournalFile `json:"files"`
+}
+
+// JournalFile is a file as it was before the run first wrote it.
+type JournalFile struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"` // "sudoers", "drop-in" or "file"
+	Existed bool   `json:"existed"`
+	Content []byte `json:"content,omitempty"`
+}
+
+// journal records path's current content in this run's journal entry,
+// unless it already holds it. Journaling is best effort: a failure is
+// warned about and the write goes ahead.
+func (m *Manager) journal(path string) {
+	if m.JournalDir == "" || m.DryRun {
+		return
+	}
+	m.journalMu.Lock()
+	defer m.journalMu.Unlock()
+	if m.undoing {
+		return
+	}
+	if err := m.journalLocked(path); err != nil {
+		m.warnf("warning: undo journal: %s: %v\n", path, err)
+	}
+}
+
+func (m *Manager) journalLocked(path string) error {
+	if m.journalRun == nil {
+		now := time.Now()
+		m.journalRun = &JournalEntry{
+			ID:      fmt.Sprintf("%s_%d", now.UTC().Format("20060102T150405.000000000"), os.Getpid()),
+			Time:    now,
+			Command: m.Command,
+		}
+		if err := m.fsys().MkdirAll(m.JournalDir, 0o700); err != nil {
+			return err
+		}
+		defer m.pruneJournal()
+	}
+	for _, f := range m.journalRun.Files {
+		if f.Path == path {
+			return nil
+		}
+	}
+	jf := JournalFile{Path: path, Kind: m.journalKind(path), Existed: true}
+	data, err := m.readFileRetry(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		jf.Existed = false
+	case err != nil:
+		return err
+	}
+	jf.Content = data
+	m.journalRun.Files = append(m.journalRun.Files, jf)
+	out, err := json.Marshal(m.journalRun)
+	if err != nil {
+		return err
+	}
+	return m.fsys().WriteFile(filepath.Join(m.JournalDir, m.journalRun.ID+".json"), out, 0o600)
+}
+
+// journalKind tells how Undo must put path back: sudoers files and
+// drop-ins are validated first.
+func (m *Manager) journalKind(path string) string {
+	switch {
+	case path == m.SudoersPath():
+		return "sudoers"
+	case filepath.Dir(path) == m.DropInDir():
+		return "drop-in"
+	}
+	return "file"
+}
+
+// pruneJournal removes all but the newest JournalDepth entries.
+func (m *Manager) pruneJournal() {
+	depth := m.JournalDepth
+	if depth <= 0 {
+		depth = DefaultJournalDepth
+	}
+	names, err := m.journalNames()
+	if err != nil {
+		return
+	}
+	for len(names) > depth {
+		m.fsys().Remove(filepath.Join(m.JournalDir, names[len(names)-1]))
+		names = names[:len(names)-1]
+	}
+}
+
+// journalNames lists the journal's entry files, newest first.
+func (m *Manager) journalNames() ([]string, error) {
+	ents, err := m.fsys().ReadDir(m.JournalDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range ents {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// Journal returns the journal's entries, newest first.
+func (m *Manager) Journal() ([]JournalEntry, error) {
+	if m.JournalDir == "" {
+		return nil, nil
+	}
+	names, err := m.journalNames()
+	if err != nil {
+		return nil, err
+	}
+	var out []JournalEntry
+	for _, name := range names {
+		e, err := m.readJournalEntry(name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func (m *Manager) readJournalEntry(name string) (JournalEntry, error) {
+	var e JournalEntry
+	data, err := m.readFileRetry(filepath.Join(m.JournalDir, name))
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, invalid(fmt.Errorf("journal entry %s: %w", name, err))
+	}
+	return e, nil
+}
+
+// Undo puts back the files changed by the newest journal entry, sudoers
+// files and drop-ins only if they still validate, then removes the entry.
+// It returns the entry undone; an empty journal is ErrNotFound. With
+// DryRun it previews the changes and keeps the entry.
+func (m *Manager) Undo() (*JournalEntry, error) {
+	if m.JournalDir == "" {
+		return nil, errors.New("no undo journal is configured")
+	}
+	names, err := m.journalNames()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, notFound(errors.New("nothing to undo: the journal is empty"))
+	}
+	e, err := m.readJournalEntry(names[0])
+	if err != nil {
+		return nil, err
+	}
+	m.journalMu.Lock()
+	m.undoing = true
+	m.journalMu.Unlock()
+	defer func() {
+		m.journalMu.Lock()
+		m.undoing = false
+		m.journalMu.Unlock()
+	}()
+	for i := len(e.Files) - 1; i >= 0; i-- {
+		if err := m.undoFile(e.Files[i]); err != nil {
+			return &e, fmt.Errorf("undo %s: %w", e.Files[i].Path, err)
+		}
+	}
+	if m.DryRun {
+		return &e, nil
+	}
+	return &e, m.fsys().Remove(filepath.Join(m.JournalDir, names[0]))
+}
+
+// undoFile puts f back as it was.
+func (m *Manager) undoFile(f JournalFile) (err error) {
+	if f.Kind == "sudoers" && f.Existed {
+		return m.restoreSudoers(f.Content, f.Path)
+	}
+	unlock, err := m.lockFile(f.Path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	switch {
+	case f.Kind != "file":
+		defer m.audit("undo", f.Path, "")(&err)
+		if !f.Existed {
+			return m.removeDropIn(f.Path)
+		}
+		return m.installDropIn(f.Path, string(f.Content))
+	case !f.Existed:
+		if m.DryRun {
+			return m.previewWrite(f.Path, "")
+		}
+		err := m.fsys().Remove(f.Path)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return err
+	}
+	return m.commitFile(f.Path, string(f.Content))
+}
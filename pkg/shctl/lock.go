@@ -0,0 +1,106 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// ----------------- File locking -----------------
+//
+// Read-modify-write sequences on the rc and sudoers files hold an advisory
+// lock (flock, or on Windows a file opened for exclusive use; see tryLock)
+// so concurrent invocations don't lose each other's changes. The files
+// themselves are replaced by rename, so the lock is taken on a separate
+// lock file that outlives the inode it protects. Other programs
+// editing the same file don't take this lock.
+//
+// Lock files are never removed: deleting one while another run waits on
+// it would let the two lock different inodes. They are empty, and the
+// ones in the runtime dir go away with it at logout.
+
+// defaultLockTimeout applies when Manager.LockTimeout is zero.
+const defaultLockTimeout = 10 * time.Second
+
+// lockPath is the lock file for path: a dot file next to it (which sudo's
+// #includedir ignores). When that directory isn't writable the lock goes
+// in userLockDir instead.
+func lockPath(path string) string {
+	name := filepath.Base(path) + ".lock"
+	if !strings.HasPrefix(name, ".") {
+		name = "." + name
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// errLockBusy is tryLock's answer when another process holds the lock.
+var errLockBusy = errors.New("lock is held by another process")
+
+// lockFile takes an exclusive lock for path, polling until LockTimeout,
+// and returns the function that releases it. The lock goes away with the
+// process if it dies. A dry run writes nothing, so it takes no lock, and
+// neither does a custom FS, which no other process can see.
+func (m *Manager) lockFile(path string) (unlock func(), err error) {
+	if _, real := m.fsys().(OSFS); m.DryRun || !real {
+		return func() {}, nil
+	}
+	timeout := m.LockTimeout
+	if timeout == 0 {
+		timeout = defaultLockTimeout
+	}
+	lp := lockPath(path)
+	unlock, err = tryLock(lp, 0o644)
+	if err != nil && !errors.Is(err, errLockBusy) {
+		dir, derr := userLockDir()
+		if derr != nil {
+			return nil, fmt.Errorf("lock %s: %w", path, derr)
+		}
+		abs, _ := filepath.Abs(path)
+		lp = filepath.Join(dir, strings.NewReplacer("/", "_", `\`, "_", ":", "_").Replace(abs)+".lock")
+		unlock, err = tryLock(lp, 0o600)
+	}
+	deadline := time.Now().Add(timeout)
+	for errors.Is(err, errLockBusy) {
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another cli-tool run (waited %s on %s)", path, timeout, lp)
+		}
+		time.Sleep(50 * time.Millisecond)
+		unlock, err = tryLock(lp, 0o644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", lp, err)
+	}
+	return unlock, nil
+}
+
+// userLockDir returns the directory for locks that can't go next to their
+// file: $XDG_RUNTIME_DIR/cli-tool, or cli-tool-<uid> in the temp dir. It
+// is created 0700 and refused unless it is a directory of ours that no one
+// else can enter, so another user can neither plant nor hold our locks.
+func userLockDir() (string, error) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("cli-tool-%d", os.Getuid()))
+	if rt := os.Getenv("XDG_RUNTIME_DIR"); rt != "" {
+		dir = filepath.Join(rt, "cli-tool")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	uid, _, owned := fileOwner(fi)
+	switch {
+	case !fi.IsDir():
+		return "", fmt.Errorf("%s is not a directory", dir)
+	case owned && uid != os.Getuid():
+		return "", fmt.Errorf("%s belongs to uid %d", dir, uid)
+	case fi.Mode().Perm()&0o077 != 0 && runtime.GOOS != "windows":
+		return "", fmt.Errorf("%s is open to other users (mode %v)", dir, fi.Mode().Perm())
+	}
+	return dir, nil
+}
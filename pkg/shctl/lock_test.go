@@ -0,0 +1,72 @@
+package shctl
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestUserLockDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix permissions")
+	}
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, dir string)
+		wantErr bool
+	}{
+		{"created private", func(*testing.T, string) {}, false},
+		{"existing private", func(t *testing.T, dir string) {
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"open to others", func(t *testing.T, dir string) {
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, 0o777); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"symlink", func(t *testing.T, dir string) {
+			if err := os.Symlink(t.TempDir(), dir); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+		{"plain file", func(t *testing.T, dir string) {
+			if err := os.WriteFile(dir, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := t.TempDir()
+			t.Setenv("XDG_RUNTIME_DIR", rt)
+			want := filepath.Join(rt, "cli-tool")
+			tt.setup(t, want)
+			dir, err := userLockDir()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("userLockDir = %s, want an error", dir)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dir != want {
+				t.Errorf("userLockDir = %s, want %s", dir, want)
+			}
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != 0o700 {
+				t.Errorf("mode = %v, want 0700", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package shctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ----------------- Manifest -----------------
+//
+// A manifest describes the aliases, exports and sudoers entries wanted, in
+// the config file's TOML subset:
+//
+//	[aliases]
+//	ll = "ls -la"
+//
+//	[exports]
+//	EDITOR = "vim"
+//
+//	[sudoers]
+//	file = "provision"   # a drop-in; omit for the sudoers file itself
+//	entries = [
+//	  "deploy ALL=(root) /usr/bin/systemctl restart app",
+//	]
+//
+// ApplyManifest converges the files to it, so applying the same manifest
+// twice changes nothing the second time.
+
+// Manifest is the desired state read by LoadManifest.
+type Manifest struct {
+	Aliases map[string]string
+	Exports map[string]string
+	// SudoersFile names the drop-in Sudoers go to; empty means the
+	// sudoers file.
+	SudoersFile string
+	Sudoers     []string
+}
+
+// ManifestChange is one change ApplyManifest made.
+type ManifestChange struct {
+	Op   string `json:"op"`   // "added", "updated" or "removed"
+	Kind string `json:"kind"` // "alias", "export" or "sudoers"
+	Name string `json:"name"` // for sudoers, the entry
+}
+
+var exportNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadManifest reads and parses the manifest at path.
+func (m *Manager) LoadManifest(path string) (Manifest, error) {
+	f, err := m.openRetry(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer f.Close()
+	man, err := ParseManifest(f)
+	if err != nil {
+		return Manifest{}, invalid(fmt.Errorf("%s: %w", path, err))
+	}
+	return man, nil
+}
+
+// ParseManifest parses manifest content. Unknown sections and keys, names
+// given twice and invalid names or sudoers entries are errors.
+func ParseManifest(r io.Reader) (Manifest, error) {
+	man := Manifest{Aliases: map[string]string{}, Exports: map[string]string{}}
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section != "aliases" && section != "exports" && section != "sudoers" {
+				return man, fmt.Errorf("line %d: unknown section [%s] (want aliases, exports or sudoers)", n, section)
+			}
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key, raw = strings.TrimSpace(key), strings.TrimSpace(raw)
+		if !ok || key == "" {
+			return man, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if section == "sudoers" && key == "entries" {
+			// the array may span lines up to its closing bracket
+			start := n
+			for !arrayClosed(raw) && sc.Scan() {
+				n++
+				raw += "\n" + sc.Text()
+			}
+			entries, err := parseStringArray(raw)
+			if err != nil {
+				return man, fmt.Errorf("line %d: %w", start, err)
+			}
+			for _, e := range entries {
+				if err := CheckSudoersEntry(e); err != nil {
+					return man, fmt.Errorf("line %d: %w", start, err)
+				}
+			}
+			man.Sudoers = append(man.Sudoers, entries...)
+			continue
+		}
+		value, err := parseConfigValue(raw)
+		if err != nil {
+			return man, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch section {
+		case "aliases":
+			if err := ValidateAliasName(key); err != nil {
+				return man, fmt.Errorf("line %d: %w", n, err)
+			}
+			if _, dup := man.Aliases[key]; dup {
+				return man, fmt.Errorf("line %d: alias %s is given twice", n, key)
+			}
+			man.Aliases[key] = value
+		case "exports":
+			if !exportNameRe.MatchString(key) {
+				return man, fmt.Errorf("line %d: invalid variable name %q", n, key)
+			}
+			if _, dup := man.Exports[key]; dup {
+				return man, fmt.Errorf("line %d: export %s is given twice", n, key)
+			}
+			man.Exports[key] = value
+		case "sudoers":
+			if key != "file" {
+				return man, fmt.Errorf("line %d: unknown key %q in [sudoers] (want file or entries)", n, key)
+			}
+			man.SudoersFile = value
+		default:
+			return man, fmt.Errorf("line %d: %s is outside [aliases], [exports] or [sudoers]", n, key)
+		}
+	}
+	return man, sc.Err()
+}
+
+// arrayClosed reports whether raw, the start of an array value, includes
+// its closing bracket outside of any string.
+func arrayClosed(raw string) bool {
+	_, err := parseStringArray(raw)
+	return err == nil || !errors.Is(err, errUnclosedArray)
+}
+
+var errUnclosedArray = errors.New("unclosed array")
+
+// parseStringArray parses `["a", 'b', ...]`, which may span lines and
+// hold comments; a trailing comma is allowed.
+func parseStringArray(raw string) ([]string, error) {
+	if !strings.HasPrefix(raw, "[") {
+		return nil, errors.New("expected an array of strings: [\"...\", ...]")
+	}
+	rest := raw[1:]
+	var out []string
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n,")
+		switch {
+		case rest == "":
+			return nil, errUnclosedArray
+		case strings.HasPrefix(rest, "#"):
+			_, rest, _ = strings.Cut(rest, "\n")
+			if rest == "" {
+				return nil, errUnclosedArray
+			}
+			continue
+		case strings.HasPrefix(rest, "]"):
+			if t := strings.TrimSpace(rest[1:]); t != "" && !strings.HasPrefix(t, "#") {
+				return nil, fmt.Errorf("unexpected %q after the array", t)
+			}
+			return out, nil
+		case rest[0] != '"' && rest[0] != '\'':
+			return nil, fmt.Errorf("array items must be strings, not %q", strings.Fields(rest)[0])
+		}
+		v, r, err := cutConfigString(rest)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+		rest = r
+	}
+}
+
+// ApplyManifest makes the managed block define each alias and export of
+// man exactly once, with its value, and puts each sudoers entry in its
+// file exactly once. With prune, managed aliases and exports the manifest
+// doesn't list are removed, as are the rules of the drop-in it doesn't
+// list; the sudoers file itself only ever gains entries and loses
+// duplicates. Sudoers changes are validated before anything is written.
+func (m *Manager) ApplyManifest(man Manifest, prune bool) ([]ManifestChange, error) {
+	var changes []ManifestChange
+	if len(man.Sudoers) > 0 || prune && man.SudoersFile != "" {
+		ch, err := m.applySudoers(man, prune)
+		changes = append(changes, ch...)
+		if err != nil {
+			return changes, err
+		}
+	}
+	for _, k := range []struct {
+		kind   string
+		wanted map[string]string
+		set    func(name, value string) error
+		remove func(name string) error
+	}{
+		{"alias", man.Aliases,
+			func(name, value string) error { _, err := m.AddAlias(name, value); return err },
+			m.RemoveAlias},
+		{"export", man.Exports,
+			func(name, value string) error { _, err := m.AddExport(name, value, ExportOptions{}); return err },
+			m.RemoveExport},
+	} {
+		cur, err := m.Entries(k.kind, nil)
+		if err != nil {
+			return changes, err
+		}
+		defs := map[string][]string{}
+		for _, e := range cur {
+			defs[e.Name] = append(defs[e.Name], e.Value)
+		}
+		var names []string
+		for name := range k.wanted {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			value := k.wanted[name]
+			d := defs[name]
+			if len(d) == 1 && d[0] == value {
+				continue
+			}
+			if err := k.set(name, value); err != nil {
+				return changes, err
+			}
+			op := "updated"
+			if len(d) == 0 {
+				op = "added"
+			}
+			changes = append(changes, ManifestChange{Op: op, Kind: k.kind, Name: name})
+		}
+		if !prune {
+			continue
+		}
+		names = names[:0]
+		for name := range defs {
+			if _, ok := k.wanted[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := k.remove(name); err != nil {
+				return changes, err
+			}
+			changes = append(changes, ManifestChange{Op: "removed", Kind: k.kind, Name: name})
+		}
+	}
+	return changes, nil
+}
+
+// applySudoers rewrites the sudoers file or drop-in of man in one
+// validated write: duplicates of the wanted entries are dropped, missing
+// ones appended and, in a drop-in with prune, other rules removed.
+func (m *Manager) applySudoers(man Manifest, prune bool) (changes []ManifestChange, err error) {
+	path := m.SudoersPath()
+	dropIn := man.SudoersFile != ""
+	if dropIn {
+		if path, err = m.DropInPath(man.SudoersFile); err != nil {
+			return nil, err
+		}
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	cur, err := m.readFileRetry(path)
+	if dropIn && errors.Is(err, fs.ErrNotExist) {
+		cur, err = []byte(DropInMarker+"\n"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, e := range man.Sudoers {
+		wanted[strings.TrimSpace(e)] = true
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, ln := range splitLines(string(cur)) {
+		t := strings.TrimSpace(ln)
+		switch {
+		case wanted[t] && seen[t]:
+			changes = append(changes, ManifestChange{Op: "removed", Kind: "sudoers", Name: t})
+			continue
+		case wanted[t]:
+			seen[t] = true
+		case dropIn && prune && hasSudoersRules([]string{t}):
+			changes = append(changes, ManifestChange{Op: "removed", Kind: "sudoers", Name: t})
+			continue
+		}
+		out = append(out, ln)
+	}
+	for _, e := range man.Sudoers {
+		if t := strings.TrimSpace(e); !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+			changes = append(changes, ManifestChange{Op: "added", Kind: "sudoers", Name: t})
+		}
+	}
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	defer m.audit("apply --file", path, "")(&err)
+	if dropIn {
+		if !hasSudoersRules(out) {
+			return changes, m.removeDropIn(path)
+		}
+		return changes, m.installDropIn(path, joinLines(out))
+	}
+	tmp, err := m.tempFileNear(path)
+	if err != nil {
+		return nil, err
+	}
+	defer m.removeTemp(tmp.Name())
+	_, err = io.WriteString(tmp, joinLines(out))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := m.visudoValidate(tmp.Name()); err != nil {
+		return nil, fmt.Errorf("visudo validation failed: %w", err)
+	}
+	if err := m.backupBeforeChange(path); err != nil {
+		return nil, err
+	}
+	return changes, m.commitCopy(tmp.Name(), path)
+}
@@ -0,0 +1,308 @@
+package shctl
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemFS is an in-memory FS. Directories exist implicitly above every file
+// and explicitly once created with MkdirAll. Ownership is not tracked. The
+// zero value is an empty filesystem ready to use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	seq   int
+}
+
+type memNode struct {
+	data  []byte
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (m *MemFS) init() {
+	if m.files == nil {
+		m.files = map[string]*memNode{}
+		m.dirs = map[string]bool{}
+	}
+}
+
+func memErr(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// isDir reports whether name is a directory; m.mu must be held.
+func (m *MemFS) isDir(name string) bool {
+	if name == "/" || name == "." || m.dirs[name] {
+		return true
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range m.files {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	name = filepath.Clean(name)
+	n, ok := m.files[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memErr("open", name, fs.ErrNotExist)
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memErr("open", name, fs.ErrExist)
+	case !ok:
+		if m.isDir(name) {
+			return nil, memErr("open", name, syscall.EISDIR)
+		}
+		n = &memNode{mode: perm, mtime: time.Now()}
+		m.files[name] = n
+	}
+	if flag&os.O_TRUNC != 0 {
+		n.data = nil
+	}
+	return &memFile{fs: m, name: name, node: n, flag: flag}, nil
+}
+
+func (m *MemFS) CreateTemp(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	for {
+		m.mu.Lock()
+		m.seq++
+		seq := strconv.Itoa(m.seq)
+		m.mu.Unlock()
+		name := pattern + seq
+		if i := strings.LastIndex(pattern, "*"); i >= 0 {
+			name = pattern[:i] + seq + pattern[i+1:]
+		}
+		f, err := m.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	n, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, memErr("open", name, fs.ErrNotExist)
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := m.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	name = filepath.Clean(name)
+	if !m.isDir(name) {
+		return nil, memErr("open", name, fs.ErrNotExist)
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	seen := map[string]bool{}
+	var out []fs.DirEntry
+	add := func(p string, file *memNode) {
+		child, _, nested := strings.Cut(strings.TrimPrefix(p, prefix), "/")
+		if seen[child] {
+			return
+		}
+		seen[child] = true
+		if nested || file == nil {
+			out = append(out, fs.FileInfoToDirEntry(memInfo{name: child, mode: fs.ModeDir | 0o755}))
+		} else {
+			out = append(out, fs.FileInfoToDirEntry(file.info(p)))
+		}
+	}
+	for p, n := range m.files {
+		if strings.HasPrefix(p, prefix) {
+			add(p, n)
+		}
+	}
+	for p := range m.dirs {
+		if strings.HasPrefix(p, prefix) {
+			add(p, nil)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	name = filepath.Clean(name)
+	if n, ok := m.files[name]; ok {
+		return n.info(name), nil
+	}
+	if m.isDir(name) {
+		return memInfo{name: filepath.Base(name), mode: fs.ModeDir | 0o755}, nil
+	}
+	return nil, memErr("stat", name, fs.ErrNotExist)
+}
+
+// Lstat is Stat: MemFS has no symlinks.
+func (m *MemFS) Lstat(name string) (fs.FileInfo, error) { return m.Stat(name) }
+
+// Readlink always fails, as no MemFS file is a symlink.
+func (m *MemFS) Readlink(name string) (string, error) {
+	return "", memErr("readlink", name, syscall.EINVAL)
+}
+
+func (m *MemFS) MkdirAll(path string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	for p := filepath.Clean(path); p != "/" && p != "."; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return memErr("mkdir", p, syscall.ENOTDIR)
+		}
+		m.dirs[p] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	n, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if m.dirs[name] {
+		delete(m.dirs, name)
+		return nil
+	}
+	return memErr("remove", name, fs.ErrNotExist)
+}
+
+func (m *MemFS) Chmod(name string, mode fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.init()
+	n, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return memErr("chmod", name, fs.ErrNotExist)
+	}
+	n.mode = mode.Perm()
+	return nil
+}
+
+// Lchown only checks that name exists.
+func (m *MemFS) Lchown(name string, uid, gid int) error {
+	_, err := m.Stat(name)
+	return err
+}
+
+func (n *memNode) info(name string) fs.FileInfo {
+	return memInfo{name: filepath.Base(name), size: int64(len(n.data)), mode: n.mode, mtime: n.mtime}
+}
+
+type memInfo struct {
+	name  string
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.mtime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
+
+// memFile reads and writes its node directly, so data is visible to other
+// readers as soon as it is written.
+type memFile struct {
+	fs   *MemFS
+	name string
+	node *memNode
+	flag int
+	off  int
+}
+
+func (f *memFile) Name() string { return f.name }
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.off >= len(f.node.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.off:])
+	f.off += n
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, memErr("write", f.name, fs.ErrPermission)
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.off = len(f.node.data)
+	}
+	if end := f.off + len(p); end > len(f.node.data) {
+		f.node.data = append(f.node.data, make([]byte, end-len(f.node.data))...)
+	}
+	copy(f.node.data[f.off:], p)
+	f.off += len(p)
+	f.node.mtime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Close() error { return nil }
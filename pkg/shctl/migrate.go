@@ -0,0 +1,229 @@
+package shctl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ----------------- Migration -----------------
+//
+// Migrate translates the aliases and exports of another shell's rc file
+// into the target shell's syntax. Anything that can't be translated
+// faithfully (command substitution, parameter expansion, shell-only
+// keywords) is reported and left out rather than written broken.
+
+// MigrateProblem is a definition Migrate left out.
+type MigrateProblem struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+// MigrateResult reports what Migrate did.
+type MigrateResult struct {
+	Written  int
+	Problems []MigrateProblem
+}
+
+// Migrate reads every alias and export in src, a from-shell ("bash", "zsh"
+// or "fish") rc file, and writes them to the managed block of m.RCFile in
+// the syntax of m.Shell. An alias or export already in the block is
+// replaced; exports that build on themselves, such as PATH additions, are
+// appended unless the same line is already there.
+func (m *Manager) Migrate(from, src string) (MigrateResult, error) {
+	var res MigrateResult
+	to := m.shell()
+	if (from == "fish") == (to == "fish") {
+		return res, invalid(fmt.Errorf("nothing to translate from %s to %s", from, to))
+	}
+	data, err := m.readFileDecompressed(src)
+	if err != nil {
+		return res, err
+	}
+	type translated struct {
+		e    Entry
+		line string
+	}
+	var out []translated
+	for i, ln := range splitLines(string(data)) {
+		e, ok := m.ParseEntry(ln)
+		if !ok {
+			continue
+		}
+		var line, problem string
+		if to == "fish" {
+			line, problem = entryToFish(e)
+		} else {
+			line, problem = entryToPOSIX(e)
+		}
+		if problem != "" {
+			res.Problems = append(res.Problems, MigrateProblem{Line: i + 1, Text: strings.TrimSpace(ln), Reason: problem})
+			continue
+		}
+		out = append(out, translated{e, line})
+	}
+	if len(out) == 0 {
+		return res, nil
+	}
+
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return res, err
+	}
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		for _, t := range out {
+			if t.e.Kind == "export" && referencesItself(t.e) {
+				if !containsString(block, t.line) {
+					block = append(block, t.line)
+				}
+			} else {
+				block = append(dropLines(block, m.entryMatcher(t.e.Kind, t.e.Name)), t.line)
+			}
+		}
+		return block, nil
+	})
+	if err != nil {
+		return res, err
+	}
+	res.Written = len(out)
+	return res, nil
+}
+
+// referencesItself reports whether export e uses its own previous value,
+// as PATH="$PATH:/opt/bin" and set -gx PATH $PATH /opt/bin do.
+func referencesItself(e Entry) bool {
+	for _, ref := range varRefRe.FindAllStringSubmatch(e.Value, -1) {
+		if ref[1] == e.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// isPathVar reports whether name is a colon-separated list in POSIX shells
+// and a list in fish, which treats every variable ending in PATH so.
+func isPathVar(name string) bool {
+	return strings.HasSuffix(name, "PATH")
+}
+
+var (
+	// bracedVarRe finds ${NAME} that only delimits the name.
+	bracedVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+	// posixOnly are constructs fish has no equivalent for, with why.
+	posixOnly = []struct{ text, reason string }{
+		{"`", "uses backtick command substitution"},
+		{"$(", "uses command substitution"},
+		{"${", "uses parameter expansion"},
+		{"$((", "uses arithmetic expansion"},
+		{"[[", "uses [[ ]] tests"},
+		{"<<<", "uses a here-string"},
+		{"!!", "uses history expansion"},
+	}
+
+	// fishOnly are constructs POSIX shells have no equivalent for.
+	fishOnly = []struct{ text, reason string }{
+		{"(", "may use fish command substitution"},
+		{"; and ", "uses fish's and"},
+		{"; or ", "uses fish's or"},
+		{"$status", "uses fish's $status"},
+		{"$argv", "uses fish's $argv"},
+	}
+)
+
+// entryToFish renders a POSIX shell entry in fish syntax, or says why it
+// can't.
+func entryToFish(e Entry) (line, problem string) {
+	v := e.Value
+	_, rawValue, _ := strings.Cut(e.Raw, "=")
+	rawValue = strings.TrimSpace(rawValue)
+	if e.Kind == "export" && strings.HasPrefix(rawValue, "'") && strings.HasSuffix(rawValue, "'") {
+		// single-quoted: nothing in it was expanded, so nothing needs translating
+		return "set -gx " + e.Name + " " + FishQuote(v), ""
+	}
+	if e.Kind == "export" {
+		v = unbraceVars(v)
+		// an unquoted leading ~ was expanded by the shell; fish quoting wouldn't
+		if v == "~" || strings.HasPrefix(v, "~/") {
+			if strings.HasPrefix(rawValue, "~") {
+				v = "$HOME" + v[1:]
+			}
+		}
+	}
+	for _, c := range posixOnly {
+		if strings.Contains(v, c.text) {
+			return "", c.reason
+		}
+	}
+	if e.Kind == "alias" {
+		return "alias " + e.Name + " " + FishQuote(v), ""
+	}
+	words := []string{v}
+	if isPathVar(e.Name) {
+		words = nil
+		for _, w := range strings.Split(v, ":") {
+			if w != "" {
+				words = append(words, w)
+			}
+		}
+	}
+	for i, w := range words {
+		if !isVarRef(w) {
+			words[i] = FishQuoteExportValue(w)
+		}
+	}
+	return "set -gx " + e.Name + " " + strings.Join(words, " "), ""
+}
+
+// entryToPOSIX renders a fish entry in POSIX shell syntax, or says why it
+// can't.
+func entryToPOSIX(e Entry) (line, problem string) {
+	for _, c := range fishOnly {
+		if strings.Contains(e.Value, c.text) {
+			return "", c.reason
+		}
+	}
+	if e.Kind == "alias" {
+		return "alias " + e.Name + "=" + ShellQuote(e.Value), ""
+	}
+	words := []string{e.Value}
+	expands := true
+	if t := strings.TrimSpace(e.Raw); strings.HasPrefix(t, "set ") {
+		if _, rest, ok := strings.Cut(t, " "+e.Name+" "); ok {
+			words = fishWords(rest)
+			// a $ only inside single quotes was never expanded by fish
+			expands = strings.Contains(singleQuotedRe.ReplaceAllString(rest, ""), "$")
+		}
+	}
+	sep := " "
+	if isPathVar(e.Name) {
+		sep = ":"
+	}
+	v := strings.Join(words, sep)
+	if !expands {
+		return "export " + e.Name + "=" + ShellQuote(v), ""
+	}
+	return "export " + e.Name + "=" + QuoteExportValue(v), ""
+}
+
+// unbraceVars rewrites ${NAME} as $NAME where no name character follows,
+// which fish reads the same way. Others are left for entryToFish to report.
+func unbraceVars(v string) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range bracedVarRe.FindAllStringSubmatchIndex(v, -1) {
+		if loc[1] < len(v) && isNameByte(v[loc[1]]) {
+			continue
+		}
+		b.WriteString(v[last:loc[0]])
+		b.WriteString("$" + v[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	b.WriteString(v[last:])
+	return b.String()
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package shctl
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// SudoersSupported reports whether the sudoers operations can work on this
+// platform.
+const SudoersSupported = true
+
+// tryLock makes one attempt at an exclusive flock on the lock file lp,
+// creating it with perm. errLockBusy means another process holds it. The
+// kernel releases the lock if the process dies.
+func tryLock(lp string, perm fs.FileMode) (unlock func(), err error) {
+	f, err := os.OpenFile(lp, os.O_RDWR|os.O_CREATE, perm)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) || errors.Is(err, syscall.EINTR) {
+		f.Close()
+		return nil, errLockBusy
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// fileOwner returns the owner and group of the file fi describes.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+package shctl
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// SudoersSupported reports whether the sudoers operations can work on this
+// platform. Windows has no sudo; aliases, exports and backups of the rc
+// file (e.g. Git Bash's ~/.bashrc) still work.
+const SudoersSupported = false
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION, which the syscall
+// package doesn't define.
+const errorSharingViolation syscall.Errno = 32
+
+// tryLock makes one attempt at opening the lock file lp for exclusive use,
+// creating it if needed; no other process can open it until unlock.
+// errLockBusy means another process holds it. Windows closes the handle,
+// and so releases the lock, if the process dies.
+func tryLock(lp string, perm fs.FileMode) (unlock func(), err error) {
+	name, err := syscall.UTF16PtrFromString(lp)
+	if err != nil {
+		return nil, err
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil,
+		syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, errLockBusy
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: lp, Err: err}
+	}
+	return func() { syscall.CloseHandle(h) }, nil
+}
+
+// fileOwner reports no owner: Windows files have no uid and gid.
+func fileOwner(fi fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
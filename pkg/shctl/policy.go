@@ -0,0 +1,371 @@
+package shctl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path/filepath"
+	"strings"
+)
+
+// ----------------- Sudoers policy evaluation -----------------
+//
+// This is a best-effort reader of the sudoers grammar, good enough to answer
+// "would this user be allowed to run this command" for simple rules during an
+// audit. It understands:
+//
+//   - #include, @include, #includedir and @includedir
+//   - User_Alias, Runas_Alias, Host_Alias and Cmnd_Alias definitions
+//   - user specs of the form "users hosts = [(runas)] [TAGS:] cmnd, ..."
+//   - "!" negation in user, host and command lists (last match wins)
+//   - %group, #uid and ALL in user lists; directories and glob patterns
+//     in command paths
+//
+// It does NOT understand Defaults, digests, regular expressions, sudoedit,
+// netgroups, multiple ":"-separated host specs on one line, or runas
+// restrictions. Its answer is a hint, not a substitute for `sudo -l -U`.
+
+const maxIncludeDepth = 8
+
+var aliasKinds = map[string]string{
+	"User_Alias":  "User",
+	"Runas_Alias": "Runas",
+	"Host_Alias":  "Host",
+	"Cmnd_Alias":  "Cmnd",
+	"Cmd_Alias":   "Cmnd",
+}
+
+// SudoersLine is a logical sudoers line and where it came from.
+type SudoersLine struct {
+	File string
+	Num  int
+	Text string
+}
+
+func (l SudoersLine) String() string {
+	return fmt.Sprintf("%s:%d: %s", l.File, l.Num, l.Text)
+}
+
+// SudoersRule is a parsed user spec.
+type SudoersRule struct {
+	Users  []string
+	Hosts  []string
+	Cmnds  []string
+	Source SudoersLine
+}
+
+// SudoersPolicy is the parsed content of a sudoers file and its includes.
+type SudoersPolicy struct {
+	aliases map[string]map[string][]string // kind -> alias name -> members
+	rules   []SudoersRule
+}
+
+// readSudoersLines returns the logical (continuation-joined, non-comment)
+// lines of path and every file it includes, in evaluation order.
+func (m *Manager) readSudoersLines(path string, depth int) ([]SudoersLine, error) {
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes nested too deeply", path)
+	}
+	f, err := m.openRetry(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []SudoersLine
+	var buf strings.Builder
+	start := 0
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if buf.Len() == 0 {
+			start = n
+		}
+		if strings.HasSuffix(line, "\\") {
+			buf.WriteString(strings.TrimSuffix(line, "\\"))
+			buf.WriteString(" ")
+			continue
+		}
+		buf.WriteString(line)
+		text := strings.TrimSpace(buf.String())
+		buf.Reset()
+
+		if dir, ok := includeDirective(text); ok {
+			inc, err := m.readInclude(path, dir, depth)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, inc...)
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		out = append(out, SudoersLine{File: path, Num: start, Text: text})
+	}
+	return out, sc.Err()
+}
+
+// includeDirective recognizes the include family of directives and returns
+// the directive with its argument, e.g. "includedir /etc/sudoers.d".
+func includeDirective(text string) (string, bool) {
+	for _, p := range []string{"#includedir ", "@includedir ", "#include ", "@include "} {
+		if strings.HasPrefix(text, p) {
+			return p[1:] + strings.TrimSpace(text[len(p):]), true
+		}
+	}
+	return "", false
+}
+
+func (m *Manager) readInclude(from, directive string, depth int) ([]SudoersLine, error) {
+	files, err := m.includedFiles(from, directive)
+	if err != nil {
+		return nil, err
+	}
+	var out []SudoersLine
+	for _, f := range files {
+		lines, err := m.readSudoersLines(f, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, lines...)
+	}
+	return out, nil
+}
+
+// includedFiles returns the files an include directive of the file from
+// names, in the order sudo reads them: the file of an include, or the
+// files of an includedir (none when it doesn't exist).
+func (m *Manager) includedFiles(from, directive string) ([]string, error) {
+	isDir := strings.HasPrefix(directive, "includedir ")
+	target := strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(directive, "includedir "), "include "))
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(from), target)
+	}
+	if !isDir {
+		return []string{target}, nil
+	}
+	entries, err := m.fsys().ReadDir(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		// sudo skips names ending in '~' or containing a '.'
+		name := e.Name()
+		if e.IsDir() || strings.HasSuffix(name, "~") || strings.Contains(name, ".") {
+			continue
+		}
+		out = append(out, filepath.Join(target, name))
+	}
+	return out, nil
+}
+
+// SudoersPolicy reads the sudoers file, following its includes.
+func (m *Manager) SudoersPolicy() (*SudoersPolicy, error) {
+	if !SudoersSupported {
+		return nil, ErrSudoersUnsupported
+	}
+	lines, err := m.readSudoersLines(m.SudoersPath(), 0)
+	if err != nil {
+		return nil, err
+	}
+	p := &SudoersPolicy{aliases: map[string]map[string][]string{}}
+	for _, l := range lines {
+		fields := strings.Fields(l.Text)
+		if kind, ok := aliasKinds[fields[0]]; ok {
+			p.addAliases(kind, strings.TrimSpace(strings.TrimPrefix(l.Text, fields[0])))
+			continue
+		}
+		if strings.HasPrefix(fields[0], "Defaults") {
+			continue
+		}
+		if r, ok := parseUserSpec(l); ok {
+			p.rules = append(p.rules, r)
+		}
+	}
+	return p, nil
+}
+
+// addAliases parses "NAME = a, b : OTHER = c" for the given alias kind.
+func (p *SudoersPolicy) addAliases(kind, defs string) {
+	if p.aliases[kind] == nil {
+		p.aliases[kind] = map[string][]string{}
+	}
+	for _, def := range strings.Split(defs, ":") {
+		name, members, ok := strings.Cut(def, "=")
+		if !ok {
+			continue
+		}
+		p.aliases[kind][strings.TrimSpace(name)] = splitList(members)
+	}
+}
+
+// parseUserSpec parses "users hosts = [(runas)] [TAGS:] cmnd, cmnd".
+func parseUserSpec(l SudoersLine) (SudoersRule, bool) {
+	left, right, ok := strings.Cut(l.Text, "=")
+	if !ok {
+		return SudoersRule{}, false
+	}
+	// "alice, bob host" -> "alice,bob host"
+	left = strings.Join(strings.Fields(strings.ReplaceAll(left, ", ", ",")), " ")
+	who := strings.Fields(left)
+	if len(who) != 2 {
+		return SudoersRule{}, false
+	}
+	var cmnds []string
+	for _, c := range splitList(right) {
+		c = stripRunasAndTags(c)
+		if c != "" {
+			cmnds = append(cmnds, c)
+		}
+	}
+	return SudoersRule{
+		Users:  splitList(who[0]),
+		Hosts:  splitList(who[1]),
+		Cmnds:  cmnds,
+		Source: l,
+	}, true
+}
+
+func stripRunasAndTags(c string) string {
+	c = strings.TrimSpace(c)
+	if strings.HasPrefix(c, "(") {
+		if i := strings.Index(c, ")"); i >= 0 {
+			c = strings.TrimSpace(c[i+1:])
+		}
+	}
+	for {
+		tag, rest, ok := strings.Cut(c, ":")
+		if !ok || tag == "" || strings.ToUpper(tag) != tag || strings.ContainsAny(tag, " /") {
+			return c
+		}
+		c = strings.TrimSpace(rest)
+	}
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// matchList evaluates a sudoers list the way sudo does: items are checked in
+// order and the last matching item decides. negated reports whether that
+// item was prefixed with "!".
+func (p *SudoersPolicy) matchList(kind string, list []string, match func(string) bool, depth int) (matched, negated bool) {
+	if depth > maxIncludeDepth {
+		return false, false
+	}
+	for _, item := range list {
+		neg := false
+		for strings.HasPrefix(item, "!") {
+			neg = !neg
+			item = strings.TrimSpace(item[1:])
+		}
+		if members, ok := p.aliases[kind][item]; ok {
+			if m, n := p.matchList(kind, members, match, depth+1); m {
+				matched, negated = true, neg != n
+			}
+			continue
+		}
+		if match(item) {
+			matched, negated = true, neg
+		}
+	}
+	return matched, negated
+}
+
+// Evaluate returns whether username may run command on host, and the rule
+// that decided it (nil when no rule matched).
+func (p *SudoersPolicy) Evaluate(username, host, command string) (bool, *SudoersRule) {
+	groups := userGroups(username)
+	matchUser := func(item string) bool {
+		switch {
+		case item == "ALL" || item == username:
+			return true
+		case strings.HasPrefix(item, "%#"):
+			return groups["#"+item[2:]]
+		case strings.HasPrefix(item, "%"):
+			return groups[item[1:]]
+		case strings.HasPrefix(item, "#"):
+			u, err := user.Lookup(username)
+			return err == nil && u.Uid == item[1:]
+		}
+		return false
+	}
+	short, _, _ := strings.Cut(host, ".")
+	matchHost := func(item string) bool {
+		return item == "ALL" || item == host || item == short
+	}
+	matchCmnd := func(item string) bool { return commandMatches(item, command) }
+
+	allowed := false
+	var decided *SudoersRule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if m, n := p.matchList("User", r.Users, matchUser, 0); !m || n {
+			continue
+		}
+		if m, n := p.matchList("Host", r.Hosts, matchHost, 0); !m || n {
+			continue
+		}
+		if m, n := p.matchList("Cmnd", r.Cmnds, matchCmnd, 0); m {
+			allowed, decided = !n, r
+		}
+	}
+	return allowed, decided
+}
+
+// commandMatches matches a command line against a sudoers command spec.
+// A spec without arguments allows any arguments; `""` allows none.
+func commandMatches(spec, command string) bool {
+	if spec == "ALL" {
+		return true
+	}
+	specPath, specArgs, _ := strings.Cut(spec, " ")
+	cmdPath, cmdArgs, _ := strings.Cut(command, " ")
+	specArgs, cmdArgs = strings.TrimSpace(specArgs), strings.TrimSpace(cmdArgs)
+
+	if strings.HasSuffix(specPath, "/") {
+		if filepath.Dir(cmdPath)+"/" != specPath {
+			return false
+		}
+	} else if ok, _ := filepath.Match(specPath, cmdPath); !ok {
+		return false
+	}
+	switch specArgs {
+	case "":
+		return true
+	case `""`:
+		return cmdArgs == ""
+	}
+	ok, _ := filepath.Match(specArgs, cmdArgs)
+	return ok || specArgs == cmdArgs
+}
+
+// userGroups returns the group names (and "#gid" forms) username belongs to.
+func userGroups(username string) map[string]bool {
+	out := map[string]bool{}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return out
+	}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		out["#"+id] = true
+		if g, err := user.LookupGroupId(id); err == nil {
+			out[g.Name] = true
+		}
+	}
+	return out
+}
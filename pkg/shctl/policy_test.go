@@ -0,0 +1,84 @@
+package shctl
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSudoersPolicyEvaluate(t *testing.T) {
+	if !SudoersSupported {
+		t.Skip(ErrSudoersUnsupported)
+	}
+	m, fsys := newTestManager(t, "")
+	writeTestFile(t, fsys, "/etc/sudoers", `Defaults env_reset
+Cmnd_Alias SERVICES = /usr/bin/systemctl, /usr/sbin/service
+User_Alias OPS = alice, bob
+root ALL=(ALL:ALL) ALL
+OPS ALL = (root) NOPASSWD: SERVICES
+deploy web1 = /usr/bin/rsync
+carol ALL = ALL, !/usr/bin/passwd
+#includedir /etc/sudoers.d
+`)
+	writeTestFile(t, fsys, "/etc/sudoers.d/backup", "backup ALL = /usr/bin/tar\n")
+	writeTestFile(t, fsys, "/etc/sudoers.d/skipped.bak", "mallory ALL = ALL\n")
+
+	p, err := m.SudoersPolicy()
+	if err != nil {
+		t.Fatalf("SudoersPolicy: %v", err)
+	}
+	tests := []struct {
+		user, host, command string
+		want                bool
+		wantLine            string // "file:num" of the deciding rule, "" for none
+	}{
+		{"root", "any", "/bin/sh", true, "/etc/sudoers:4"},
+		{"alice", "any", "/usr/bin/systemctl restart nginx", true, "/etc/sudoers:5"},
+		{"bob", "any", "/usr/sbin/service", true, "/etc/sudoers:5"},
+		{"alice", "any", "/bin/sh", false, ""},
+		{"deploy", "web1", "/usr/bin/rsync -a", true, "/etc/sudoers:6"},
+		{"deploy", "web1.example.com", "/usr/bin/rsync", true, "/etc/sudoers:6"},
+		{"deploy", "db1", "/usr/bin/rsync", false, ""},
+		{"carol", "any", "/usr/bin/id", true, "/etc/sudoers:7"},
+		{"carol", "any", "/usr/bin/passwd", false, "/etc/sudoers:7"},
+		{"backup", "any", "/usr/bin/tar", true, "/etc/sudoers.d/backup:1"},
+		{"mallory", "any", "/bin/sh", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.command, func(t *testing.T) {
+			got, rule := p.Evaluate(tt.user, tt.host, tt.command)
+			if got != tt.want {
+				t.Errorf("Evaluate = %v, want %v", got, tt.want)
+			}
+			var line string
+			if rule != nil {
+				line = fmt.Sprintf("%s:%d", rule.Source.File, rule.Source.Num)
+			}
+			if line != tt.wantLine {
+				t.Errorf("deciding rule = %q, want %q", line, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestCommandMatches(t *testing.T) {
+	tests := []struct {
+		spec, command string
+		want          bool
+	}{
+		{"ALL", "/bin/anything --at all", true},
+		{"/usr/bin/systemctl", "/usr/bin/systemctl restart x", true},
+		{`/usr/bin/systemctl ""`, "/usr/bin/systemctl restart x", false},
+		{`/usr/bin/systemctl ""`, "/usr/bin/systemctl", true},
+		{"/usr/bin/systemctl restart *", "/usr/bin/systemctl restart nginx", true},
+		{"/usr/bin/systemctl restart *", "/usr/bin/systemctl stop nginx", false},
+		{"/usr/local/bin/", "/usr/local/bin/tool", true},
+		{"/usr/local/bin/", "/usr/local/bin/sub/tool", false},
+		{"/usr/bin/*", "/usr/bin/id", true},
+		{"/usr/bin/id", "/bin/id", false},
+	}
+	for _, tt := range tests {
+		if got := commandMatches(tt.spec, tt.command); got != tt.want {
+			t.Errorf("commandMatches(%q, %q) = %v, want %v", tt.spec, tt.command, got, tt.want)
+		}
+	}
+}
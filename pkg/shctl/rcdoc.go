@@ -0,0 +1,211 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ----------------- RC document cache -----------------
+//
+// Read operations share one parsed copy of each rc file per Manager instead
+// of re-reading it every time. Anything that writes a file must call
+// invalidateRCDocument so the next read sees the new content; the file
+// helpers in files.go do this.
+
+// RCDocument is the parsed content of an rc file.
+type RCDocument struct {
+	Path     string
+	Lines    []string
+	Entries  []Entry // the entries inside the managed block
+	Disabled []Entry // the entries commented out with DisabledPrefix
+
+	begin, end int // the managed block is Lines[begin:end]
+}
+
+// loadRCDocument returns the cached document for path, reading and parsing
+// the file on first use.
+func (m *Manager) loadRCDocument(path string) (*RCDocument, error) {
+	m.docsMu.Lock()
+	defer m.docsMu.Unlock()
+	if doc, ok := m.docs[path]; ok {
+		return doc, nil
+	}
+	data, err := m.readFileDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &RCDocument{Path: path, Lines: splitLines(string(data))}
+	if begin, end, ok := m.managedRange(doc.Lines); ok {
+		doc.begin, doc.end = begin, end
+		for i := begin; i < end; i++ {
+			if e, ok := m.ParseEntry(doc.Lines[i]); ok {
+				e.Line = i + 1
+				e.Comment = m.commentAbove(doc.Lines, i)
+				e.Tags = ParseTags(e.Comment)
+				doc.Entries = append(doc.Entries, e)
+			} else if e, ok := m.parseDisabled(doc.Lines[i]); ok {
+				e.Line = i + 1
+				e.Comment = m.commentAbove(doc.Lines, i)
+				e.Tags = ParseTags(e.Comment)
+				doc.Disabled = append(doc.Disabled, e)
+			}
+		}
+	}
+	if m.docs == nil {
+		m.docs = map[string]*RCDocument{}
+	}
+	m.docs[path] = doc
+	return doc, nil
+}
+
+// invalidateRCDocument drops the cached document for path.
+func (m *Manager) invalidateRCDocument(path string) {
+	m.docsMu.Lock()
+	delete(m.docs, path)
+	m.docsMu.Unlock()
+}
+
+// LinesWithPrefix returns the managed block's lines whose trimmed text
+// starts with any prefix.
+func (d *RCDocument) LinesWithPrefix(prefixes ...string) []string {
+	var out []string
+	for _, line := range d.Lines[d.begin:d.end] {
+		if hasAnyPrefix(strings.TrimSpace(line), prefixes) {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// ----------------- Managed block -----------------
+//
+// Everything the tool writes to an rc file lives between two marker lines,
+// so it can be told apart from hand-written content. Entries outside the
+// block are never listed, edited or removed. The markers can be changed
+// (see SetManagedMarkers) to adopt an existing dotfiles layout.
+
+// DefaultManagedBegin and DefaultManagedEnd are the markers used when
+// Manager.ManagedBegin and ManagedEnd are empty.
+const (
+	DefaultManagedBegin = "# >>> cli-tool managed >>>"
+	DefaultManagedEnd   = "# <<< cli-tool managed <<<"
+)
+
+func (m *Manager) managedBegin() string {
+	if m.ManagedBegin != "" {
+		return m.ManagedBegin
+	}
+	return DefaultManagedBegin
+}
+
+func (m *Manager) managedEnd() string {
+	if m.ManagedEnd != "" {
+		return m.ManagedEnd
+	}
+	return DefaultManagedEnd
+}
+
+// SetManagedMarkers makes begin and end the lines that open and close the
+// managed block. Both must be one-line comments, so sourcing the file
+// ignores them, must differ, and must not read as an entry or a disabled
+// one, or the block couldn't be told apart from its content.
+func (m *Manager) SetManagedMarkers(begin, end string) error {
+	begin, end = strings.TrimSpace(begin), strings.TrimSpace(end)
+	for _, mk := range []string{begin, end} {
+		if mk == "" {
+			return invalid(errors.New("managed block markers must not be empty"))
+		}
+		if !strings.HasPrefix(mk, "#") || strings.ContainsAny(mk, "\r\n") {
+			return invalid(fmt.Errorf("managed block marker %q must be a one-line comment starting with #", mk))
+		}
+		_, entry := m.ParseEntry(mk)
+		if _, disabled := m.parseDisabled(mk); entry || disabled {
+			return invalid(fmt.Errorf("managed block marker %q reads as an entry", mk))
+		}
+	}
+	if begin == end {
+		return invalid(fmt.Errorf("managed block markers must differ, both are %q", begin))
+	}
+	m.ManagedBegin, m.ManagedEnd = begin, end
+	return nil
+}
+
+// managedRange returns the bounds of the lines between the managed block
+// markers, lines[begin:end]. ok is false when there is no complete block.
+func (m *Manager) managedRange(lines []string) (begin, end int, ok bool) {
+	begin = -1
+	for i, ln := range lines {
+		switch strings.TrimSpace(ln) {
+		case m.managedBegin():
+			if begin < 0 {
+				begin = i + 1
+			}
+		case m.managedEnd():
+			if begin >= 0 {
+				return begin, i, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// managedLines returns the lines inside the managed block of content.
+func (m *Manager) managedLines(content string) []string {
+	lines := splitLines(content)
+	begin, end, ok := m.managedRange(lines)
+	if !ok {
+		return nil
+	}
+	return lines[begin:end]
+}
+
+// editManagedBlock replaces the managed block of path with what edit
+// returns for its current lines, holding the file lock throughout. A file
+// without a block gets one appended, unless edit returns no lines. With
+// SyntaxCheck, a result the shell can't parse is not written.
+func (m *Manager) editManagedBlock(path string, edit func(block []string) ([]string, error)) error {
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return err
+	}
+	lines := splitLines(string(data))
+	begin, end, ok := m.managedRange(lines)
+	var block []string
+	if ok {
+		block = append(block, lines[begin:end]...)
+	}
+	block, err = edit(block)
+	if err != nil {
+		return err
+	}
+	var out []string
+	switch {
+	case ok:
+		out = append(out, lines[:begin]...)
+		out = append(out, block...)
+		out = append(out, lines[end:]...)
+	case len(block) == 0:
+		out = lines
+	default:
+		out = append(out, lines...)
+		if len(out) > 0 && strings.TrimSpace(out[len(out)-1]) != "" {
+			out = append(out, "")
+		}
+		out = append(out, m.managedBegin())
+		out = append(out, block...)
+		out = append(out, m.managedEnd())
+	}
+	content := joinLines(out)
+	if m.SyntaxCheck {
+		if err := m.checkSyntaxContent(path, content); err != nil {
+			return fmt.Errorf("not writing: %w", err)
+		}
+	}
+	return m.commitFile(path, content)
+}
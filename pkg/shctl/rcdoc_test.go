@@ -0,0 +1,212 @@
+package shctl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSetManagedMarkers(t *testing.T) {
+	tests := []struct {
+		name, begin, end string
+		wantErr          bool
+	}{
+		{"custom", "# BEGIN dotfiles", "# END dotfiles", false},
+		{"trimmed", "  # BEGIN  ", "# END", false},
+		{"empty begin", "", "# END", true},
+		{"blank end", "# BEGIN", "  ", true},
+		{"same", "# block", "# block", true},
+		{"not a comment", "BEGIN", "# END", true},
+		{"two lines", "# BEGIN\n# more", "# END", true},
+		{"reads as a disabled entry", "# alias begin=x", "# END", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, "")
+			err := m.SetManagedMarkers(tt.begin, tt.end)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("SetManagedMarkers error = %v, want ErrInvalid", err)
+				}
+				if m.ManagedBegin != "" || m.ManagedEnd != "" {
+					t.Errorf("markers set despite the error: %q, %q", m.ManagedBegin, m.ManagedEnd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetManagedMarkers: %v", err)
+			}
+			if m.ManagedBegin != strings.TrimSpace(tt.begin) || m.ManagedEnd != strings.TrimSpace(tt.end) {
+				t.Errorf("markers = %q, %q", m.ManagedBegin, m.ManagedEnd)
+			}
+		})
+	}
+}
+
+func TestSetManagedMarkersAgainstEntryPrefix(t *testing.T) {
+	m, _ := newTestManager(t, "")
+	if err := m.SetEntryPrefix("alias", "#@alias "); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetManagedMarkers("#@alias begin=1", "# END"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("marker reading as an entry: error = %v, want ErrInvalid", err)
+	}
+}
+
+func TestCustomMarkerSet(t *testing.T) {
+	rc := strings.Join([]string{
+		"# >>> cli-tool managed >>>",
+		"alias old='not ours'",
+		"# <<< cli-tool managed <<<",
+		"## dotfiles {",
+		"myalias ll='ls -la'",
+		"export EDITOR=vim",
+		"## }",
+		"",
+	}, "\n")
+	m, fsys := newTestManager(t, rc)
+	if err := m.SetEntryPrefix("alias", "myalias "); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetManagedMarkers("## dotfiles {", "## }"); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func() []string {
+		t.Helper()
+		entries, err := m.Entries("alias", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name)
+		}
+		return out
+	}
+	if got := names(); len(got) != 1 || got[0] != "ll" {
+		t.Fatalf("aliases = %v, want only ll from the custom block", got)
+	}
+	if _, err := m.AddAlias("gs", "git status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RemoveAlias("ll"); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"# >>> cli-tool managed >>>",
+		"alias old='not ours'",
+		"# <<< cli-tool managed <<<",
+		"## dotfiles {",
+		"export EDITOR=vim",
+		"myalias gs='git status'",
+		"## }",
+		"",
+	}, "\n")
+	if got := readTestFile(t, fsys, m.RCFile); got != want {
+		t.Errorf("rc file =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCustomMarkersNewBlock(t *testing.T) {
+	m, fsys := newTestManager(t, "# hand-written\n")
+	if err := m.SetManagedMarkers("# BEGIN managed", "# END managed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.AddAlias("ll", "ls -la"); err != nil {
+		t.Fatal(err)
+	}
+	want := "# hand-written\n\n# BEGIN managed\nalias ll='ls -la'\n# END managed\n"
+	if got := readTestFile(t, fsys, m.RCFile); got != want {
+		t.Errorf("rc file = %q, want %q", got, want)
+	}
+}
+
+func TestRCDocumentCached(t *testing.T) {
+	m, _ := newTestManager(t, managedRC("alias ll='ls -la'"))
+	first, err := m.loadRCDocument(m.RCFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.loadRCDocument(m.RCFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("second load re-read the file instead of using the cache")
+	}
+}
+
+func TestRCDocumentInvalidatedByWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(m *Manager) error
+		kind  string
+		want  []string
+	}{
+		{"add alias", func(m *Manager) error {
+			_, err := m.AddAlias("gs", "git status")
+			return err
+		}, "alias", []string{"ll", "gs"}},
+		{"remove alias", func(m *Manager) error {
+			return m.RemoveAlias("ll")
+		}, "alias", nil},
+		{"add export", func(m *Manager) error {
+			_, err := m.AddExport("EDITOR", "vim", ExportOptions{})
+			return err
+		}, "export", []string{"EDITOR"}},
+		{"write file", func(m *Manager) error {
+			return m.WriteFile(m.RCFile, managedRC("alias la='ls -A'"))
+		}, "alias", []string{"la"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, managedRC("alias ll='ls -la'"))
+			if _, err := m.Entries("alias", nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.write(m); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := m.Entries(tt.kind, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("entries after write = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkEntries(b *testing.B) {
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("alias a%d='echo %d'", i, i)
+	}
+	for _, bm := range []struct {
+		name   string
+		cached bool
+	}{
+		{"cached", true},
+		{"reread", false},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			m, _ := newTestManager(b, managedRC(lines...))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !bm.cached {
+					m.invalidateRCDocument(m.RCFile)
+				}
+				if _, err := m.Entries("alias", nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1467 @@
+package shctl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ----------------- Aliases -----------------
+
+// AddAlias adds an alias, or replaces the existing definition of name in
+// place. updated reports whether an existing definition was replaced.
+func (m *Manager) AddAlias(name, command string) (updated bool, err error) {
+	return m.AddAliasWithComment(name, command, "")
+}
+
+// AddAliasWithComment is AddAlias that also writes comment as a "# ..."
+// line right above the alias, replacing the comment already there. An
+// empty comment leaves an existing one alone.
+func (m *Manager) AddAliasWithComment(name, command, comment string) (updated bool, err error) {
+	return m.AddAliasTagged(name, command, comment, nil)
+}
+
+// AddAliasTagged is AddAliasWithComment that also tags the alias: each tag
+// is written as "@tag:name" on the comment line, after comment. Tags
+// replace those the alias had; with tags but no comment, the text of the
+// existing comment is kept.
+func (m *Manager) AddAliasTagged(name, command, comment string, tags []string) (updated bool, err error) {
+	line, err := m.AliasLine(name, command)
+	if err != nil {
+		return false, err
+	}
+	if len(tags) > 0 && strings.TrimSpace(comment) == "" {
+		old, _, err := m.Lookup("alias", name)
+		if err != nil {
+			return false, err
+		}
+		comment = stripTags(old.Comment)
+	}
+	if comment, err = TagComment(comment, tags); err != nil {
+		return false, err
+	}
+	c, err := commentLine(comment)
+	if err != nil {
+		return false, err
+	}
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	return m.upsertLine(path, line, c, m.entryMatcher("alias", name))
+}
+
+// AliasLine returns the line AddAlias writes for name, without touching
+// any file.
+func (m *Manager) AliasLine(name, command string) (string, error) {
+	if err := ValidateAliasName(name); err != nil {
+		return "", err
+	}
+	if strings.ContainsAny(command, "\r\n") {
+		return "", invalid(errors.New("an alias command must fit on one line"))
+	}
+	prefix := m.aliasPrefixes()[0]
+	if m.shell() == "fish" {
+		return prefix + name + " " + FishQuote(command), nil
+	}
+	return prefix + name + "=" + ShellQuote(command), nil
+}
+
+// ImportResult counts what ImportAliases or AddEntries did.
+type ImportResult struct {
+	Added, Updated, Skipped int
+}
+
+// ImportAliases adds every `name=command` line of file through AddAlias.
+// Malformed lines are reported to Stderr with their line number and
+// skipped, or, with strict, abort the import before anything is written.
+func (m *Manager) ImportAliases(file string, strict bool) (ImportResult, error) {
+	var res ImportResult
+	data, err := m.readFileRetry(file)
+	if err != nil {
+		return res, err
+	}
+	type pair struct {
+		line          int
+		name, command string
+	}
+	var pairs []pair
+	for i, ln := range splitLines(string(data)) {
+		ln = strings.TrimSpace(ln)
+		if ln == "" || strings.HasPrefix(ln, "#") {
+			continue
+		}
+		name, command, ok := strings.Cut(ln, "=")
+		name, command = strings.TrimSpace(name), strings.TrimSpace(command)
+		if ok && name != "" && command != "" {
+			if strings.HasPrefix(command, "'") || strings.HasPrefix(command, `"`) {
+				command = shellUnquote(command)
+			}
+			_, err = m.AliasLine(name, command)
+		} else {
+			err = invalid(errors.New("expected name=command"))
+		}
+		if err != nil {
+			if strict {
+				return res, fmt.Errorf("%s:%d: %w", file, i+1, err)
+			}
+			m.warnf("%s:%d: skipped: %v\n", file, i+1, err)
+			res.Skipped++
+			continue
+		}
+		pairs = append(pairs, pair{i + 1, name, command})
+	}
+
+	for _, p := range pairs {
+		wasUpdated, err := m.AddAlias(p.name, p.command)
+		if err != nil {
+			return res, fmt.Errorf("%s:%d: %w", file, p.line, err)
+		}
+		if wasUpdated {
+			res.Updated++
+		} else {
+			res.Added++
+		}
+	}
+	return res, nil
+}
+
+// AddEntries adds every `name value` line read from r (blank lines and
+// # comments aside) as an alias or export (kind), each through AddAlias
+// or AddExport with opts. A quoted value is unquoted first. The first line
+// that fails stops the run with an error naming it; with keepGoing it is
+// reported to Stderr, counted as skipped, and the next line is tried.
+func (m *Manager) AddEntries(kind string, r io.Reader, opts ExportOptions, keepGoing bool) (ImportResult, error) {
+	var res ImportResult
+	add := func(name, value string) (bool, error) { return m.AddAlias(name, value) }
+	if kind == "export" {
+		add = func(name, value string) (bool, error) { return m.AddExport(name, value, opts) }
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxLineSize)
+	for n := 1; sc.Scan(); n++ {
+		ln := strings.TrimSpace(sc.Text())
+		if ln == "" || strings.HasPrefix(ln, "#") {
+			continue
+		}
+		var updated bool
+		err := invalid(fmt.Errorf("expected %q", "name value"))
+		if i := strings.IndexAny(ln, " \t"); i > 0 {
+			name, value := ln[:i], strings.TrimSpace(ln[i:])
+			if strings.HasPrefix(value, "'") || strings.HasPrefix(value, `"`) {
+				value = shellUnquote(value)
+			}
+			updated, err = add(name, value)
+		}
+		switch {
+		case err != nil && !keepGoing:
+			return res, fmt.Errorf("line %d: %w", n, err)
+		case err != nil:
+			m.warnf("line %d: skipped: %v\n", n, err)
+			res.Skipped++
+		case updated:
+			res.Updated++
+		default:
+			res.Added++
+		}
+	}
+	return res, sc.Err()
+}
+
+// RenameAlias rewrites `alias old=...` as `alias new=...`, keeping the
+// right-hand side byte for byte. An existing alias named new is only
+// replaced with force.
+func (m *Manager) RenameAlias(oldName, newName string, force bool) error {
+	if err := ValidateAliasName(newName); err != nil {
+		return err
+	}
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return err
+	}
+	isOld, isNew := m.entryMatcher("alias", oldName), m.entryMatcher("alias", newName)
+	return m.editManagedBlock(path, func(block []string) ([]string, error) {
+		out := []string{}
+		found := false
+		for _, ln := range block {
+			if isNew(ln) && oldName != newName {
+				if !force {
+					return nil, invalid(fmt.Errorf("alias %q already exists (use --force to overwrite)", newName))
+				}
+				continue
+			}
+			if isOld(ln) {
+				// the name directly follows the (indented) prefix
+				t := strings.TrimLeft(ln, " \t")
+				for _, p := range m.aliasPrefixes() {
+					if strings.HasPrefix(t, p) {
+						start := len(ln) - len(t) + len(p)
+						ln = ln[:start] + newName + ln[start+len(oldName):]
+						break
+					}
+				}
+				found = true
+			}
+			out = append(out, ln)
+		}
+		if !found {
+			return nil, notFound(fmt.Errorf("alias %q not found in %s", oldName, path))
+		}
+		return out, nil
+	})
+}
+
+// ValidateAliasName accepts the characters POSIX allows in alias names
+// (alphanumerics, '_', '!', '%', ',', '-', '@') plus '.', which every common
+// shell accepts (alias ..='cd ..'). A leading '-' would be read as an option.
+func ValidateAliasName(name string) error {
+	if name == "" {
+		return invalid(errors.New("alias name must not be empty"))
+	}
+	if strings.HasPrefix(name, "-") {
+		return invalid(fmt.Errorf("invalid alias name %q: must not start with '-'", name))
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_!%,-@.", r):
+		default:
+			return invalid(fmt.Errorf("invalid alias name %q: character %q is not allowed", name, r))
+		}
+	}
+	return nil
+}
+
+// shellBuiltins are the builtins (and keywords) an alias of the same name
+// hides, by shell; "sh" holds the ones every shell but fish has.
+var shellBuiltins = map[string][]string{
+	"sh": {"alias", "bg", "break", "cd", "command", "continue", "eval", "exec", "exit",
+		"export", "false", "fg", "getopts", "hash", "jobs", "kill", "pwd", "read",
+		"readonly", "return", "set", "shift", "test", "times", "trap", "true", "type",
+		"ulimit", "umask", "unalias", "unset", "wait"},
+	"bash": {"bind", "builtin", "caller", "declare", "dirs", "disown", "echo", "enable",
+		"help", "history", "let", "local", "logout", "mapfile", "popd", "printf",
+		"pushd", "shopt", "source", "suspend", "typeset"},
+	"zsh": {"autoload", "bindkey", "builtin", "declare", "dirs", "disown", "echo",
+		"emulate", "history", "let", "local", "logout", "popd", "print", "printf",
+		"pushd", "rehash", "setopt", "source", "typeset", "unsetopt", "whence", "where",
+		"which"},
+	"fish": {"abbr", "alias", "bg", "bind", "block", "builtin", "cd", "command",
+		"commandline", "complete", "contains", "count", "echo", "emit", "eval", "exec",
+		"exit", "false", "fg", "functions", "history", "jobs", "math", "printf", "pwd",
+		"random", "read", "realpath", "return", "set", "source", "status", "string",
+		"test", "time", "true", "type", "ulimit", "wait"},
+}
+
+// AliasShadows describes what an alias called name would hide from the
+// target shell: one of its builtins, or a command found on $PATH. It
+// returns "" when the name is free.
+func (m *Manager) AliasShadows(name string) string {
+	sh := m.shell()
+	lists := [][]string{shellBuiltins[sh]}
+	if sh != "fish" {
+		lists = append(lists, shellBuiltins["sh"])
+	}
+	for _, l := range lists {
+		for _, b := range l {
+			if b == name {
+				return "the " + sh + " builtin " + name
+			}
+		}
+	}
+	if p, err := exec.LookPath(name); err == nil {
+		return "the command " + p
+	}
+	return ""
+}
+
+// RemoveAlias removes every definition of name.
+func (m *Manager) RemoveAlias(name string) error {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return err
+	}
+	return m.removeLinesMatching(path, m.entryMatcher("alias", name))
+}
+
+// ----------------- Exports -----------------
+
+// ExportOptions controls how AddExport and UpdateExport write a value.
+type ExportOptions struct {
+	Declare bool // write `declare -x`, which only bash and zsh understand
+	Raw     bool // write the value unquoted, e.g. to keep `$PATH:/x` expanding
+	// Quote is "single" to keep the value literal or "double" to let its
+	// $ references expand. Empty picks by the value: double quotes when it
+	// refers to a variable ($HOME, ${HOME}), else single quotes if it
+	// needs any.
+	Quote string
+	// Comment is written as a "# ..." line right above the export, as
+	// with AddAliasWithComment.
+	Comment string
+}
+
+// AddExport sets varName to value: an existing export is rewritten in
+// place (see UpdateExport), otherwise one is appended. updated reports
+// whether an existing export was rewritten.
+func (m *Manager) AddExport(varName, value string, opts ExportOptions) (updated bool, err error) {
+	return m.setExport(varName, value, opts, false)
+}
+
+// UpdateExport rewrites the value of the existing export of varName,
+// keeping the form it was written in (export, declare -x, set -gx) unless
+// opts.Declare is set. Later definitions of the same variable are dropped
+// so the new value is the one that takes effect. It fails when varName is
+// not exported.
+func (m *Manager) UpdateExport(varName, value string, opts ExportOptions) error {
+	_, err := m.setExport(varName, value, opts, true)
+	return err
+}
+
+// setExport replaces the first export of varName and drops the rest, or
+// appends a new one unless mustExist. Without opts.Declare the existing
+// line keeps its form; a new one uses the first export prefix, or set -gx
+// for fish.
+func (m *Manager) setExport(varName, value string, opts ExportOptions, mustExist bool) (updated bool, err error) {
+	if err := checkExport(varName, value); err != nil {
+		return false, err
+	}
+	if err := checkQuote(opts); err != nil {
+		return false, err
+	}
+	keyword := ""
+	if opts.Declare {
+		if err := m.checkDeclare(); err != nil {
+			return false, err
+		}
+		keyword = "declare -x "
+	}
+	comment, err := commentLine(opts.Comment)
+	if err != nil {
+		return false, err
+	}
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	match := m.entryMatcher("export", varName)
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		out, found := m.replaceEntry(block, match, comment, func(ln string) string {
+			t := strings.TrimLeft(ln, " \t")
+			prefix := keyword
+			if prefix == "" {
+				prefix = m.exportPrefixOf(t)
+			}
+			return ln[:len(ln)-len(t)] + exportLine(prefix, varName, value, opts)
+		})
+		if updated = found; found {
+			return out, nil
+		}
+		if mustExist {
+			return nil, notFound(fmt.Errorf("export %q not found in %s", varName, path))
+		}
+		return appendEntry(block, comment, m.newExportLine(varName, value, opts)), nil
+	})
+	return updated, err
+}
+
+// ExportLine returns the line AddExport writes for a new export of
+// varName, without touching any file.
+func (m *Manager) ExportLine(varName, value string, opts ExportOptions) (string, error) {
+	if opts.Declare {
+		if err := m.checkDeclare(); err != nil {
+			return "", err
+		}
+	}
+	if err := checkExport(varName, value); err != nil {
+		return "", err
+	}
+	if err := checkQuote(opts); err != nil {
+		return "", err
+	}
+	return m.newExportLine(varName, value, opts), nil
+}
+
+// newExportLine renders a new export: set -gx for fish, declare -x with
+// opts.Declare, the first export prefix otherwise.
+func (m *Manager) newExportLine(varName, value string, opts ExportOptions) string {
+	keyword := m.exportPrefixes()[0]
+	switch {
+	case m.shell() == "fish":
+		keyword = "set -gx "
+	case opts.Declare:
+		keyword = "declare -x "
+	}
+	return exportLine(keyword, varName, value, opts)
+}
+
+// checkQuote validates opts.Quote.
+func checkQuote(opts ExportOptions) error {
+	switch {
+	case opts.Quote != "" && opts.Quote != "single" && opts.Quote != "double":
+		return invalid(fmt.Errorf("invalid quoting %q (want single or double)", opts.Quote))
+	case opts.Raw && opts.Quote != "":
+		return invalid(errors.New("a raw value can't also be quoted"))
+	}
+	return nil
+}
+
+// checkExport validates the variable name and value of an export.
+func checkExport(varName, value string) error {
+	switch {
+	case !exportNameRe.MatchString(varName):
+		return invalid(fmt.Errorf("invalid variable name %q", varName))
+	case strings.ContainsAny(value, "\r\n"):
+		return invalid(errors.New("an export value must fit on one line"))
+	}
+	return nil
+}
+
+// VarRef returns the first variable reference ($NAME or ${NAME}) in
+// value, or "" if there is none.
+func VarRef(value string) string {
+	return varRefRe.FindString(value)
+}
+
+func (m *Manager) checkDeclare() error {
+	if !m.ShellSupportsDeclare() {
+		return invalid(fmt.Errorf("--declare requires bash or zsh, but the target shell is %s", m.shell()))
+	}
+	return nil
+}
+
+// exportPrefixOf returns the export prefix line starts with.
+func (m *Manager) exportPrefixOf(line string) string {
+	for _, p := range m.exportPrefixes() {
+		if strings.HasPrefix(line, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// exportLine renders an export with the given prefix: `set -gx VAR value`
+// for fish's set forms, `prefix VAR=value` otherwise. Unless raw, values
+// are quoted as opts.Quote says: values referring to variables are
+// double-quoted so they still expand, and other values the shell would
+// split, expand or interpret are single-quoted.
+func exportLine(prefix, varName, value string, opts ExportOptions) string {
+	fish := strings.HasPrefix(prefix, "set ")
+	switch {
+	case opts.Raw:
+	case opts.Quote == "double" || opts.Quote == "" && varRefRe.MatchString(value):
+		value = DoubleQuote(value)
+	case fish:
+		value = FishQuote(value)
+	case needsShellQuoting(value):
+		value = ShellQuote(value)
+	}
+	if fish {
+		return prefix + varName + " " + value
+	}
+	return prefix + varName + "=" + value
+}
+
+// needsShellQuoting reports whether v contains anything a POSIX shell would
+// treat specially when it appears unquoted after `VAR=`.
+func needsShellQuoting(v string) bool {
+	return v == "" || strings.ContainsAny(v, " \t\n$;&|<>*?[]#~'\"`\\(){}!")
+}
+
+// ShellSupportsDeclare reports whether the target shell has the `declare`
+// builtin (POSIX sh, dash and fish do not).
+func (m *Manager) ShellSupportsDeclare() bool {
+	switch m.shell() {
+	case "bash", "zsh":
+		return true
+	}
+	return false
+}
+
+// RemoveExport removes every export of varName.
+func (m *Manager) RemoveExport(varName string) error {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return err
+	}
+	return m.removeLinesMatching(path, m.entryMatcher("export", varName))
+}
+
+// RemoveEntriesMatching removes every alias or export (kind) whose name
+// matches the regular expression pattern and returns the names removed,
+// sorted. An invalid pattern fails before the rc file is touched.
+func (m *Manager) RemoveEntriesMatching(kind, pattern string) ([]string, error) {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	err = m.removeLinesMatching(path, func(line string) bool {
+		e, ok := m.ParseEntry(line)
+		if !ok || e.Kind != kind || !re.MatchString(e.Name) {
+			return false
+		}
+		seen[e.Name] = true
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(seen))
+	for n := range seen {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ----------------- PATH entries -----------------
+
+// pathParts splits the value of a PATH export into its components,
+// including references to PATH itself. Fish lists are split into words.
+func pathParts(e Entry) []string {
+	if t := strings.TrimSpace(e.Raw); strings.HasPrefix(t, "set ") {
+		_, value, _ := strings.Cut(strings.TrimPrefix(t, "set "), "PATH ")
+		return fishWords(value)
+	}
+	var out []string
+	for _, p := range strings.Split(e.Value, ":") {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func isPathRef(p string) bool {
+	return p == "$PATH" || p == "${PATH}"
+}
+
+// pathDirs returns the directories the PATH exports among lines add, in
+// order and without duplicates.
+func (m *Manager) pathDirs(lines []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, ln := range lines {
+		e, ok := m.ParseEntry(ln)
+		if !ok || e.Kind != "export" || e.Name != "PATH" {
+			continue
+		}
+		for _, p := range pathParts(e) {
+			if !isPathRef(p) && !seen[p] {
+				seen[p] = true
+				out = append(out, p)
+			}
+		}
+	}
+	return out
+}
+
+// pathLine renders a PATH export of parts with prefix, keeping `$PATH`
+// references expandable.
+func pathLine(prefix string, parts []string) string {
+	if strings.HasPrefix(prefix, "set ") {
+		words := make([]string, len(parts))
+		for i, p := range parts {
+			words[i] = p
+			if !isPathRef(p) {
+				words[i] = FishQuote(p)
+			}
+		}
+		return prefix + "PATH " + strings.Join(words, " ")
+	}
+	return prefix + "PATH=" + DoubleQuote(strings.Join(parts, ":"))
+}
+
+// PathDirs returns the directories the PATH exports in the managed block
+// add.
+func (m *Manager) PathDirs() ([]string, error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, err
+	}
+	data, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return nil, err
+	}
+	return m.pathDirs(m.managedLines(string(data))), nil
+}
+
+// PathAdd appends `export PATH="$PATH:dir"` (`set -gx PATH $PATH dir` for
+// fish) unless a managed PATH export already adds dir. added reports
+// whether a line was written.
+func (m *Manager) PathAdd(dir string) (added bool, err error) {
+	if dir == "" || strings.Contains(dir, ":") {
+		return false, invalid(fmt.Errorf("invalid PATH directory %q", dir))
+	}
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	prefix := m.exportPrefixes()[0]
+	if m.shell() == "fish" {
+		prefix = "set -gx "
+	}
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		for _, d := range m.pathDirs(block) {
+			if d == dir {
+				return block, nil
+			}
+		}
+		added = true
+		return append(block, pathLine(prefix, []string{"$PATH", dir})), nil
+	})
+	return added, err
+}
+
+// PathRemove takes dir out of every managed PATH export. Exports left with
+// nothing but `$PATH` are removed. removed reports whether dir was found.
+func (m *Manager) PathRemove(dir string) (removed bool, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		drop := map[int]bool{}
+		for i, ln := range block {
+			e, ok := m.ParseEntry(ln)
+			if !ok || e.Kind != "export" || e.Name != "PATH" {
+				continue
+			}
+			var keep []string
+			dirs := 0
+			for _, p := range pathParts(e) {
+				switch {
+				case p == dir:
+					removed = true
+					continue
+				case !isPathRef(p):
+					dirs++
+				}
+				keep = append(keep, p)
+			}
+			if len(keep) == len(pathParts(e)) {
+				continue
+			}
+			if dirs == 0 {
+				drop[i] = true
+				continue
+			}
+			t := strings.TrimLeft(ln, " \t")
+			block[i] = ln[:len(ln)-len(t)] + pathLine(m.exportPrefixOf(t), keep)
+		}
+		i := -1
+		return dropLines(block, func(string) bool { i++; return drop[i] }), nil
+	})
+	return removed, err
+}
+
+// ----------------- Reading entries -----------------
+
+// Lines returns the managed rc lines starting with any prefix of kind, as
+// written.
+func (m *Manager) Lines(kind string) ([]string, error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, err
+	}
+	doc, err := m.loadRCDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	prefixes := m.aliasPrefixes()
+	if kind == "export" {
+		prefixes = m.exportPrefixes()
+	}
+	return doc.LinesWithPrefix(prefixes...), nil
+}
+
+// Entries returns the managed entries of the given kind accepted by match;
+// a nil match accepts every entry.
+func (m *Manager) Entries(kind string, match func(Entry) bool) ([]Entry, error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, err
+	}
+	doc, err := m.loadRCDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []Entry
+	for _, e := range doc.Entries {
+		if e.Kind == kind && (match == nil || match(e)) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// Lookup returns the effective (last) definition of name.
+func (m *Manager) Lookup(kind, name string) (Entry, bool, error) {
+	entries, err := m.Entries(kind, func(e Entry) bool { return e.Name == name })
+	if err != nil || len(entries) == 0 {
+		return Entry{}, false, err
+	}
+	return entries[len(entries)-1], true, nil
+}
+
+// EntriesSinceBackup diffs the entries of the given kind in the latest rc
+// backup against the current rc file.
+func (m *Manager) EntriesSinceBackup(kind string) ([]EntryChange, error) {
+	bak, ok := m.LatestBackup(m.RCFile)
+	if !ok {
+		return nil, notFound(fmt.Errorf("no rc backup found in %s", m.backupDir()))
+	}
+	old, err := m.loadRCDocument(bak)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := m.loadRCDocument(m.RCFile)
+	if err != nil {
+		return nil, err
+	}
+	var out []EntryChange
+	for _, c := range DiffEntries(old.Entries, cur.Entries) {
+		if c.Kind == kind {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// DumpShell renders the managed aliases and exports as a standalone POSIX
+// shell file, keeping the last definition of each name, or every
+// definition of an export that extends itself.
+func (m *Manager) DumpShell() (string, error) {
+	path := m.RCFile
+	doc, err := m.loadRCDocument(path)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&sb, "# Generated by cli-tool dump from %s. Do not edit.\n", path)
+	// exports that extend themselves (PATH="$PATH:/x") build on each
+	// other, so all of their definitions are kept
+	selfRef := map[string]bool{}
+	for _, e := range doc.Entries {
+		if extendsItself(e) {
+			selfRef[e.Name] = true
+		}
+	}
+	last := map[[2]string]int{}
+	for i, e := range doc.Entries {
+		last[[2]string{e.Kind, e.Name}] = i
+	}
+	for i, e := range doc.Entries {
+		if last[[2]string{e.Kind, e.Name}] != i && !(e.Kind == "export" && selfRef[e.Name]) {
+			continue
+		}
+		sb.WriteString(FormatShellEntry(e))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// EvalScript renders the managed entries of the given kinds (every kind when
+// none is given) as statements for the target shell, in file order, so
+// that `eval "$(cli-tool export env)"` has the effect of sourcing them.
+// Entries are not deduplicated: PATH exports build on each other.
+func (m *Manager) EvalScript(kinds ...string) (string, error) {
+	doc, err := m.loadRCDocument(m.RCFile)
+	if err != nil {
+		return "", err
+	}
+	format := FormatShellEntry
+	if m.shell() == "fish" {
+		format = FormatFishEntry
+	}
+	var sb strings.Builder
+	for _, e := range doc.Entries {
+		if len(kinds) > 0 && !containsString(kinds, e.Kind) {
+			continue
+		}
+		sb.WriteString(format(e))
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------------- Disabled entries -----------------
+//
+// Disabling an entry comments it out with DisabledPrefix, so it can be
+// enabled again later without retyping it. Disabled entries are not listed,
+// looked up or applied; only DisabledEntries and EnableEntry see them.
+
+// DisabledPrefix is put in front of a disabled entry's line.
+const DisabledPrefix = "# "
+
+// parseDisabled parses line as an entry disabled with DisabledPrefix. The
+// entry's Raw is the line as it is in the file, comment included.
+func (m *Manager) parseDisabled(line string) (Entry, bool) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), DisabledPrefix)
+	if !ok {
+		return Entry{}, false
+	}
+	e, ok := m.ParseEntry(rest)
+	e.Raw = line
+	return e, ok
+}
+
+// DisabledEntries returns the disabled entries of the given kind in file
+// order.
+func (m *Manager) DisabledEntries(kind string) ([]Entry, error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, err
+	}
+	doc, err := m.loadRCDocument(path)
+	if err != nil {
+		return nil, err
+	}
+	var out []Entry
+	for _, e := range doc.Disabled {
+		if e.Kind == kind {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// DisableEntry comments out every definition of kind/name. changed is
+// false when it was already disabled; a name that is neither defined nor
+// disabled is ErrNotFound.
+func (m *Manager) DisableEntry(kind, name string) (changed bool, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	match := m.entryMatcher(kind, name)
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		disabled := false
+		for i, ln := range block {
+			if match(ln) {
+				block[i] = DisabledPrefix + strings.TrimSpace(ln)
+				changed = true
+			} else if e, ok := m.parseDisabled(ln); ok && e.Kind == kind && e.Name == name {
+				disabled = true
+			}
+		}
+		if !changed && !disabled {
+			return nil, notFound(fmt.Errorf("%s %q not found in %s", kind, name, path))
+		}
+		return block, nil
+	})
+	return changed, err
+}
+
+// EnableEntry uncomments the last disabled definition of kind/name and
+// drops any other disabled copies. changed is false when it is already
+// enabled; enabling a name that is both defined and disabled is refused,
+// since one definition would silently replace the other.
+func (m *Manager) EnableEntry(kind, name string) (changed bool, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	match := m.entryMatcher(kind, name)
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		last, active := -1, false
+		for i, ln := range block {
+			if match(ln) {
+				active = true
+			} else if e, ok := m.parseDisabled(ln); ok && e.Kind == kind && e.Name == name {
+				last = i
+			}
+		}
+		switch {
+		case last < 0 && active:
+			return block, nil
+		case last < 0:
+			return nil, notFound(fmt.Errorf("disabled %s %q not found in %s", kind, name, path))
+		case active:
+			return nil, invalid(fmt.Errorf("%s %q is defined and disabled; remove one of them first", kind, name))
+		}
+		var out []string
+		for i, ln := range block {
+			if i == last {
+				rest, _ := strings.CutPrefix(strings.TrimSpace(ln), DisabledPrefix)
+				out = append(out, rest)
+				continue
+			}
+			if e, ok := m.parseDisabled(ln); ok && e.Kind == kind && e.Name == name {
+				continue
+			}
+			out = append(out, ln)
+		}
+		changed = true
+		return out, nil
+	})
+	return changed, err
+}
+
+// ----------------- Entry comments -----------------
+//
+// An entry's comment is the "# ..." line right above it in the managed
+// block. It is read into Entry.Comment, replaced when the entry is added
+// again with a new one, and removed along with the entry.
+
+// isEntryComment reports whether line is a comment that can belong to the
+// entry below it: not a disabled entry or a managed block marker.
+func (m *Manager) isEntryComment(line string) bool {
+	t := strings.TrimSpace(line)
+	if !strings.HasPrefix(t, "#") || t == m.managedBegin() || t == m.managedEnd() {
+		return false
+	}
+	_, disabled := m.parseDisabled(t)
+	return !disabled
+}
+
+// commentAbove returns the text of the comment of lines[i], or "".
+func (m *Manager) commentAbove(lines []string, i int) string {
+	if i == 0 || !m.isEntryComment(lines[i-1]) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[i-1]), "#"))
+}
+
+// commentLine renders comment as a comment line; "" stays "".
+func commentLine(comment string) (string, error) {
+	comment = strings.TrimSpace(comment)
+	switch {
+	case comment == "":
+		return "", nil
+	case strings.ContainsAny(comment, "\r\n"):
+		return "", invalid(errors.New("a comment must fit on one line"))
+	}
+	return "# " + comment, nil
+}
+
+// markWithComments marks the lines of block accepted by match (given the
+// index), together with the comment right above each of them.
+func (m *Manager) markWithComments(block []string, match func(i int) bool) []bool {
+	marked := make([]bool, len(block))
+	for i := range block {
+		if match(i) {
+			marked[i] = true
+			if i > 0 && m.isEntryComment(block[i-1]) {
+				marked[i-1] = true
+			}
+		}
+	}
+	return marked
+}
+
+// replaceEntry replaces the first line of block accepted by match with
+// render(line) and drops the later ones along with their comments. A
+// non-empty comment line replaces the comment of the line kept, or is put
+// above it. found is false, and block returned as is, when nothing matches.
+func (m *Manager) replaceEntry(block []string, match func(string) bool, comment string, render func(string) string) (out []string, found bool) {
+	first := -1
+	for i, ln := range block {
+		if match(ln) {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return block, false
+	}
+	drop := m.markWithComments(block, func(i int) bool { return i > first && match(block[i]) })
+	out = []string{}
+	for i, ln := range block {
+		switch {
+		case drop[i]:
+			continue
+		case i == first:
+			if comment != "" {
+				if i > 0 && m.isEntryComment(block[i-1]) {
+					out = out[:len(out)-1]
+				}
+				out = append(out, comment)
+			}
+			ln = render(ln)
+		}
+		out = append(out, ln)
+	}
+	return out, true
+}
+
+// appendEntry appends line to block, below comment unless it is empty.
+func appendEntry(block []string, comment, line string) []string {
+	if comment != "" {
+		block = append(block, comment)
+	}
+	return append(block, line)
+}
+
+// ----------------- Tags -----------------
+//
+// Tags sort entries into categories. They live on the entry's comment line
+// as "@tag:name" words, so they move and go away with the entry like the
+// rest of its comment.
+
+// tagRe finds the tags of a comment.
+var tagRe = regexp.MustCompile(`(?:^|\s)@tag:(\S+)`)
+
+// tagNameRe matches the names TagComment accepts.
+var tagNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ParseTags returns the tags of comment, each once, in order.
+func ParseTags(comment string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, sm := range tagRe.FindAllStringSubmatch(comment, -1) {
+		if !seen[sm[1]] {
+			seen[sm[1]] = true
+			tags = append(tags, sm[1])
+		}
+	}
+	return tags
+}
+
+// HasTag reports whether e is tagged with tag.
+func (e Entry) HasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// TagComment appends tags to comment as "@tag:name" words. A tag is made
+// of letters, digits, '_', '.' and '-'.
+func TagComment(comment string, tags []string) (string, error) {
+	words := []string{strings.TrimSpace(comment)}
+	if words[0] == "" {
+		words = nil
+	}
+	seen := map[string]bool{}
+	for _, t := range tags {
+		if !tagNameRe.MatchString(t) {
+			return "", invalid(fmt.Errorf("invalid tag %q: use letters, digits, '_', '.' and '-'", t))
+		}
+		if !seen[t] {
+			seen[t] = true
+			words = append(words, "@tag:"+t)
+		}
+	}
+	return strings.Join(words, " "), nil
+}
+
+// stripTags returns comment without its tags.
+func stripTags(comment string) string {
+	return strings.Join(strings.Fields(tagRe.ReplaceAllString(comment, " ")), " ")
+}
+
+// ----------------- Sorting -----------------
+
+// varRefRe finds $NAME and ${NAME} references.
+var varRefRe = regexp.MustCompile(`\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// singleQuotedRe finds single-quoted text, inside which $ is literal.
+var singleQuotedRe = regexp.MustCompile(`'[^']*'`)
+
+// extendsItself reports whether e is an export whose value refers to its
+// own variable, as in PATH="$PATH:/x".
+func extendsItself(e Entry) bool {
+	if e.Kind != "export" {
+		return false
+	}
+	for _, ref := range varRefRe.FindAllStringSubmatch(singleQuotedRe.ReplaceAllString(e.Raw, ""), -1) {
+		if ref[1] == e.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// SortEntries reorders the managed entries of kind, disabled ones
+// included, alphabetically by name. The sorted entries, each with its
+// entry comment, take the places the entries of kind had, so other
+// comments and lines stay where they are, and definitions of the same name
+// keep their order, which makes sorting idempotent. Sorting exports is
+// refused when it would move an export ahead of another managed export it
+// references.
+func (m *Manager) SortEntries(kind string) (changed bool, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, err
+	}
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		var slots []int
+		var entries []Entry
+		comments := map[int]string{} // by the line of the entry they belong to
+		for i, ln := range block {
+			e, ok := m.ParseEntry(ln)
+			if !ok {
+				e, ok = m.parseDisabled(ln)
+			}
+			if ok && e.Kind == kind {
+				e.Raw, e.Line = ln, i
+				slots = append(slots, i)
+				entries = append(entries, e)
+				if i > 0 && m.isEntryComment(block[i-1]) {
+					comments[i] = block[i-1]
+				}
+			}
+		}
+		sorted := append([]Entry(nil), entries...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+		if kind == "export" {
+			if err := checkExportOrder(entries, sorted, "sorting"); err != nil {
+				return nil, err
+			}
+		}
+		out := []string{}
+		n := 0
+		for i, ln := range block {
+			switch {
+			case n < len(slots) && slots[n] == i:
+				e := sorted[n]
+				n++
+				if c, ok := comments[e.Line]; ok {
+					out = append(out, c)
+				}
+				ln = e.Raw
+			case i+1 < len(block) && comments[i+1] != "":
+				continue // moves with its entry
+			}
+			out = append(out, ln)
+		}
+		changed = joinLines(out) != joinLines(block)
+		return out, nil
+	})
+	return changed, err
+}
+
+// Duplicate is a name DedupeDefinitions collapsed to its last definition.
+type Duplicate struct {
+	Name    string `json:"name"`
+	Removed int    `json:"removed"` // earlier definitions dropped
+	Kept    string `json:"kept"`    // the line kept
+}
+
+// DedupeDefinitions keeps only the last definition of each alias or export
+// (kind) in the managed block, which is the one the shell ends up with, and
+// returns what it collapsed, by name. Exports that extend themselves
+// (PATH="$PATH:/x") are left alone, since each of their definitions
+// counts; their names are returned in skipped. Exports are refused, as by
+// SortEntries, if one would end up ahead of another it references.
+func (m *Manager) DedupeDefinitions(kind string) (dups []Duplicate, skipped []string, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return nil, nil, err
+	}
+	err = m.editManagedBlock(path, func(block []string) ([]string, error) {
+		dups, skipped = nil, nil
+		var entries []Entry
+		count, last := map[string]int{}, map[string]int{}
+		selfRef := map[string]bool{}
+		for i, ln := range block {
+			e, ok := m.ParseEntry(ln)
+			if !ok || e.Kind != kind {
+				continue
+			}
+			e.Line = i
+			entries = append(entries, e)
+			count[e.Name]++
+			last[e.Name] = i
+			if count[e.Name] > 1 && extendsItself(e) {
+				selfRef[e.Name] = true
+			}
+		}
+		drop := m.markWithComments(block, func(i int) bool {
+			e, ok := m.ParseEntry(block[i])
+			return ok && e.Kind == kind && last[e.Name] != i && !selfRef[e.Name]
+		})
+		var out []string
+		var kept []Entry
+		for i, ln := range block {
+			if drop[i] {
+				continue
+			}
+			if e, ok := m.ParseEntry(ln); ok && e.Kind == kind {
+				e.Line = i
+				kept = append(kept, e)
+			}
+			out = append(out, ln)
+		}
+		if kind == "export" {
+			if err := checkExportOrder(entries, kept, "removing duplicates"); err != nil {
+				return nil, err
+			}
+		}
+		for _, e := range entries {
+			if last[e.Name] != e.Line || count[e.Name] < 2 {
+				continue
+			}
+			if selfRef[e.Name] {
+				skipped = append(skipped, e.Name)
+				continue
+			}
+			dups = append(dups, Duplicate{Name: e.Name, Removed: count[e.Name] - 1, Kept: e.Raw})
+		}
+		return out, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(dups, func(i, j int) bool { return dups[i].Name < dups[j].Name })
+	sort.Strings(skipped)
+	return dups, skipped, nil
+}
+
+// checkExportOrder reports an export that references another one defined
+// before it in before but after it in after; what names the change.
+func checkExportOrder(before, after []Entry, what string) error {
+	pos := func(es []Entry) map[string]int {
+		p := map[string]int{}
+		for i, e := range es {
+			if _, ok := p[e.Name]; !ok {
+				p[e.Name] = i
+			}
+		}
+		return p
+	}
+	was, now := pos(before), pos(after)
+	for i, e := range after {
+		raw := singleQuotedRe.ReplaceAllString(e.Raw, "")
+		for _, ref := range varRefRe.FindAllStringSubmatch(raw, -1) {
+			name := ref[1]
+			if name == e.Name {
+				continue
+			}
+			if w, ok := was[name]; ok && w < was[e.Name] && now[name] > i {
+				return invalid(fmt.Errorf("%s would move export %s ahead of %s, which it references", what, e.Name, name))
+			}
+		}
+	}
+	return nil
+}
+
+// ----------------- Applied state -----------------
+
+// appliedState describes the rc file: its path, content hash and mtime.
+func (m *Manager) appliedState() (string, error) {
+	rc := m.RCFile
+	data, err := m.readFileRetry(rc)
+	if err != nil {
+		return "", err
+	}
+	fi, err := m.fsys().Stat(rc)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("path %s\nsha256 %x\nmtime %d\n", rc, sha256.Sum256(data), fi.ModTime().Unix()), nil
+}
+
+// MarkApplied records the rc file's current state in statePath. With
+// DryRun it previews the write instead.
+func (m *Manager) MarkApplied(statePath string) error {
+	state, err := m.appliedState()
+	if err != nil {
+		return err
+	}
+	if m.DryRun {
+		return m.previewWrite(statePath, state)
+	}
+	if err := m.fsys().MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return err
+	}
+	return m.atomicWriteFile(statePath, state)
+}
+
+// IsApplied compares the rc file's path and content hash with the state
+// recorded in statePath. The mtime is informational only, so touching the
+// file is not a change.
+func (m *Manager) IsApplied(statePath string) (bool, error) {
+	recorded, err := m.readFileRetry(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current, err := m.appliedState()
+	if err != nil {
+		return false, err
+	}
+	strip := func(s string) string { return s[:strings.Index(s, "mtime ")] }
+	return strings.Contains(string(recorded), "mtime ") && strip(string(recorded)) == strip(current), nil
+}
+
+// ----------------- RC edit -----------------
+
+// EditRC lets edit change the rc file in place, after backing it up. If
+// the result no longer parses (see CheckSyntax), revert decides whether
+// the backup is put back; if it isn't, the *SyntaxError is returned. It
+// reports whether the file changed and whether it was reverted. With
+// DryRun edit gets a temp copy, whose diff is previewed and discarded.
+func (m *Manager) EditRC(edit func(path string) error, revert func(error) bool) (changed, reverted bool, err error) {
+	path := m.RCFile
+	if err := m.ensureFile(path); err != nil {
+		return false, false, err
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return false, false, err
+	}
+	defer unlock()
+	orig, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return false, false, err
+	}
+	if m.DryRun {
+		tmp, err := m.createTemp("", "rc_*")
+		if err != nil {
+			return false, false, err
+		}
+		defer m.removeTemp(tmp.Name())
+		_, err = tmp.Write(orig)
+		if cerr := tmp.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = edit(tmp.Name())
+		}
+		if err != nil {
+			return false, false, err
+		}
+		edited, err := m.readFileRetry(tmp.Name())
+		if err != nil {
+			return false, false, err
+		}
+		return string(edited) != string(orig), false, m.previewWrite(path, string(edited))
+	}
+
+	res, err := m.Backup(BackupOptions{RC: true})
+	if err != nil {
+		return false, false, fmt.Errorf("not editing %s, backup failed: %w", path, err)
+	}
+	m.notef("Backed up %s -> %s\n", path, res["rc"])
+	m.journal(path)
+	defer m.invalidateRCDocument(path)
+	err = edit(path)
+	edited, rerr := m.readFileOrEmpty(path)
+	if rerr != nil {
+		return false, false, rerr
+	}
+	changed = string(edited) != string(orig)
+	if err != nil || !changed {
+		return changed, false, err
+	}
+	err = m.CheckSyntax(path)
+	var se *SyntaxError
+	if !errors.As(err, &se) {
+		// parses, or the shell couldn't be run to tell
+		return true, false, err
+	}
+	if !revert(err) {
+		return true, false, err
+	}
+	backup, err := m.readFileDecompressed(res["rc"])
+	if err != nil {
+		return true, false, err
+	}
+	return true, true, m.atomicWriteFile(path, string(backup))
+}
+
+// ----------------- Several rc files -----------------
+
+// RCResult is what EachRC did to one rc file.
+type RCResult struct {
+	File       string `json:"file"`
+	Shell      string `json:"shell"`
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolled_back,omitempty"`
+}
+
+// ShellForRC returns the shell whose syntax the rc file at path is in,
+// going by its name: zsh for .zshrc, .zprofile and the like, fish for
+// *.fish, bash for .bashrc, .bash_profile, .bash_login and .profile, and
+// def for anything else.
+func ShellForRC(path, def string) string {
+	base := filepath.Base(path)
+	switch {
+	case strings.HasSuffix(base, ".fish"):
+		return "fish"
+	case base == ".zshrc", base == ".zprofile", base == ".zshenv", base == ".zlogin":
+		return "zsh"
+	case base == ".bashrc", base == ".bash_profile", base == ".bash_login", base == ".profile":
+		return "bash"
+	}
+	return def
+}
+
+// EachRC calls change once per file, in order, with RCFile set to the file
+// and Shell to the shell its name implies (see ShellForRC; the current
+// Shell otherwise). When change fails for a file, the files already
+// changed, and that one, are put back as they were, so either every file
+// changes or none does. RCFile and Shell are restored before returning.
+func (m *Manager) EachRC(files []string, change func() error) ([]RCResult, error) {
+	rcFile, shell := m.RCFile, m.Shell
+	defer func() { m.RCFile, m.Shell = rcFile, shell }()
+	var results []RCResult
+	var before []JournalFile
+	for _, f := range files {
+		m.RCFile, m.Shell = f, ShellForRC(f, shell)
+		if m.Shell == "" {
+			m.Shell = m.shell()
+		}
+		results = append(results, RCResult{File: f, Shell: m.Shell})
+		data, err := m.readFileRetry(f)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			results[len(results)-1].Error = err.Error()
+			m.rollBack(before, results)
+			return results, err
+		}
+		before = append(before, JournalFile{Path: f, Kind: "file", Existed: err == nil, Content: data})
+		if err := change(); err != nil {
+			results[len(results)-1].Error = err.Error()
+			m.rollBack(before, results)
+			return results, fmt.Errorf("%s: %w", f, err)
+		}
+	}
+	return results, nil
+}
+
+// rollBack puts the files of before back as they were, marking results
+// for those it changed.
+func (m *Manager) rollBack(before []JournalFile, results []RCResult) {
+	if m.DryRun {
+		return
+	}
+	for i, f := range before {
+		data, err := m.readFileRetry(f.Path)
+		if (err == nil) == f.Existed && string(data) == string(f.Content) {
+			continue
+		}
+		if err := m.undoFile(f); err != nil {
+			m.warnf("warning: could not roll back %s: %v\n", f.Path, err)
+			continue
+		}
+		results[i].RolledBack = true
+	}
+}
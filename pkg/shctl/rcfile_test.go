@@ -0,0 +1,480 @@
+package shctl
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeclareExportRoundTrip(t *testing.T) {
+	tests := []struct {
+		shell, value, line string
+	}{
+		{"bash", "vim", "declare -x EDITOR=vim"},
+		{"zsh", "vim", "declare -x EDITOR=vim"},
+		{"bash", "code --wait", "declare -x EDITOR='code --wait'"},
+		{"bash", "$HOME/bin/ed", `declare -x EDITOR="$HOME/bin/ed"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell+" "+tt.value, func(t *testing.T) {
+			m, fsys := newTestManager(t, "# rc\n")
+			m.Shell = tt.shell
+			if _, err := m.AddExport("EDITOR", tt.value, ExportOptions{Declare: true}); err != nil {
+				t.Fatalf("AddExport: %v", err)
+			}
+			if rc := readTestFile(t, fsys, m.RCFile); !containsLine(rc, tt.line) {
+				t.Fatalf("rc file lacks %q:\n%s", tt.line, rc)
+			}
+			e, ok, err := m.Lookup("export", "EDITOR")
+			if err != nil || !ok || e.Value != tt.value || e.Raw != tt.line {
+				t.Fatalf("Lookup = %+v, %v, %v; want value %q from %q", e, ok, err, tt.value, tt.line)
+			}
+			// an update keeps the declare -x form
+			if err := m.UpdateExport("EDITOR", "nano", ExportOptions{}); err != nil {
+				t.Fatalf("UpdateExport: %v", err)
+			}
+			if rc := readTestFile(t, fsys, m.RCFile); !containsLine(rc, "declare -x EDITOR=nano") {
+				t.Fatalf("update dropped the declare -x form:\n%s", rc)
+			}
+			if err := m.RemoveExport("EDITOR"); err != nil {
+				t.Fatalf("RemoveExport: %v", err)
+			}
+			if rc := readTestFile(t, fsys, m.RCFile); strings.Contains(rc, "EDITOR") {
+				t.Fatalf("export left after remove:\n%s", rc)
+			}
+		})
+	}
+}
+
+func TestDeclareExportUnsupportedShell(t *testing.T) {
+	for _, shell := range []string{"sh", "dash", "fish"} {
+		m, _ := newTestManager(t, "")
+		m.Shell = shell
+		if _, err := m.AddExport("EDITOR", "vim", ExportOptions{Declare: true}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: AddExport --declare error = %v, want ErrInvalid", shell, err)
+		}
+		if _, err := m.ExportLine("EDITOR", "vim", ExportOptions{Declare: true}); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: ExportLine --declare error = %v, want ErrInvalid", shell, err)
+		}
+	}
+}
+
+func TestEntriesSinceBackup(t *testing.T) {
+	backup := managedRC(
+		"alias ll='ls -la'",
+		"alias gs='git status'",
+		"export EDITOR=vim",
+	)
+	tests := []struct {
+		name string
+		kind string
+		cur  string
+		want []EntryChange
+	}{
+		{"unchanged", "alias", backup, nil},
+		{"added, removed and changed", "alias", managedRC(
+			"alias ll='ls -lah'",
+			"alias gd='git diff'",
+			"export EDITOR=vim",
+		), []EntryChange{
+			{Op: "added", Kind: "alias", Name: "gd", New: "git diff"},
+			{Op: "removed", Kind: "alias", Name: "gs", Old: "git status"},
+			{Op: "changed", Kind: "alias", Name: "ll", Old: "ls -la", New: "ls -lah"},
+		}},
+		{"other kind only", "alias", managedRC(
+			"alias ll='ls -la'",
+			"alias gs='git status'",
+			"export EDITOR=nano",
+		), nil},
+		{"exports", "export", managedRC(
+			"alias ll='ls -la'",
+			"export EDITOR=nano",
+		), []EntryChange{
+			{Op: "changed", Kind: "export", Name: "EDITOR", Old: "vim", New: "nano"},
+		}},
+		{"last definition wins", "alias", managedRC(
+			"alias ll='ls'",
+			"alias ll='ls -la'",
+			"alias gs='git status'",
+		), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, tt.cur)
+			writeTestFile(t, fsys, m.BackupDir+"/.bashrc.bak.20240101_000000", backup)
+			got, err := m.EntriesSinceBackup(tt.kind)
+			if err != nil {
+				t.Fatalf("EntriesSinceBackup: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("EntriesSinceBackup = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntriesSinceBackupWithoutBackup(t *testing.T) {
+	m, _ := newTestManager(t, managedRC("alias ll='ls -la'"))
+	if _, err := m.EntriesSinceBackup("alias"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("EntriesSinceBackup error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDumpShellFileSources(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to check the file with")
+	}
+	m, _ := newTestManager(t, managedRC(
+		`alias ll='ls -la'`,
+		`alias greet='echo '\''hi there'\'''`,
+		`alias ll='ls -lah'`,
+		`export EDITOR=vim`,
+		`declare -x PAGER='less -R'`,
+		`export GOPATH="$HOME/go"`,
+		`export PS='a;b*c "d"'`,
+		`set -gx LANG C.UTF-8`,
+		`export PATH="$PATH:/opt/a"`,
+		`export PATH="$PATH:/opt/b"`,
+	))
+	content, err := m.DumpShell()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(content, "#!/bin/sh\n# Generated by cli-tool") {
+		t.Errorf("dump lacks the header:\n%s", content)
+	}
+	// written the way dump --shell-file does, into a directory to create
+	out := filepath.Join(t.TempDir(), "docker", "env.sh")
+	disk := &Manager{RCFile: out}
+	if err := disk.WriteFile(out, content); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := exec.Command(sh, "-n", out).CombinedOutput(); err != nil {
+		t.Fatalf("sh -n %s: %v\n%s\n%s", out, err, msg, content)
+	}
+	// sourcing it gives back the values, the last definition of ll and
+	// both PATH additions
+	script := `. "$1" && printf '%s|%s|%s|%s\n' "$EDITOR" "$PAGER" "$PS" "$LANG" && alias ll && alias greet && echo "$PATH"`
+	got, err := exec.Command(sh, "-c", script, "sh", out).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sourcing the dump: %v\n%s", err, got)
+	}
+	lines := splitLines(string(got))
+	if len(lines) != 4 || lines[0] != `vim|less -R|a;b*c "d"|C.UTF-8` ||
+		!strings.Contains(lines[1], "ls -lah") || !strings.Contains(lines[2], "hi there") ||
+		!strings.HasSuffix(lines[3], ":/opt/a:/opt/b") {
+		t.Errorf("sourced dump printed:\n%s", got)
+	}
+}
+
+func TestAppliedState(t *testing.T) {
+	const state = "/home/u/.cache/cli-tool/last-applied"
+	rc := managedRC("alias ll='ls -la'")
+	tests := []struct {
+		name   string
+		mark   bool
+		change func(t *testing.T, m *Manager)
+		want   bool
+	}{
+		{"never marked", false, nil, false},
+		{"unchanged", true, nil, true},
+		{"rewritten with the same content", true, func(t *testing.T, m *Manager) {
+			writeTestFile(t, m.FS, m.RCFile, rc)
+		}, true},
+		{"entry added", true, func(t *testing.T, m *Manager) {
+			if _, err := m.AddAlias("gs", "git status"); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"other rc file", true, func(t *testing.T, m *Manager) {
+			m.RCFile = "/home/u/.zshrc"
+			writeTestFile(t, m.FS, m.RCFile, rc)
+		}, false},
+		{"corrupt state", true, func(t *testing.T, m *Manager) {
+			writeTestFile(t, m.FS, state, "garbage\n")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := newTestManager(t, rc)
+			if tt.mark {
+				if err := m.MarkApplied(state); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.change != nil {
+				tt.change(t, m)
+			}
+			got, err := m.IsApplied(state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("IsApplied = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemovePreservesMode(t *testing.T) {
+	rc := managedRC("alias ll='ls -la'", "alias gs='git status'", "export EDITOR='vim'")
+	tests := []struct {
+		name   string
+		mode   fs.FileMode
+		remove func(m *Manager) error
+	}{
+		{"alias, private file", 0o600, func(m *Manager) error { return m.RemoveAlias("ll") }},
+		{"alias, group readable", 0o640, func(m *Manager) error { return m.RemoveAlias("ll") }},
+		{"export", 0o600, func(m *Manager) error { return m.RemoveExport("EDITOR") }},
+		{"by pattern", 0o600, func(m *Manager) error {
+			_, err := m.RemoveEntriesMatching("alias", "g*")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, "")
+			if err := fsys.WriteFile(m.RCFile, []byte(rc), tt.mode); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.remove(m); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, fsys, m.RCFile); got == rc {
+				t.Fatal("nothing was removed")
+			}
+			fi, err := fsys.Stat(m.RCFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != tt.mode {
+				t.Errorf("mode after remove = %v, want %v", got, tt.mode)
+			}
+		})
+	}
+}
+
+func TestAddRemoveCyclesAreStable(t *testing.T) {
+	tests := []struct {
+		name   string
+		add    func(m *Manager) error
+		remove func(m *Manager) error
+	}{
+		{"alias", func(m *Manager) error {
+			_, err := m.AddAlias("gs", "git status")
+			return err
+		}, func(m *Manager) error { return m.RemoveAlias("gs") }},
+		{"export", func(m *Manager) error {
+			_, err := m.AddExport("EDITOR", "vim", ExportOptions{})
+			return err
+		}, func(m *Manager) error { return m.RemoveExport("EDITOR") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, managedRC("alias ll='ls -la'", "", "export PAGER='less'")+"\n# trailer\n")
+			if err := tt.add(m); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.remove(m); err != nil {
+				t.Fatal(err)
+			}
+			want := readTestFile(t, fsys, m.RCFile)
+			for i := 0; i < 100; i++ {
+				if err := tt.add(m); err != nil {
+					t.Fatal(err)
+				}
+				if err := tt.remove(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := readTestFile(t, fsys, m.RCFile); got != want {
+				t.Errorf("after 100 cycles the file went from %d to %d bytes:\n%s", len(want), len(got), got)
+			}
+		})
+	}
+}
+
+func TestMemFSLifecycle(t *testing.T) {
+	m, fsys := newTestManager(t, "")
+	names := func(kind string) string {
+		t.Helper()
+		entries, err := m.Entries(kind, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name+"="+e.Value)
+		}
+		return strings.Join(out, " ")
+	}
+	steps := []struct {
+		name          string
+		do            func() error
+		aliases, exps string
+	}{
+		{"empty", func() error { return nil }, "", ""},
+		{"add alias", func() error {
+			_, err := m.AddAlias("ll", "ls -la")
+			return err
+		}, "ll=ls -la", ""},
+		{"add export", func() error {
+			_, err := m.AddExport("EDITOR", "vim", ExportOptions{})
+			return err
+		}, "ll=ls -la", "EDITOR=vim"},
+		{"update alias", func() error {
+			_, err := m.AddAlias("ll", "ls -lah")
+			return err
+		}, "ll=ls -lah", "EDITOR=vim"},
+		{"add second alias", func() error {
+			_, err := m.AddAlias("gs", "git status")
+			return err
+		}, "ll=ls -lah gs=git status", "EDITOR=vim"},
+		{"remove alias", func() error { return m.RemoveAlias("ll") }, "gs=git status", "EDITOR=vim"},
+		{"remove export", func() error { return m.RemoveExport("EDITOR") }, "gs=git status", ""},
+	}
+	for _, st := range steps {
+		if err := st.do(); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if got := names("alias"); got != st.aliases {
+			t.Errorf("%s: aliases = %q, want %q", st.name, got, st.aliases)
+		}
+		if got := names("export"); got != st.exps {
+			t.Errorf("%s: exports = %q, want %q", st.name, got, st.exps)
+		}
+	}
+	before := readTestFile(t, fsys, m.RCFile)
+	if err := m.RemoveAlias("ll"); err != nil {
+		t.Fatal(err)
+	}
+	if after := readTestFile(t, fsys, m.RCFile); after != before {
+		t.Errorf("removing a missing alias changed the file:\n%s", after)
+	}
+	if rc := readTestFile(t, fsys, m.RCFile); !containsLine(rc, DefaultManagedBegin) || !containsLine(rc, DefaultManagedEnd) {
+		t.Errorf("rc file has no managed block:\n%s", rc)
+	}
+	if _, err := os.Stat(m.RCFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s exists on disk: the MemFS run leaked out (%v)", m.RCFile, err)
+	}
+}
+
+func TestUpdateExportDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		block   []string
+		want    []string
+		wantErr error
+	}{
+		{"single", []string{"export EDITOR='vi'"}, []string{"export EDITOR=vim"}, nil},
+		{"later duplicates dropped", []string{
+			"export EDITOR='vi'", "export PAGER='less'", "export EDITOR='nano'", "export EDITOR='ed'",
+		}, []string{"export EDITOR=vim", "export PAGER='less'"}, nil},
+		{"form of the first kept", []string{
+			"declare -x EDITOR='vi'", "export EDITOR='nano'",
+		}, []string{"declare -x EDITOR=vim"}, nil},
+		{"indentation kept", []string{"  export EDITOR='vi'", "export EDITOR='nano'"}, []string{"  export EDITOR=vim"}, nil},
+		{"alias of the same name untouched", []string{
+			"alias EDITOR='vi'", "export EDITOR='vi'",
+		}, []string{"alias EDITOR='vi'", "export EDITOR=vim"}, nil},
+		{"not exported", []string{"export PAGER='less'"}, []string{"export PAGER='less'"}, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys := newTestManager(t, managedRC(tt.block...))
+			err := m.UpdateExport("EDITOR", "vim", ExportOptions{})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := readTestFile(t, fsys, m.RCFile), managedRC(tt.want...); got != want {
+				t.Errorf("rc file =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestExportQuoting(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		opts  ExportOptions
+		line  string
+		shell string // what sh sees with HOME=/h
+	}{
+		{"plain", "vim", ExportOptions{}, "export V=vim", "vim"},
+		{"reference expands", "$HOME:/x", ExportOptions{}, `export V="$HOME:/x"`, "/h:/x"},
+		{"raw", "$HOME:/x", ExportOptions{Raw: true}, "export V=$HOME:/x", "/h:/x"},
+		{"single keeps it literal", "$HOME:/x", ExportOptions{Quote: "single"}, `export V='$HOME:/x'`, "$HOME:/x"},
+		{"semicolon", "a;echo pwned", ExportOptions{}, `export V='a;echo pwned'`, "a;echo pwned"},
+		{"single quote", "it's", ExportOptions{}, `export V='it'\''s'`, "it's"},
+		{"double quotes", `say "hi"`, ExportOptions{}, `export V='say "hi"'`, `say "hi"`},
+		{"glob", "*.txt", ExportOptions{}, "export V='*.txt'", "*.txt"},
+		{"backquote", "`id`", ExportOptions{}, "export V='`id`'", "`id`"},
+		{"empty", "", ExportOptions{}, "export V=''", ""},
+	}
+	sh, shErr := exec.LookPath("sh")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exportLine("export ", "V", tt.value, tt.opts); got != tt.line {
+				t.Errorf("line = %s, want %s", got, tt.line)
+			}
+			if shErr != nil {
+				return
+			}
+			dir := t.TempDir()
+			rc := filepath.Join(dir, "rc")
+			disk := &Manager{RCFile: rc, BackupDir: dir}
+			if _, err := disk.AddExport("V", tt.value, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command(sh, "-c", `. "$1" && printf %s "$V"`, "sh", rc)
+			cmd.Env = []string{"HOME=/h", "PATH=" + os.Getenv("PATH")}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatalf("sourcing %s: %v", readTestFile(t, disk.fsys(), rc), err)
+			}
+			if string(out) != tt.shell {
+				t.Errorf("sh sees %q, want %q", out, tt.shell)
+			}
+		})
+	}
+
+	// names the shell can't export and values that would spill onto a
+	// second line are refused before anything is written
+	invalidTests := []struct{ name, varName, value string }{
+		{"empty name", "", "x"},
+		{"leading digit", "1V", "x"},
+		{"dash", "MY-VAR", "x"},
+		{"space", "V; rm -rf ~", "x"},
+		{"newline", "V", "a\nexport W=pwned"},
+		{"carriage return", "V", "a\r"},
+	}
+	for _, tt := range invalidTests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := managedRC("export V=old")
+			m, _ := newTestManager(t, rc)
+			if _, err := m.AddExport(tt.varName, tt.value, ExportOptions{}); !errors.Is(err, ErrInvalid) {
+				t.Errorf("AddExport = %v, want ErrInvalid", err)
+			}
+			if err := m.UpdateExport(tt.varName, tt.value, ExportOptions{}); !errors.Is(err, ErrInvalid) {
+				t.Errorf("UpdateExport = %v, want ErrInvalid", err)
+			}
+			if _, err := m.ExportLine(tt.varName, tt.value, ExportOptions{}); !errors.Is(err, ErrInvalid) {
+				t.Errorf("ExportLine = %v, want ErrInvalid", err)
+			}
+			if got := readTestFile(t, m.FS, m.RCFile); got != rc {
+				t.Errorf("rc file changed:\n%s", got)
+			}
+		})
+	}
+}
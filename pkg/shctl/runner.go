@@ -0,0 +1,61 @@
+package shctl
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// ----------------- External commands -----------------
+
+// CommandRunner runs the external programs the sudoers operations need
+// (visudo, and sudo or another PrivCmd for files under /etc), and git for
+// the sync operations. Replacing it lets those operations run without
+// root or a real visudo, e.g. in tests.
+type CommandRunner interface {
+	// Run runs name with args and returns its combined stdout and stderr.
+	// A non-zero exit status is reported as an error.
+	Run(name string, args ...string) ([]byte, error)
+}
+
+// DefaultCommandTimeout bounds external commands when
+// Manager.CommandTimeout is zero.
+const DefaultCommandTimeout = 30 * time.Second
+
+// ExecRunner is the CommandRunner used when Manager.Runner is nil.
+type ExecRunner struct {
+	// Timeout kills a command still running after it; zero waits forever.
+	Timeout time.Duration
+}
+
+// Run runs name through os/exec. A command killed for running past
+// Timeout is reported with an error wrapping context.DeadlineExceeded.
+func (r ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	// a child left holding the output pipe (sudo's command) mustn't keep us
+	// waiting once the command itself is killed
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return out, fmt.Errorf("%s killed after %s without finishing: %w", name, r.Timeout, ctx.Err())
+	}
+	return out, err
+}
+
+func (m *Manager) runner() CommandRunner {
+	if m.Runner != nil {
+		return m.Runner
+	}
+	timeout := m.CommandTimeout
+	if timeout == 0 {
+		timeout = DefaultCommandTimeout
+	}
+	return ExecRunner{Timeout: timeout}
+}
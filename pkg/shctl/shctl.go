@@ -0,0 +1,150 @@
+// Package shctl manages shell aliases and exports in rc files and user specs
+// in sudoers files. It is the library behind the shctl command: every
+// operation works on the paths configured in a Manager and reports through
+// return values (and the Manager's writers) instead of printing or exiting.
+package shctl
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Manager performs operations on one rc file, one sudoers file (with the
+// sudoers.d drop-ins next to it) and one backup directory. RCFile must be
+// set; every other field has a usable zero value. A Manager must not be
+// copied after first use.
+type Manager struct {
+	// RCFile is the shell startup file aliases and exports are written to.
+	RCFile string
+	// SudoersFile is the sudoers file; empty means /etc/sudoers.
+	SudoersFile string
+	// BackupDir receives backups; empty means os.TempDir().
+	BackupDir string
+	// ConfigFile is the tool's config file, backed up on request.
+	ConfigFile string
+	// JournalDir holds the undo journal; empty means no journal. Only the
+	// newest JournalDepth runs are kept (zero means DefaultJournalDepth).
+	JournalDir   string
+	JournalDepth int
+	// Command describes the invocation in the journal, e.g. "alias add ll".
+	Command string
+	// AuditLog receives a JSON line for every change made to the sudoers
+	// file or a drop-in; empty means no audit log.
+	AuditLog string
+	// Shell selects the syntax written: "bash", "zsh" or "fish". Empty
+	// means bash.
+	Shell string
+	// Visudo is the visudo binary; empty means visudo from PATH.
+	Visudo string
+	// PrivCmd runs cp, install and rm for the files under /etc the user
+	// can't write: "sudo", "doas", "pkexec" or a path to one of them.
+	// Empty means sudo.
+	PrivCmd string
+	// Runner runs visudo and PrivCmd; nil means ExecRunner.
+	Runner CommandRunner
+	// CommandTimeout kills visudo or sudo still running after it (e.g.
+	// sudo waiting for a password nobody will type); zero means
+	// DefaultCommandTimeout, negative waits forever. Only ExecRunner
+	// enforces it.
+	CommandTimeout time.Duration
+	// FS holds every file read or written; nil means OSFS.
+	FS FS
+	// AliasPrefixes and ExportPrefixes are the line prefixes recognized as
+	// entries; the first one is used when writing POSIX syntax. Nil means
+	// DefaultAliasPrefixes and DefaultExportPrefixes.
+	AliasPrefixes  []string
+	ExportPrefixes []string
+	// ManagedBegin and ManagedEnd are the comment lines around the managed
+	// block; empty means DefaultManagedBegin and DefaultManagedEnd. Set
+	// them through SetManagedMarkers, which validates them.
+	ManagedBegin string
+	ManagedEnd   string
+
+	// DryRun turns every write into a call to Preview.
+	DryRun bool
+	// Preview receives the unified diff each skipped write would have made
+	// ("" when it would change nothing). Nil prints the diff to Stdout.
+	Preview func(path, diff string)
+
+	// Stdout receives progress notices (backups taken, backups missing)
+	// and the output of PrivCmd; Stderr receives warnings. Nil discards.
+	Stdout io.Writer
+	Stderr io.Writer
+	// Verbose reports visudo's warnings even when validation passes.
+	Verbose bool
+	// SyntaxCheck refuses to write an alias or export change that leaves
+	// the rc file failing CheckSyntax.
+	SyntaxCheck bool
+	// FileMode is the permission bits, before the umask, of the rc file and
+	// the other files the tool creates; zero means 0644. Existing files
+	// keep their mode.
+	FileMode fs.FileMode
+	// FollowSymlinks makes writes to a file that is a symlink (e.g. an rc
+	// file linked into a dotfiles repo) replace the file it points to.
+	// Without it such writes are refused, as replacing the file would
+	// turn the link into a regular file.
+	FollowSymlinks bool
+
+	// Retries is how many times transient file errors (EAGAIN, ESTALE,
+	// ...) are retried, RetryDelay apart at first and doubling each time.
+	Retries    int
+	RetryDelay time.Duration
+	// LockTimeout bounds the wait for another process holding the lock on
+	// a file; zero means 10s.
+	LockTimeout time.Duration
+
+	docsMu sync.Mutex
+	docs   map[string]*RCDocument
+
+	journalMu  sync.Mutex
+	journalRun *JournalEntry
+	undoing    bool
+}
+
+// SudoersPath returns the sudoers file in use.
+func (m *Manager) SudoersPath() string {
+	if m.SudoersFile != "" {
+		return m.SudoersFile
+	}
+	return "/etc/sudoers"
+}
+
+func (m *Manager) backupDir() string {
+	if m.BackupDir != "" {
+		return m.BackupDir
+	}
+	return os.TempDir()
+}
+
+func (m *Manager) fileMode() fs.FileMode {
+	if m.FileMode != 0 {
+		return m.FileMode.Perm()
+	}
+	return 0o644
+}
+
+func (m *Manager) shell() string {
+	if m.Shell != "" {
+		return filepath.Base(m.Shell)
+	}
+	return "bash"
+}
+
+// notef writes a progress notice to Stdout.
+func (m *Manager) notef(format string, a ...any) {
+	if m.Stdout != nil {
+		fmt.Fprintf(m.Stdout, format, a...)
+	}
+}
+
+// warnf writes a warning to Stderr.
+func (m *Manager) warnf(format string, a ...any) {
+	if m.Stderr != nil {
+		fmt.Fprintf(m.Stderr, format, a...)
+	}
+}
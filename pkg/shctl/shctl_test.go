@@ -0,0 +1,69 @@
+package shctl
+
+import (
+	"testing"
+)
+
+// newTestManager returns a Manager whose files all live in a MemFS, with
+// rc as the content of its rc file ("" leaves the file missing).
+func newTestManager(t testing.TB, rc string) (*Manager, *MemFS) {
+	t.Helper()
+	fsys := &MemFS{}
+	m := &Manager{
+		RCFile:      "/home/u/.bashrc",
+		SudoersFile: "/etc/sudoers",
+		BackupDir:   "/home/u/backups",
+		FS:          fsys,
+		Runner:      &fakeRunner{},
+	}
+	if rc != "" {
+		writeTestFile(t, fsys, m.RCFile, rc)
+	}
+	return m, fsys
+}
+
+func writeTestFile(t testing.TB, fsys FS, path, content string) {
+	t.Helper()
+	if err := fsys.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t testing.TB, fsys FS, path string) string {
+	t.Helper()
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// fakeRunner records the commands it is asked to run and answers them
+// through run; a nil run succeeds with no output.
+type fakeRunner struct {
+	calls [][]string
+	run   func(name string, args ...string) ([]byte, error)
+}
+
+func (r *fakeRunner) Run(name string, args ...string) ([]byte, error) {
+	r.calls = append(r.calls, append([]string{name}, args...))
+	if r.run == nil {
+		return nil, nil
+	}
+	return r.run(name, args...)
+}
+
+// containsLine reports whether content has line as one of its lines.
+func containsLine(content, line string) bool {
+	for _, ln := range splitLines(content) {
+		if ln == line {
+			return true
+		}
+	}
+	return false
+}
+
+// managedRC returns rc file content whose managed block holds lines.
+func managedRC(lines ...string) string {
+	return joinLines(append(append([]string{"# hand-written", DefaultManagedBegin}, lines...), DefaultManagedEnd))
+}
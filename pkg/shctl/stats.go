@@ -0,0 +1,93 @@
+package shctl
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+)
+
+// ----------------- Stats -----------------
+
+// Stats summarizes what the tool manages.
+type Stats struct {
+	Aliases int `json:"aliases"` // distinct names in the managed block
+	Exports int `json:"exports"`
+	// SudoersRules counts the non-comment lines of the sudoers file and
+	// its drop-ins; SudoersError says why they couldn't be read (e.g.
+	// permission denied), in which case both counts are zero.
+	SudoersRules int    `json:"sudoers_rules"`
+	DropIns      int    `json:"drop_ins"`
+	SudoersError string `json:"sudoers_error,omitempty"`
+	Backups      int    `json:"backups"`
+	// BackupBytes is the size of everything in the backup dir, checksums
+	// included.
+	BackupBytes int64  `json:"backup_bytes"`
+	BackupDir   string `json:"backup_dir"`
+}
+
+// Stats counts the managed aliases and exports, the sudoers rules and the
+// backups. Sudoers that can't be read are reported in SudoersError rather
+// than failing the whole summary.
+func (m *Manager) Stats() (Stats, error) {
+	st := Stats{BackupDir: m.backupDir()}
+	for _, k := range []struct {
+		kind string
+		n    *int
+	}{{"alias", &st.Aliases}, {"export", &st.Exports}} {
+		es, err := m.Entries(k.kind, nil)
+		if err != nil {
+			return st, err
+		}
+		*k.n = len(DedupeEntries(es))
+	}
+	files, err := m.SudoersRules("")
+	if err != nil {
+		st.SudoersError = err.Error()
+	}
+	for i, f := range files {
+		st.SudoersRules += len(f.Lines)
+		if i > 0 {
+			st.DropIns++
+		}
+	}
+	backups, err := m.Backups()
+	if err != nil {
+		return st, err
+	}
+	st.Backups = len(backups)
+	st.BackupBytes, err = m.dirSize(st.BackupDir)
+	return st, err
+}
+
+// dirSize adds up the sizes of the regular files under dir; a missing dir
+// is empty.
+func (m *Manager) dirSize(dir string) (int64, error) {
+	ents, err := m.fsys().ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range ents {
+		p := filepath.Join(dir, e.Name())
+		if e.IsDir() {
+			n, err := m.dirSize(p)
+			if err != nil {
+				return total, err
+			}
+			total += n
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return total, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
@@ -0,0 +1,846 @@
+package shctl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// ----------------- Sudoers -----------------
+
+// ErrSudoersUnsupported is what the sudoers operations return where
+// SudoersSupported is false.
+var ErrSudoersUnsupported = fmt.Errorf("sudoers isn't supported on %s; aliases, exports and rc file backups still work", runtime.GOOS)
+
+// VisudoPath locates visudo (Manager.Visudo, or visudo in PATH). With a
+// custom Runner the name is passed to it as is.
+func (m *Manager) VisudoPath() (string, error) {
+	if !SudoersSupported {
+		return "", ErrSudoersUnsupported
+	}
+	name := m.Visudo
+	if name == "" {
+		name = "visudo"
+	}
+	if m.Runner != nil {
+		return name, nil
+	}
+	visudo, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("visudo not found (%s): install sudo, or set BASM_VISUDO_PATH to its location", name)
+	}
+	return visudo, nil
+}
+
+// visudoValidate checks path with visudo -c -f. Without a visudo binary it
+// fails, so sudoers is never written unvalidated.
+func (m *Manager) visudoValidate(path string) error {
+	visudo, err := m.VisudoPath()
+	if err != nil {
+		return err
+	}
+	out, err := m.runner().Run(visudo, "-c", "-f", path)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// not a verdict on the file
+		return err
+	} else if err != nil {
+		return invalid(fmt.Errorf("visudo error: %s (%w)", strings.TrimSpace(string(out)), err))
+	}
+	// visudo can print warnings (e.g. deprecations) and still exit 0
+	if msg := strings.TrimSpace(string(out)); m.Verbose && msg != "" {
+		m.warnf("visudo: %s\n", msg)
+	}
+	return nil
+}
+
+// SudoersSpec describes a single user spec line to build.
+type SudoersSpec struct {
+	User     string
+	Hosts    []string
+	RunAs    string
+	NoPasswd bool
+	Commands []string
+}
+
+// BuildSudoersEntry renders spec as "user h1,h2=(runas) [NOPASSWD: ]cmd, cmd".
+func BuildSudoersEntry(spec SudoersSpec) (string, error) {
+	if spec.User == "" || strings.ContainsAny(spec.User, " \t,=") {
+		return "", invalid(fmt.Errorf("invalid user %q", spec.User))
+	}
+	if len(spec.Hosts) == 0 {
+		return "", invalid(errors.New("at least one host is required"))
+	}
+	for _, h := range spec.Hosts {
+		if strings.TrimSpace(h) == "" {
+			return "", invalid(errors.New("host list contains an empty host"))
+		}
+		if strings.ContainsAny(h, " \t=") {
+			return "", invalid(fmt.Errorf("invalid host %q", h))
+		}
+	}
+	if len(spec.Commands) == 0 {
+		return "", invalid(errors.New("at least one --command is required"))
+	}
+	for _, c := range spec.Commands {
+		if c != "ALL" && !strings.HasPrefix(c, "/") {
+			return "", invalid(fmt.Errorf("command %q must be an absolute path or ALL", c))
+		}
+	}
+	runas := spec.RunAs
+	if runas == "" {
+		runas = "ALL"
+	}
+	tags := ""
+	if spec.NoPasswd {
+		tags = "NOPASSWD: "
+	}
+	return fmt.Sprintf("%s %s=(%s) %s%s", spec.User, strings.Join(spec.Hosts, ","), runas, tags,
+		strings.Join(spec.Commands, ", ")), nil
+}
+
+// sudoersTags are the tags sudo accepts before a command.
+var sudoersTags = map[string]bool{
+	"NOPASSWD": true, "PASSWD": true, "NOEXEC": true, "EXEC": true,
+	"SETENV": true, "NOSETENV": true, "LOG_INPUT": true, "NOLOG_INPUT": true,
+	"LOG_OUTPUT": true, "NOLOG_OUTPUT": true, "MAIL": true, "NOMAIL": true,
+	"FOLLOW": true, "NOFOLLOW": true, "INTERCEPT": true, "NOINTERCEPT": true,
+}
+
+// CheckSudoersEntry is a quick structural check of a line about to be
+// added to sudoers: a user spec must look like "user host=(runas) command",
+// an alias definition like "Cmnd_Alias NAME = ...". It catches obvious
+// mistakes with a clearer message than visudo's, and without running it,
+// but passing it doesn't make the entry valid: visudo still decides.
+func CheckSudoersEntry(entry string) error {
+	const want = `expected "user host=(runas) command"`
+	e := strings.TrimSpace(entry)
+	switch {
+	case e == "":
+		return invalid(errors.New("sudoers entry is empty"))
+	case strings.ContainsAny(e, "\r\n"):
+		return invalid(errors.New("sudoers entry must be a single line"))
+	}
+	if _, ok := includeDirective(e); ok {
+		return nil
+	}
+	if strings.HasPrefix(e, "#") {
+		return invalid(fmt.Errorf("sudoers entry %q is a comment", e))
+	}
+	first := strings.Fields(e)[0]
+	if first == "Defaults" || strings.HasPrefix(first, "Defaults") && strings.ContainsAny(first[8:9], ":@!>") {
+		return nil
+	}
+	left, right, ok := strings.Cut(e, "=")
+	if !ok {
+		return invalid(fmt.Errorf("sudoers entry %q has no \"=\": %s", e, want))
+	}
+	if _, ok := aliasKinds[first]; ok {
+		name := strings.TrimSpace(strings.TrimPrefix(left, first))
+		if !sudoersAliasNameRe.MatchString(name) {
+			return invalid(fmt.Errorf("alias name %q must be upper case letters, digits and _, starting with a letter", name))
+		}
+		if strings.TrimSpace(right) == "" {
+			return invalid(fmt.Errorf("alias %s has no members", name))
+		}
+		return nil
+	}
+	left = strings.Join(strings.Fields(strings.ReplaceAll(left, ", ", ",")), " ")
+	if n := len(strings.Fields(left)); n != 2 {
+		return invalid(fmt.Errorf("sudoers entry %q needs a user list and a host list before \"=\", found %d word(s): %s", e, n, want))
+	}
+	cmnds := splitCmndList(right)
+	if len(cmnds) == 0 {
+		return invalid(fmt.Errorf("sudoers entry %q has no command after \"=\": %s", e, want))
+	}
+	for _, c := range cmnds {
+		if strings.HasPrefix(c, "(") {
+			i := strings.Index(c, ")")
+			if i < 0 {
+				return invalid(fmt.Errorf("unclosed \"(\" in runas spec of %q", c))
+			}
+			c = strings.TrimSpace(c[i+1:])
+		}
+		// options such as CWD=/srv or TIMEOUT=1m
+		for {
+			opt, rest, _ := strings.Cut(c, " ")
+			if k, _, ok := strings.Cut(opt, "="); !ok || k == "" || strings.ToUpper(k) != k {
+				break
+			}
+			c = strings.TrimSpace(rest)
+		}
+		for {
+			tag, rest, ok := strings.Cut(c, ":")
+			if !ok || tag == "" || strings.ToUpper(tag) != tag || strings.ContainsAny(tag, " /!") {
+				break
+			}
+			if !sudoersTags[tag] {
+				return invalid(fmt.Errorf("unknown tag %q (known tags include NOPASSWD, PASSWD, NOEXEC, SETENV)", tag+":"))
+			}
+			c = strings.TrimSpace(rest)
+		}
+		cmd := strings.TrimSpace(strings.TrimPrefix(c, "!"))
+		name, _, _ := strings.Cut(cmd, " ")
+		if digestRe.MatchString(name) {
+			_, cmd, _ = strings.Cut(cmd, " ")
+			cmd = strings.TrimSpace(cmd)
+			name, _, _ = strings.Cut(cmd, " ")
+		}
+		switch {
+		case cmd == "":
+			return invalid(fmt.Errorf("sudoers entry %q has an empty command", e))
+		case name == "ALL", name == "sudoedit", strings.HasPrefix(name, "/"), sudoersAliasNameRe.MatchString(name):
+		default:
+			return invalid(fmt.Errorf("command %q must be an absolute path, ALL or a Cmnd_Alias name", cmd))
+		}
+	}
+	return nil
+}
+
+var (
+	// sudoersAliasNameRe matches the names sudo allows for aliases.
+	sudoersAliasNameRe = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	// digestRe matches a digest spec such as sha256:<hash> before a command.
+	digestRe = regexp.MustCompile(`^sha(224|256|384|512):\S+$`)
+)
+
+// splitCmndList splits the command list of a user spec on the commas that
+// separate commands, not those inside a runas spec or escaped with \.
+func splitCmndList(s string) []string {
+	var out []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				if c := strings.TrimSpace(s[start:i]); c != "" {
+					out = append(out, c)
+				}
+				start = i + 1
+			}
+		}
+	}
+	if c := strings.TrimSpace(s[start:]); c != "" {
+		out = append(out, c)
+	}
+	return out
+}
+
+// SudoersEntryRisks explains what makes a user spec entry dangerous, one
+// sentence per risk: NOPASSWD, unrestricted commands (ALL) and wildcards in
+// command paths. An entry without any returns nil.
+func SudoersEntryRisks(entry string) []string {
+	rule, ok := parseUserSpec(SudoersLine{Text: entry})
+	if !ok {
+		return nil
+	}
+	var risks []string
+	_, right, _ := strings.Cut(entry, "=")
+	if strings.Contains(right, "NOPASSWD:") {
+		risks = append(risks, "NOPASSWD: sudo won't ask for a password, so anything running as this user "+
+			"(a compromised browser, a malicious script) can use these commands too")
+	}
+	for _, c := range rule.Cmnds {
+		if c == "ALL" {
+			risks = append(risks, "ALL commands: this grants full root access, equivalent to the root password")
+			break
+		}
+	}
+	for _, c := range rule.Cmnds {
+		if c != "ALL" && strings.ContainsAny(c, "*?[") {
+			risks = append(risks, fmt.Sprintf("wildcard in %q: it matches more paths and arguments than intended "+
+				"and often lets the user run arbitrary commands as root", c))
+		}
+	}
+	return risks
+}
+
+// SudoersAdd appends entry to the sudoers file: copy to temp, append,
+// validate with visudo -c -f <tmp>, then apply.
+func (m *Manager) SudoersAdd(entry string) (err error) {
+	if err := CheckSudoersEntry(entry); err != nil {
+		return err
+	}
+	orig := m.SudoersPath()
+	unlock, err := m.lockFile(orig)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.audit("sudoers add", orig, entry)(&err)
+	tmp, err := m.copyToTemp(orig, orig)
+	if err != nil {
+		return err
+	}
+	defer m.removeTemp(tmp)
+
+	// Append entry
+	if err := m.appendLine(tmp, entry); err != nil {
+		return err
+	}
+
+	// Validate
+	if err := m.visudoValidate(tmp); err != nil {
+		return fmt.Errorf("visudo validation failed: %w", err)
+	}
+
+	// Apply (may need sudo if writing to /etc/sudoers)
+	if err := m.backupBeforeChange(orig); err != nil {
+		return err
+	}
+	return m.commitCopy(tmp, orig)
+}
+
+// SudoersCheck reports whether adding entry to the sudoers file, or to the
+// named drop-in, would pass validation, without changing anything: the
+// entry is appended to a temp copy that visudo checks and that is then
+// thrown away. It returns the file the entry was checked against.
+func (m *Manager) SudoersCheck(file, entry string) (string, error) {
+	path := m.SudoersPath()
+	if file != "" {
+		var err error
+		if path, err = m.DropInPath(file); err != nil {
+			return "", err
+		}
+	}
+	if err := CheckSudoersEntry(entry); err != nil {
+		return path, err
+	}
+	tmp, err := m.copyToTemp(path, path)
+	if file != "" && errors.Is(err, fs.ErrNotExist) {
+		// a new drop-in starts out empty
+		var f File
+		if f, err = m.createTemp("", "sudoers_*"); err == nil {
+			tmp, err = f.Name(), f.Close()
+		}
+	}
+	if err != nil {
+		return path, err
+	}
+	defer m.removeTemp(tmp)
+	if err := m.appendLine(tmp, entry); err != nil {
+		return path, err
+	}
+	if err := m.visudoValidate(tmp); err != nil {
+		return path, fmt.Errorf("visudo validation failed: %w", err)
+	}
+	return path, nil
+}
+
+// SudoersRemove removes the sudoers lines containing pattern, if the
+// result still validates.
+func (m *Manager) SudoersRemove(pattern string) error {
+	pat := []byte(pattern)
+	return m.sudoersRemove("sudoers remove", pattern, func(_ int, ln []byte) bool { return bytes.Contains(ln, pat) })
+}
+
+// SudoersRemoveRegexp removes the sudoers lines matching the regular
+// expression pattern, if the result still validates. An invalid pattern
+// fails before anything is read or written.
+func (m *Manager) SudoersRemoveRegexp(pattern string) error {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return err
+	}
+	return m.sudoersRemove("sudoers remove --regex", pattern, func(_ int, ln []byte) bool { return re.Match(ln) })
+}
+
+// compilePattern compiles a user-supplied regular expression.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, invalid(fmt.Errorf("invalid pattern %q: %w", pattern, err))
+	}
+	return re, nil
+}
+
+func (m *Manager) sudoersRemove(op, pattern string, match func(n int, ln []byte) bool) (err error) {
+	orig := m.SudoersPath()
+	unlock, err := m.lockFile(orig)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer m.audit(op, orig, pattern)(&err)
+	tmp, err := m.removeLinesToTemp(orig, match)
+	if err != nil {
+		return err
+	}
+	defer m.removeTemp(tmp)
+
+	// Validate
+	if err := m.visudoValidate(tmp); err != nil {
+		return fmt.Errorf("visudo validation failed after removal: %w", err)
+	}
+
+	// Apply
+	if err := m.backupBeforeChange(orig); err != nil {
+		return err
+	}
+	return m.commitCopy(tmp, orig)
+}
+
+// SudoersRemoveLine removes line n (counting from 1, as SudoersFile.Nums
+// does) from the file it is numbered in by SudoersRules, if the result
+// still validates. file names a drop-in or is the path of any file
+// SudoersRules lists; without it, n must number a rule in exactly one of
+// them. It returns the file and the line removed. A drop-in left without
+// rules is deleted.
+func (m *Manager) SudoersRemoveLine(file string, n int) (path, line string, err error) {
+	if path, err = m.sudoersLineFile(file, n); err != nil {
+		return path, "", err
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return path, "", err
+	}
+	defer unlock()
+	defer m.audit("sudoers remove --line", path, fmt.Sprintf("line %d", n))(&err)
+	data, err := m.readFileRetry(path)
+	if err != nil {
+		return path, "", err
+	}
+	lines := splitLines(string(data))
+	if n < 1 || n > len(lines) {
+		return path, "", notFound(fmt.Errorf("%s has %d lines, no line %d", path, len(lines), n))
+	}
+	line = lines[n-1]
+	if path != m.SudoersPath() {
+		i := 0
+		out := dropLines(lines, func(string) bool { i++; return i == n })
+		if !hasSudoersRules(out) && filepath.Dir(path) == m.DropInDir() {
+			return path, line, m.removeDropIn(path)
+		}
+		return path, line, m.installDropIn(path, joinLines(out))
+	}
+
+	tmp, err := m.removeLinesToTemp(path, func(i int, _ []byte) bool { return i == n })
+	if err != nil {
+		return path, "", err
+	}
+	defer m.removeTemp(tmp)
+	if err := m.visudoValidate(tmp); err != nil {
+		return path, "", fmt.Errorf("visudo validation failed after removal: %w", err)
+	}
+	if err := m.backupBeforeChange(path); err != nil {
+		return path, "", err
+	}
+	return path, line, m.commitCopy(tmp, path)
+}
+
+// sudoersLineFile returns the file whose line n SudoersRemoveLine removes:
+// the drop-in named file, the listed file at path file, or the one listed
+// file in which n numbers a rule. The same n numbering rules in several
+// files is refused, as removing from any one of them would be a guess.
+func (m *Manager) sudoersLineFile(file string, n int) (string, error) {
+	if file != "" && !strings.ContainsAny(file, `/\`) {
+		return m.DropInPath(file)
+	}
+	files, err := m.SudoersRules("")
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	for _, f := range files {
+		switch {
+		case file != "" && f.Path == filepath.Clean(file):
+			return f.Path, nil
+		case file == "" && containsInt(f.Nums, n):
+			paths = append(paths, f.Path)
+		}
+	}
+	switch {
+	case file != "":
+		return "", notFound(fmt.Errorf("%s is not one of the files sudoers list shows", file))
+	case len(paths) == 0:
+		return "", notFound(fmt.Errorf("no sudoers rule is numbered %d (see sudoers list --numbers)", n))
+	case len(paths) > 1:
+		return "", invalid(fmt.Errorf("line %d numbers a rule in each of %s; pick one with --file", n, strings.Join(paths, ", ")))
+	}
+	return paths[0], nil
+}
+
+func containsInt(ns []int, n int) bool {
+	for _, k := range ns {
+		if k == n {
+			return true
+		}
+	}
+	return false
+}
+
+// EditSudoers works like visudo on the sudoers file (or the named drop-in):
+// edit is called on a temp copy, which is validated before it is applied.
+// When validation fails, again decides whether to call edit once more; if
+// it returns false nothing is changed. It returns the edited file and
+// whether its content changed.
+func (m *Manager) EditSudoers(file string, edit func(tmp string) error, again func(error) bool) (path string, changed bool, err error) {
+	path = m.SudoersPath()
+	if file != "" {
+		if path, err = m.DropInPath(file); err != nil {
+			return "", false, err
+		}
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return path, false, err
+	}
+	defer unlock()
+	defer m.audit("sudoers edit", path, "")(&err)
+	orig, err := m.readFileRetry(path)
+	if file != "" && errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return path, false, err
+	}
+	tmp, err := m.tempFileNear(path)
+	if err != nil {
+		return path, false, err
+	}
+	defer m.removeTemp(tmp.Name())
+	_, err = tmp.Write(orig)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return path, false, err
+	}
+
+	for {
+		if err := edit(tmp.Name()); err != nil {
+			return path, false, err
+		}
+		err := m.visudoValidate(tmp.Name())
+		if err == nil {
+			break
+		}
+		if !again(err) {
+			return path, false, fmt.Errorf("%s not changed", path)
+		}
+	}
+
+	edited, err := m.fsys().ReadFile(tmp.Name())
+	if err != nil {
+		return path, false, err
+	}
+	if string(edited) == string(orig) {
+		return path, false, nil
+	}
+	if file != "" {
+		err = m.installDropIn(path, string(edited))
+	} else if err = m.backupBeforeChange(path); err == nil {
+		err = m.commitCopy(tmp.Name(), path)
+	}
+	return path, err == nil, err
+}
+
+// SudoersFile is a sudoers file and its non-comment lines, include
+// directives left out.
+type SudoersFile struct {
+	Path  string
+	Lines []string
+	// Nums holds the line number in the file, from 1, of each of Lines.
+	Nums []int
+	// Unused marks a drop-in in DropInDir that the sudoers file doesn't
+	// include, so sudo ignores it.
+	Unused bool
+}
+
+// SudoersRules returns the non-comment lines of the main sudoers file and
+// of every file it includes (#include, #includedir and their @ forms,
+// followed as sudo does), in the order sudo reads them. Drop-ins in
+// DropInDir that nothing includes come last, marked Unused. With file,
+// only that drop-in is read.
+func (m *Manager) SudoersRules(file string) ([]SudoersFile, error) {
+	if !SudoersSupported {
+		return nil, ErrSudoersUnsupported
+	}
+	var paths []string
+	unused := map[string]bool{}
+	if file != "" {
+		p, err := m.DropInPath(file)
+		if err != nil {
+			return nil, err
+		}
+		paths = []string{p}
+	} else {
+		seen := map[string]bool{}
+		if err := m.sudoersIncludes(m.SudoersPath(), 0, seen, &paths); err != nil {
+			return nil, err
+		}
+		dropIns, err := m.DropIns()
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range dropIns {
+			if !seen[p] {
+				paths = append(paths, p)
+				unused[p] = true
+			}
+		}
+	}
+	var out []SudoersFile
+	for _, path := range paths {
+		f, err := m.openRetry(path)
+		if err != nil {
+			return nil, err
+		}
+		sf := SudoersFile{Path: path, Unused: unused[path]}
+		sc := bufio.NewScanner(f)
+		for n := 1; sc.Scan(); n++ {
+			line := sc.Text()
+			s := strings.TrimSpace(line)
+			if _, inc := includeDirective(s); inc || s == "" || strings.HasPrefix(s, "#") {
+				continue
+			}
+			sf.Lines = append(sf.Lines, line)
+			sf.Nums = append(sf.Nums, n)
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, sf)
+	}
+	return out, nil
+}
+
+// ----------------- Sudoers drop-ins -----------------
+//
+// Drop-ins are files in the sudoers.d directory next to the sudoers file
+// (/etc/sudoers.d by default), read by sudo through #includedir. Each one is
+// validated on its own and installed with mode 0440.
+
+// sudoersIncludes appends path and, recursively, the files it includes to
+// paths, each once.
+func (m *Manager) sudoersIncludes(path string, depth int, seen map[string]bool, paths *[]string) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: includes nested too deeply", path)
+	}
+	if seen[path] {
+		return nil
+	}
+	seen[path] = true
+	*paths = append(*paths, path)
+	data, err := m.readFileRetry(path)
+	if err != nil {
+		return err
+	}
+	for _, ln := range splitLines(string(data)) {
+		dir, ok := includeDirective(strings.TrimSpace(ln))
+		if !ok {
+			continue
+		}
+		files, err := m.includedFiles(path, dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if err := m.sudoersIncludes(f, depth+1, seen, paths); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DropInDir returns the sudoers.d directory next to the sudoers file.
+func (m *Manager) DropInDir() string {
+	return filepath.Join(filepath.Dir(m.SudoersPath()), "sudoers.d")
+}
+
+// ValidDropInName rejects names sudo would silently skip: #includedir
+// ignores files containing a '.' or ending in '~'.
+func ValidDropInName(name string) error {
+	if name == "" || strings.ContainsAny(name, "./") || strings.HasSuffix(name, "~") {
+		return invalid(fmt.Errorf("invalid drop-in name %q: must not be empty, contain '.' or '/', or end in '~'", name))
+	}
+	return nil
+}
+
+// DropInPath returns the path of the named drop-in.
+func (m *Manager) DropInPath(name string) (string, error) {
+	if err := ValidDropInName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(m.DropInDir(), name), nil
+}
+
+// DropIns returns the drop-ins sudo would read, sorted by name. A missing
+// sudoers.d directory has no drop-ins.
+func (m *Manager) DropIns() ([]string, error) {
+	dir := m.DropInDir()
+	ents, err := m.fsys().ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range ents {
+		if e.IsDir() || ValidDropInName(e.Name()) != nil {
+			continue
+		}
+		out = append(out, filepath.Join(dir, e.Name()))
+	}
+	return out, nil
+}
+
+// DropInAdd appends entry to the named drop-in, creating it with
+// DropInMarker as its first line if needed, and returns its path.
+func (m *Manager) DropInAdd(name, entry string) (path string, err error) {
+	path, err = m.DropInPath(name)
+	if err != nil {
+		return "", err
+	}
+	if err := CheckSudoersEntry(entry); err != nil {
+		return path, err
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return path, err
+	}
+	defer unlock()
+	defer m.audit("drop-in add", path, entry)(&err)
+	cur, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return path, err
+	}
+	content := string(cur)
+	switch {
+	case content == "":
+		content = DropInMarker + "\n"
+	case !strings.HasSuffix(content, "\n"):
+		content += "\n"
+	}
+	return path, m.installDropIn(path, content+entry+"\n")
+}
+
+// DropInRemove removes the lines containing pattern from the named drop-in,
+// or the whole drop-in when pattern is empty. A drop-in left without rules
+// is deleted, which deleted reports.
+func (m *Manager) DropInRemove(name, pattern string) (path string, deleted bool, err error) {
+	var match func(string) bool
+	if pattern != "" {
+		match = func(ln string) bool { return strings.Contains(ln, pattern) }
+	}
+	return m.dropInRemove("drop-in remove", name, pattern, match)
+}
+
+// DropInRemoveRegexp is DropInRemove with lines matching the regular
+// expression pattern, which must not be empty.
+func (m *Manager) DropInRemoveRegexp(name, pattern string) (path string, deleted bool, err error) {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return "", false, err
+	}
+	return m.dropInRemove("drop-in remove --regex", name, pattern, re.MatchString)
+}
+
+// dropInRemove removes the lines of the named drop-in for which match
+// returns true, or the whole drop-in when match is nil. op and pattern
+// are what the audit log records.
+func (m *Manager) dropInRemove(op, name, pattern string, match func(string) bool) (path string, deleted bool, err error) {
+	path, err = m.DropInPath(name)
+	if err != nil {
+		return "", false, err
+	}
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return path, false, err
+	}
+	defer unlock()
+	defer m.audit(op, path, pattern)(&err)
+	data, err := m.readFileRetry(path)
+	if err != nil {
+		return path, false, err
+	}
+	var out []string
+	rules := false
+	if match != nil {
+		out = dropLines(splitLines(string(data)), match)
+		rules = hasSudoersRules(out)
+	}
+	if !rules {
+		return path, true, m.removeDropIn(path)
+	}
+	return path, false, m.installDropIn(path, joinLines(out))
+}
+
+// hasSudoersRules reports whether lines hold anything but blanks and
+// comments.
+func hasSudoersRules(lines []string) bool {
+	for _, ln := range lines {
+		if t := strings.TrimSpace(ln); t != "" && !strings.HasPrefix(t, "#") {
+			return true
+		}
+	}
+	return false
+}
+
+// installDropIn validates content with visudo and writes it to path with
+// mode 0440, through PrivCmd when the directory isn't writable.
+func (m *Manager) installDropIn(path, content string) error {
+	tmp, err := m.createTemp("", "sudoers_*")
+	if err != nil {
+		return err
+	}
+	defer m.removeTemp(tmp.Name())
+	_, err = io.WriteString(tmp, content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := m.visudoValidate(tmp.Name()); err != nil {
+		return fmt.Errorf("visudo validation failed: %w", err)
+	}
+	if m.DryRun {
+		return m.previewWrite(path, content)
+	}
+	if err := m.backupBeforeChange(path); err != nil {
+		return err
+	}
+	m.journal(path)
+	err = m.fsys().MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = m.atomicWriteFileMode(path, content, 0o440)
+	}
+	if errors.Is(err, fs.ErrPermission) {
+		// sudoers.d is normally root's
+		return m.privileged("install", "-m", "0440", tmp.Name(), path)
+	}
+	return err
+}
+
+func (m *Manager) removeDropIn(path string) error {
+	if m.DryRun {
+		return m.previewWrite(path, "")
+	}
+	if err := m.backupBeforeChange(path); err != nil {
+		return err
+	}
+	m.journal(path)
+	err := m.fsys().Remove(path)
+	if errors.Is(err, fs.ErrPermission) {
+		return m.privileged("rm", "-f", path)
+	}
+	return err
+}
@@ -0,0 +1,363 @@
+package shctl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+const testSudoers = "root ALL=(ALL:ALL) ALL\n"
+
+// newSudoersManager returns a test Manager with testSudoers in place and
+// a fake visudo answering through run.
+func newSudoersManager(t *testing.T, run func(name string, args ...string) ([]byte, error)) (*Manager, *MemFS, *fakeRunner) {
+	t.Helper()
+	if !SudoersSupported {
+		t.Skip(ErrSudoersUnsupported)
+	}
+	m, fsys := newTestManager(t, "")
+	writeTestFile(t, fsys, m.SudoersPath(), testSudoers)
+	r := &fakeRunner{run: run}
+	m.Runner = r
+	return m, fsys, r
+}
+
+func TestVisudoWarningsOnSuccess(t *testing.T) {
+	warn := func(string, ...string) ([]byte, error) {
+		return []byte("/etc/sudoers.tmp: parsed OK\nwarning: Runas_Alias \"OLD\" referenced but not defined\n"), nil
+	}
+	tests := []struct {
+		name    string
+		verbose bool
+		op      func(m *Manager) error
+		want    string
+	}{
+		{"add quiet", false, func(m *Manager) error { return m.SudoersAdd("deploy ALL=(ALL) /usr/bin/x") }, ""},
+		{"add verbose", true, func(m *Manager) error { return m.SudoersAdd("deploy ALL=(ALL) /usr/bin/x") },
+			"visudo: /etc/sudoers.tmp: parsed OK\nwarning: Runas_Alias \"OLD\" referenced but not defined\n"},
+		{"remove quiet", false, func(m *Manager) error { return m.SudoersRemove("root") }, ""},
+		{"remove verbose", true, func(m *Manager) error { return m.SudoersRemove("root") },
+			"visudo: /etc/sudoers.tmp: parsed OK\nwarning: Runas_Alias \"OLD\" referenced but not defined\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _, _ := newSudoersManager(t, warn)
+			var stderr bytes.Buffer
+			m.Stderr, m.Verbose = &stderr, tt.verbose
+			if err := tt.op(m); err != nil {
+				t.Fatalf("operation failed: %v", err)
+			}
+			if got := stderr.String(); got != tt.want {
+				t.Errorf("stderr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// visudoArgs returns the arguments of the visudo runs among calls.
+func visudoArgs(calls [][]string) [][]string {
+	var out [][]string
+	for _, c := range calls {
+		if c[0] == "visudo" {
+			out = append(out, c[1:])
+		}
+	}
+	return out
+}
+
+func TestVisudoValidateChecksTempCopy(t *testing.T) {
+	m, _, r := newSudoersManager(t, nil)
+	if err := m.SudoersAdd("deploy ALL=(ALL) /usr/bin/x"); err != nil {
+		t.Fatal(err)
+	}
+	runs := visudoArgs(r.calls)
+	if len(runs) != 1 || len(runs[0]) != 3 || runs[0][0] != "-c" || runs[0][1] != "-f" || !strings.HasPrefix(runs[0][2], "/etc/.sudoers.tmp_") {
+		t.Errorf("visudo runs = %q, want one -c -f on a temp copy next to sudoers", runs)
+	}
+}
+
+func TestBuildSudoersEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    SudoersSpec
+		want    string
+		wantErr bool
+	}{
+		{"one host", SudoersSpec{User: "deploy", Hosts: []string{"ALL"}, Commands: []string{"/usr/bin/x"}},
+			"deploy ALL=(ALL) /usr/bin/x", false},
+		{"multi-host", SudoersSpec{User: "deploy", Hosts: []string{"h1", "h2", "h3"}, Commands: []string{"/usr/bin/x"}},
+			"deploy h1,h2,h3=(ALL) /usr/bin/x", false},
+		{"runas, nopasswd and commands", SudoersSpec{User: "%ops", Hosts: []string{"web1", "web2"}, RunAs: "root",
+			NoPasswd: true, Commands: []string{"/usr/bin/systemctl", "/usr/sbin/service"}},
+			"%ops web1,web2=(root) NOPASSWD: /usr/bin/systemctl, /usr/sbin/service", false},
+		{"empty host", SudoersSpec{User: "deploy", Hosts: []string{"h1", "", "h3"}, Commands: []string{"/usr/bin/x"}}, "", true},
+		{"blank host", SudoersSpec{User: "deploy", Hosts: []string{" "}, Commands: []string{"/usr/bin/x"}}, "", true},
+		{"host with space", SudoersSpec{User: "deploy", Hosts: []string{"h 1"}, Commands: []string{"/usr/bin/x"}}, "", true},
+		{"no hosts", SudoersSpec{User: "deploy", Commands: []string{"/usr/bin/x"}}, "", true},
+		{"no user", SudoersSpec{Hosts: []string{"ALL"}, Commands: []string{"/usr/bin/x"}}, "", true},
+		{"relative command", SudoersSpec{User: "deploy", Hosts: []string{"ALL"}, Commands: []string{"x"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildSudoersEntry(tt.spec)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("BuildSudoersEntry = %q, %v; want ErrInvalid", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("BuildSudoersEntry = %q, %v; want %q", got, err, tt.want)
+			}
+			if err := CheckSudoersEntry(got); err != nil {
+				t.Errorf("CheckSudoersEntry(%q): %v", got, err)
+			}
+		})
+	}
+}
+
+func TestSudoersAddMultiHost(t *testing.T) {
+	m, fsys, _ := newSudoersManager(t, nil)
+	entry, err := BuildSudoersEntry(SudoersSpec{User: "deploy", Hosts: []string{"h1", "h2", "h3"}, Commands: []string{"/usr/bin/x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SudoersAdd(entry); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTestFile(t, fsys, m.SudoersPath()), testSudoers+"deploy h1,h2,h3=(ALL) /usr/bin/x\n"; got != want {
+		t.Errorf("sudoers = %q, want %q", got, want)
+	}
+}
+
+// renameSpyFS records the mode of each file as it is renamed into place.
+type renameSpyFS struct {
+	*MemFS
+	modes map[string]fs.FileMode
+}
+
+func (r *renameSpyFS) Rename(oldpath, newpath string) error {
+	if fi, err := r.MemFS.Stat(oldpath); err == nil {
+		r.modes[newpath] = fi.Mode().Perm()
+	}
+	return r.MemFS.Rename(oldpath, newpath)
+}
+
+func TestDropInModeBeforeRename(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing fs.FileMode // 0: no drop-in yet
+	}{
+		{"new drop-in", 0},
+		{"existing 0644 drop-in", 0o644},
+		{"existing 0440 drop-in", 0o440},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, mem, _ := newSudoersManager(t, nil)
+			spy := &renameSpyFS{MemFS: mem, modes: map[string]fs.FileMode{}}
+			m.FS = spy
+			path, err := m.DropInPath("deploy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != 0 {
+				if err := mem.WriteFile(path, []byte(DropInMarker+"\n"), tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := m.DropInAdd("deploy", "deploy ALL=(ALL) /usr/bin/x"); err != nil {
+				t.Fatal(err)
+			}
+			if got, ok := spy.modes[path]; !ok || got != 0o440 {
+				t.Errorf("mode at rename = %v (renamed %v), want 0440", got, ok)
+			}
+			fi, err := mem.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fi.Mode().Perm(); got != 0o440 {
+				t.Errorf("drop-in mode = %v, want 0440", got)
+			}
+		})
+	}
+}
+
+func TestSudoersRemovePreservesMode(t *testing.T) {
+	m, fsys, _ := newSudoersManager(t, nil)
+	writeTestFile(t, fsys, m.SudoersPath(), testSudoers+"deploy ALL=(ALL) /usr/bin/x\n")
+	if err := fsys.Chmod(m.SudoersPath(), 0o440); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SudoersRemove("deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fsys, m.SudoersPath()); got != testSudoers {
+		t.Errorf("sudoers = %q, want %q", got, testSudoers)
+	}
+	fi, err := fsys.Stat(m.SudoersPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0o440 {
+		t.Errorf("mode after remove = %v, want 0440", got)
+	}
+}
+
+func TestSudoersAddRemoveCyclesAreStable(t *testing.T) {
+	m, fsys, _ := newSudoersManager(t, nil)
+	for i := 0; i < 100; i++ {
+		if err := m.SudoersAdd("deploy ALL=(ALL) /usr/bin/x"); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SudoersRemove("deploy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readTestFile(t, fsys, m.SudoersPath()); got != testSudoers {
+		t.Errorf("after 100 cycles sudoers = %q, want %q", got, testSudoers)
+	}
+}
+
+func TestSudoersVisudoVerdict(t *testing.T) {
+	const entry = "deploy ALL=(ALL) /usr/bin/x"
+	reject := func(string, ...string) ([]byte, error) {
+		return []byte(">>> /etc/sudoers.tmp: syntax error near line 2 <<<\n"), errors.New("exit status 1")
+	}
+	timeout := func(string, ...string) ([]byte, error) { return nil, context.DeadlineExceeded }
+	tests := []struct {
+		name    string
+		before  string
+		op      func(m *Manager) error
+		run     func(string, ...string) ([]byte, error)
+		after   string
+		wantErr error // nil: success
+	}{
+		{"add accepted", testSudoers, func(m *Manager) error { return m.SudoersAdd(entry) }, nil,
+			testSudoers + entry + "\n", nil},
+		{"add rejected", testSudoers, func(m *Manager) error { return m.SudoersAdd(entry) }, reject,
+			testSudoers, ErrInvalid},
+		{"add timed out", testSudoers, func(m *Manager) error { return m.SudoersAdd(entry) }, timeout,
+			testSudoers, context.DeadlineExceeded},
+		{"remove accepted", testSudoers + entry + "\n", func(m *Manager) error { return m.SudoersRemove("deploy") }, nil,
+			testSudoers, nil},
+		{"remove rejected", testSudoers + entry + "\n", func(m *Manager) error { return m.SudoersRemove("deploy") }, reject,
+			testSudoers + entry + "\n", ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys, r := newSudoersManager(t, tt.run)
+			writeTestFile(t, fsys, m.SudoersPath(), tt.before)
+			err := tt.op(m)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == ErrInvalid && !strings.Contains(err.Error(), "syntax error near line 2") {
+				t.Errorf("error %q does not carry visudo's output", err)
+			}
+			if got := readTestFile(t, fsys, m.SudoersPath()); got != tt.after {
+				t.Errorf("sudoers = %q, want %q", got, tt.after)
+			}
+			if n := len(visudoArgs(r.calls)); n != 1 {
+				t.Errorf("visudo ran %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestSudoersRemoveDryRun(t *testing.T) {
+	const entry = "deploy ALL=(ALL) /usr/bin/x"
+	tests := []struct {
+		name string
+		op   func(m *Manager) error
+	}{
+		{"by pattern", func(m *Manager) error { return m.SudoersRemove("deploy") }},
+		{"by line", func(m *Manager) error {
+			_, _, err := m.SudoersRemoveLine("", 2)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys, _ := newSudoersManager(t, nil)
+			writeTestFile(t, fsys, m.SudoersPath(), testSudoers+entry+"\n")
+			var diffs []string
+			m.DryRun = true
+			m.Preview = func(_, d string) { diffs = append(diffs, d) }
+			if err := tt.op(m); err != nil {
+				t.Fatal(err)
+			}
+			if got := readTestFile(t, fsys, m.SudoersPath()); got != testSudoers+entry+"\n" {
+				t.Errorf("dry run changed sudoers to %q", got)
+			}
+			if len(diffs) != 1 || !strings.Contains(diffs[0], "-"+entry+"\n") {
+				t.Errorf("previews = %q, want one removing %s", diffs, entry)
+			}
+			ents, err := fsys.ReadDir("/etc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range ents {
+				if e.Name() != "sudoers" {
+					t.Errorf("left behind /etc/%s", e.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestSudoersRemoveLineResolvesFile(t *testing.T) {
+	const (
+		main = "root ALL=(ALL:ALL) ALL\n#includedir /etc/sudoers.d\ndeploy ALL=(ALL) /usr/bin/x\n"
+		web  = "# web servers\nweb ALL=(ALL) /usr/bin/w\nops ALL=(ALL) /usr/bin/o\n"
+	)
+	tests := []struct {
+		name     string
+		file     string
+		n        int
+		wantPath string
+		wantLine string
+		wantErr  error
+	}{
+		{"only in the main file", "", 1, "/etc/sudoers", "root ALL=(ALL:ALL) ALL", nil},
+		{"only in a drop-in", "", 2, "/etc/sudoers.d/web", "web ALL=(ALL) /usr/bin/w", nil},
+		{"ambiguous", "", 3, "", "", ErrInvalid},
+		{"drop-in by name", "web", 3, "/etc/sudoers.d/web", "ops ALL=(ALL) /usr/bin/o", nil},
+		{"drop-in by path", "/etc/sudoers.d/web", 3, "/etc/sudoers.d/web", "ops ALL=(ALL) /usr/bin/o", nil},
+		{"main file by path", "/etc/sudoers", 3, "/etc/sudoers", "deploy ALL=(ALL) /usr/bin/x", nil},
+		{"unlisted path", "/etc/other", 3, "", "", ErrNotFound},
+		{"no such rule", "", 5, "", "", ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, fsys, _ := newSudoersManager(t, nil)
+			writeTestFile(t, fsys, "/etc/sudoers", main)
+			writeTestFile(t, fsys, "/etc/sudoers.d/web", web)
+			path, line, err := m.SudoersRemoveLine(tt.file, tt.n)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				if readTestFile(t, fsys, "/etc/sudoers") != main || readTestFile(t, fsys, "/etc/sudoers.d/web") != web {
+					t.Error("a refused removal changed a file")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if path != tt.wantPath || line != tt.wantLine {
+				t.Errorf("removed %s: %q, want %s: %q", path, line, tt.wantPath, tt.wantLine)
+			}
+			if content := readTestFile(t, fsys, path); containsLine(content, tt.wantLine) {
+				t.Errorf("%s still has %q:\n%s", path, tt.wantLine, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package shctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ----------------- RC syntax check -----------------
+//
+// A broken quote in an rc file makes every new terminal fail to start, so
+// rc files can be parsed with the target shell's -n (no-execute) mode
+// before they are written or sourced.
+
+// SyntaxProblem is one error reported by the shell's syntax check. Line is
+// 0 when the shell didn't name one.
+type SyntaxProblem struct {
+	Line    int
+	Message string
+}
+
+// SyntaxError reports that path does not parse in shell.
+type SyntaxError struct {
+	Path     string
+	Shell    string
+	Problems []SyntaxProblem
+}
+
+func (e *SyntaxError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %s -n reports syntax errors", e.Path, e.Shell)
+	for _, p := range e.Problems {
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "\n  line %d: %s", p.Line, p.Message)
+		} else {
+			fmt.Fprintf(&b, "\n  %s", p.Message)
+		}
+	}
+	return b.String()
+}
+
+// Is makes a SyntaxError match ErrInvalid.
+func (e *SyntaxError) Is(target error) bool { return target == ErrInvalid }
+
+// CheckSyntax parses the rc file at path with the target shell's -n mode.
+// A file that doesn't parse yields a *SyntaxError.
+func (m *Manager) CheckSyntax(path string) error {
+	data, err := m.readFileDecompressed(path)
+	if err != nil {
+		return err
+	}
+	return m.checkSyntaxContent(path, string(data))
+}
+
+// checkSyntaxContent checks content as if it were the file at path. The
+// shell has to read a real file, so content goes to a temp file on disk
+// even when m.FS is not the OS file system.
+func (m *Manager) checkSyntaxContent(path, content string) error {
+	f, err := os.CreateTemp("", "cli-tool-syntax-*")
+	if err != nil {
+		return err
+	}
+	trackTemp(OSFS{}, f.Name())
+	defer func() {
+		os.Remove(f.Name())
+		untrackTemp(f.Name())
+	}()
+	_, err = f.WriteString(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	sh := m.shell()
+	out, err := m.runner().Run(sh, "-n", f.Name())
+	if err == nil {
+		return nil
+	}
+	msg := strings.TrimSpace(strings.ReplaceAll(string(out), f.Name(), path))
+	if msg == "" || errors.Is(err, context.DeadlineExceeded) {
+		// the shell couldn't be run at all, or was killed for taking too long
+		return fmt.Errorf("syntax check with %s -n: %w", sh, err)
+	}
+	return &SyntaxError{Path: path, Shell: sh, Problems: parseSyntaxProblems(msg)}
+}
+
+// syntaxLineRe finds the line number in bash ("file: line 3: ..."), zsh
+// ("file:3: ...") and fish ("file (line 3): ...") messages.
+var syntaxLineRe = regexp.MustCompile(`(?:: line |:|\(line )(\d+)\)?: ?`)
+
+// parseSyntaxProblems turns a shell's -n output into problems, one per
+// line of output that names a line number; other lines (such as fish's
+// excerpt of the offending code) are attached to the preceding problem.
+func parseSyntaxProblems(out string) []SyntaxProblem {
+	var problems []SyntaxProblem
+	for _, ln := range strings.Split(out, "\n") {
+		if strings.TrimSpace(ln) == "" {
+			continue
+		}
+		if loc := syntaxLineRe.FindStringSubmatchIndex(ln); loc != nil {
+			n, _ := strconv.Atoi(ln[loc[2]:loc[3]])
+			problems = append(problems, SyntaxProblem{Line: n, Message: ln[loc[1]:]})
+			continue
+		}
+		if len(problems) == 0 {
+			problems = append(problems, SyntaxProblem{Message: ln})
+			continue
+		}
+		p := &problems[len(problems)-1]
+		p.Message += "\n    " + ln
+	}
+	return problems
+}
@@ -0,0 +1,58 @@
+package shctl
+
+import "sync"
+
+// ----------------- Temp files -----------------
+//
+// Temp files hold copies of the files being changed, sudoers included, so
+// they mustn't outlive the process. Each one is recorded from creation
+// until it is removed or renamed into place, and RemoveTempFiles deletes
+// whatever is left when the process is interrupted before its deferred
+// removals run.
+
+var temps = struct {
+	sync.Mutex
+	files map[string]FS
+}{files: map[string]FS{}}
+
+func trackTemp(fsys FS, name string) {
+	temps.Lock()
+	temps.files[name] = fsys
+	temps.Unlock()
+}
+
+func untrackTemp(name string) {
+	temps.Lock()
+	delete(temps.files, name)
+	temps.Unlock()
+}
+
+// createTemp is FS.CreateTemp, with the file recorded for RemoveTempFiles.
+func (m *Manager) createTemp(dir, pattern string) (File, error) {
+	f, err := m.fsys().CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	trackTemp(m.fsys(), f.Name())
+	return f, nil
+}
+
+// removeTemp removes a temp file from createTemp; one already renamed
+// into place is just forgotten.
+func (m *Manager) removeTemp(name string) {
+	m.fsys().Remove(name)
+	untrackTemp(name)
+}
+
+// RemoveTempFiles removes the temp files of every Manager in the process
+// that are still around. It is meant for a signal handler that is about
+// to exit; operations still running may fail once their temp files are
+// gone.
+func RemoveTempFiles() {
+	temps.Lock()
+	defer temps.Unlock()
+	for name, fsys := range temps.files {
+		fsys.Remove(name)
+		delete(temps.files, name)
+	}
+}
@@ -0,0 +1,113 @@
+package shctl
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+)
+
+// ----------------- Uninstall -----------------
+
+// DropInMarker is the first line of every drop-in DropInAdd creates, so
+// Uninstall can tell them apart from drop-ins it didn't write.
+const DropInMarker = "# Created by cli-tool; removed by `cli-tool uninstall`."
+
+// UninstallResult reports what Uninstall removed.
+type UninstallResult struct {
+	Backups map[string]string // backups taken first, keyed like Backup's result
+	Entries int               // entries removed with the managed block
+	Block   bool              // whether the rc file had a managed block
+	DropIns []string          // drop-ins removed
+}
+
+// Uninstall removes the managed block from the rc file and every drop-in
+// DropInAdd created, after backing each of them up. Hand-written lines and
+// drop-ins without DropInMarker are left alone.
+func (m *Manager) Uninstall() (UninstallResult, error) {
+	res := UninstallResult{Backups: map[string]string{}}
+	rc := m.RCFile
+	data, err := m.readFileOrEmpty(rc)
+	if err != nil {
+		return res, err
+	}
+	if _, _, ok := m.managedRange(splitLines(string(data))); ok {
+		b, err := m.Backup(BackupOptions{RC: true})
+		if err != nil {
+			return res, err
+		}
+		res.Backups["rc"] = b["rc"]
+		if !m.DryRun {
+			m.notef("Backed up %s -> %s\n", rc, b["rc"])
+		}
+		if res.Entries, err = m.removeManagedBlock(rc); err != nil {
+			return res, err
+		}
+		res.Block = true
+	}
+
+	dropIns, err := m.DropIns()
+	if err != nil {
+		return res, err
+	}
+	for _, path := range dropIns {
+		ok, err := m.createdDropIn(path)
+		if err != nil {
+			return res, err
+		}
+		if !ok {
+			continue
+		}
+		// removeDropIn backs the file up first
+		if err := m.removeDropIn(path); err != nil {
+			return res, err
+		}
+		res.DropIns = append(res.DropIns, path)
+	}
+	return res, nil
+}
+
+// removeManagedBlock deletes the managed block of path, markers included,
+// along with the blank line editManagedBlock put in front of it. It
+// returns the number of entries the block held.
+func (m *Manager) removeManagedBlock(path string) (int, error) {
+	unlock, err := m.lockFile(path)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	data, err := m.readFileOrEmpty(path)
+	if err != nil {
+		return 0, err
+	}
+	lines := splitLines(string(data))
+	begin, end, ok := m.managedRange(lines)
+	if !ok {
+		return 0, nil
+	}
+	n := 0
+	for _, ln := range lines[begin:end] {
+		if _, ok := m.ParseEntry(ln); ok {
+			n++
+		}
+	}
+	from := begin - 1
+	if from > 0 && strings.TrimSpace(lines[from-1]) == "" {
+		from--
+	}
+	out := append(append([]string{}, lines[:from]...), lines[end+1:]...)
+	return n, m.commitFile(path, joinLines(out))
+}
+
+// createdDropIn reports whether the drop-in at path starts with
+// DropInMarker.
+func (m *Manager) createdDropIn(path string) (bool, error) {
+	data, err := m.readFileRetry(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	first, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSpace(first) == DropInMarker, nil
+}